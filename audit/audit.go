@@ -0,0 +1,319 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+//Action identifies the kind of audited operation
+type Action string
+
+const (
+	//Read denotes an object served to an authenticated user
+	Read Action = "read"
+	//ShareRead denotes an object served through a share link
+	ShareRead Action = "share_read"
+	//ShareMint denotes the creation of a share link
+	ShareMint Action = "share_mint"
+)
+
+const defaultBatchSize = 1000
+const defaultUploadInterval = 5 * time.Minute
+const maxPendingBatches = 10
+const uploadTimeout = time.Minute
+
+//minUploadBackoff is the delay before retrying a failed upload, doubled on every further failure up to the upload
+//interval
+const minUploadBackoff = 5 * time.Second
+
+//Event is an audit record. Each event embeds the hash of its predecessor, chaining the records of the log
+type Event struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Action    Action    `json:"action"`
+	User      string    `json:"user"`
+	Alias     string    `json:"alias,omitempty"`
+	Bucket    string    `json:"bucket,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	ShareID   string    `json:"share_id,omitempty"`
+	//Error describes why serving the object failed, e.g. after part of it was transferred
+	Error    string `json:"error,omitempty"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+//computeHash hashes the event contents, excluding its own hash
+func (e Event) computeHash() (string, error) {
+	e.Hash = ""
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//Log appends hash chained events to a file, optionally uploading them in batches to a GCS bucket
+type Log struct {
+	mu       sync.Mutex
+	file     *os.File
+	seq      uint64
+	lastHash string
+
+	writer    store.ObjectWriter
+	bucket    string
+	prefix    string
+	batchSize int
+	pending   bytes.Buffer
+	batched   int
+	//queued holds the batches awaiting upload, oldest first
+	queued  []batch
+	flush   chan struct{}
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+//batch is a set of events sealed for upload, named after the sequence number of its last event
+type batch struct {
+	name   string
+	events int
+	data   []byte
+}
+
+//Open opens the audit log configured in the supplied configuration, resuming the chain recorded in the file.
+//Events are uploaded to the configured bucket through writer, when one is configured
+func Open(c config.ProgramConfig, writer store.ObjectWriter) (*Log, error) {
+	last, err := lastEvent(c.Audit.File)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(c.Audit.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{file: f, seq: last.Seq, lastHash: last.Hash, flush: make(chan struct{}, 1), done: make(chan struct{})}
+
+	if c.Audit.Upload.Bucket != "" {
+		if writer == nil {
+			f.Close()
+			return nil, fmt.Errorf("the configured store doesn't support uploading audit events")
+		}
+		l.writer = writer
+		l.bucket = c.Audit.Upload.Bucket
+		l.prefix = c.Audit.Upload.Prefix
+		l.batchSize = c.Audit.Upload.BatchSize
+		if l.batchSize <= 0 {
+			l.batchSize = defaultBatchSize
+		}
+		interval := c.Audit.Upload.Interval.Duration
+		if interval <= 0 {
+			interval = defaultUploadInterval
+		}
+		l.stopped.Add(1)
+		go l.uploadPeriodically(interval)
+	}
+	return l, nil
+}
+
+//lastEvent returns the last event recorded in the file, or a zero event if the file is missing or empty
+func lastEvent(path string) (Event, error) {
+	var last Event
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return last, nil
+	}
+	if err != nil {
+		return last, err
+	}
+	defer f.Close()
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			return last, fmt.Errorf("cannot resume audit log %s: %s", path, err.Error())
+		}
+	}
+	return last, scanner.Err()
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+//Record appends the event to the log, assigning its sequence number and chaining it to the previous one. Uploads
+//happen in the background, so that recording never waits on the bucket. Recording on a nil Log is a no-op
+func (l *Log) Record(e Event) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.PrevHash = l.lastHash
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	l.seq, l.lastHash = e.Seq, e.Hash
+
+	if l.writer != nil {
+		l.pending.Write(line)
+		l.batched++
+		if l.batched >= l.batchSize {
+			l.seal()
+			select {
+			case l.flush <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+//seal moves the pending events to a batch queued for upload, dropping the oldest batches beyond maxPendingBatches.
+//Must be called with l.mu held
+func (l *Log) seal() {
+	if l.batched == 0 {
+		return
+	}
+	l.queued = append(l.queued, batch{
+		name:   fmt.Sprintf("%s%s-%012d.jsonl", l.prefix, time.Now().UTC().Format("20060102T150405Z"), l.seq),
+		events: l.batched,
+		data:   append([]byte(nil), l.pending.Bytes()...),
+	})
+	l.pending.Reset()
+	l.batched = 0
+	if n := len(l.queued) - maxPendingBatches; n > 0 {
+		dropped := 0
+		for _, b := range l.queued[:n] {
+			dropped += b.events
+		}
+		logging.Errorf("dropping %d audit events pending upload: they are only retained in the local audit log", dropped)
+		l.queued = append([]batch(nil), l.queued[n:]...)
+	}
+}
+
+//uploadPeriodically uploads the full batches as soon as they are sealed, and the pending events every interval.
+//Failed uploads are retried with an exponential backoff, capped at the interval
+func (l *Log) uploadPeriodically(interval time.Duration) {
+	defer l.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var (
+		backoff time.Duration
+		retryAt time.Time
+		retry   <-chan time.Time
+	)
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			l.seal()
+			l.mu.Unlock()
+		case <-l.flush:
+		case <-retry:
+		case <-l.done:
+			l.mu.Lock()
+			l.seal()
+			l.mu.Unlock()
+			if !l.uploadQueued() {
+				logging.Errorf("audit events left pending upload on close are only retained in the local audit log")
+			}
+			return
+		}
+		if time.Now().Before(retryAt) {
+			continue
+		}
+		if l.uploadQueued() {
+			backoff, retryAt, retry = 0, time.Time{}, nil
+			continue
+		}
+		backoff = nextBackoff(backoff, interval)
+		retryAt = time.Now().Add(backoff)
+		retry = time.After(backoff)
+	}
+}
+
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	if backoff *= 2; backoff < minUploadBackoff {
+		backoff = minUploadBackoff
+	}
+	if backoff > max && max > minUploadBackoff {
+		backoff = max
+	}
+	return backoff
+}
+
+//uploadQueued uploads the queued batches in order, each as a single object, without holding l.mu. It stops at the
+//first failure, reporting whether the queue has been emptied
+func (l *Log) uploadQueued() bool {
+	for {
+		l.mu.Lock()
+		if len(l.queued) == 0 {
+			l.mu.Unlock()
+			return true
+		}
+		b := l.queued[0]
+		l.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+		err := l.writer.PutObject(ctx, l.bucket, b.name, bytes.NewReader(b.data))
+		cancel()
+		if err != nil {
+			logging.Errorf("cannot upload %d audit events to bucket %s: %v", b.events, l.bucket, err)
+			return false
+		}
+		l.mu.Lock()
+		//the batch may have been dropped meanwhile, if the queue overflowed
+		if len(l.queued) > 0 && l.queued[0].name == b.name {
+			l.queued = l.queued[1:]
+		}
+		l.mu.Unlock()
+	}
+}
+
+//Close uploads the pending events, if any, and closes the file
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.done)
+	l.stopped.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,262 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+func testConfig(t *testing.T) config.ProgramConfig {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var c config.ProgramConfig
+	c.Audit.Enabled = true
+	c.Audit.File = filepath.Join(dir, "audit.log")
+	return c
+}
+
+func recordEvents(t *testing.T, l *Log, events ...Event) {
+	for _, e := range events {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verifyFile(t *testing.T, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	return Verify(f)
+}
+
+func TestChainSurvivesReopening(t *testing.T) {
+	c := testConfig(t)
+	l, err := Open(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordEvents(t, l, Event{Action: Read, User: "jane@lenses.io", Key: "a"}, Event{Action: Read, User: "jane@lenses.io", Key: "b"})
+	l.Close()
+
+	l, err = Open(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordEvents(t, l, Event{Action: ShareMint, User: "joe@lenses.io", Key: "/b1/c"})
+	l.Close()
+
+	n, err := verifyFile(t, c.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Unexpected number of verified events %d", n)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	c := testConfig(t)
+	l, err := Open(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordEvents(t, l, Event{Action: Read, User: "jane@lenses.io", Key: "a"},
+		Event{Action: Read, User: "jane@lenses.io", Key: "b"},
+		Event{Action: Read, User: "jane@lenses.io", Key: "c"})
+	l.Close()
+
+	content, err := ioutil.ReadFile(c.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+
+	altered := strings.Replace(string(content), "jane@lenses.io", "joe@lenses.io", 1)
+	removed := lines[0] + lines[2]
+	truncated := lines[1] + lines[2]
+
+	for name, tampered := range map[string]string{"altered": altered, "removed": removed, "truncated": truncated} {
+		n, err := Verify(strings.NewReader(tampered))
+		var chainErr *ChainError
+		if !errors.As(err, &chainErr) {
+			t.Errorf("%s: expected a chain error, got %v", name, err)
+			continue
+		}
+		if name == "altered" && (chainErr.Line != 1 || n != 0) {
+			t.Errorf("%s: unexpected error %v after %d events", name, err, n)
+		}
+		if name == "truncated" && (chainErr.Line != 1 || n != 0) {
+			t.Errorf("%s: unexpected error %v after %d events", name, err, n)
+		}
+		if name == "removed" && (chainErr.Line != 2 || n != 1) {
+			t.Errorf("%s: unexpected error %v after %d events", name, err, n)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c := testConfig(t)
+	l, err := Open(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	recordEvents(t, l,
+		Event{Time: start, Action: Read, User: "jane@lenses.io", Key: "reports/q1.html"},
+		Event{Time: start.Add(time.Hour), Action: Read, User: "joe@lenses.io", Key: "reports/q2.html"},
+		Event{Time: start.Add(2 * time.Hour), Action: Read, User: "jane@lenses.io", Key: "index.html"})
+	l.Close()
+
+	for _, test := range []struct {
+		filter Filter
+		keys   []string
+	}{
+		{Filter{User: "jane@lenses.io"}, []string{"reports/q1.html", "index.html"}},
+		{Filter{Key: "reports/*"}, []string{"reports/q1.html", "reports/q2.html"}},
+		{Filter{Key: "index.html"}, []string{"index.html"}},
+		{Filter{Since: start.Add(time.Hour), Until: start.Add(2 * time.Hour)}, []string{"reports/q2.html"}},
+	} {
+		f, err := os.Open(c.Audit.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := Query(f, test.filter)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, e := range events {
+			keys = append(keys, e.Key)
+		}
+		if strings.Join(keys, ",") != strings.Join(test.keys, ",") {
+			t.Errorf("Unexpected keys %v for filter %+v", keys, test.filter)
+		}
+	}
+}
+
+type memoryWriter struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memoryWriter) PutObject(ctx context.Context, bucket, key string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[bucket+"/"+key] = b
+	return nil
+}
+
+func (m *memoryWriter) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.objects)
+}
+
+//blockingWriter fails its uploads until released, once the first attempt has started
+type blockingWriter struct {
+	memoryWriter
+	started  chan struct{}
+	release  chan struct{}
+	attempts int32
+}
+
+func (b *blockingWriter) PutObject(ctx context.Context, bucket, key string, r io.Reader) error {
+	if atomic.AddInt32(&b.attempts, 1) == 1 {
+		close(b.started)
+	}
+	select {
+	case <-b.release:
+		return b.memoryWriter.PutObject(ctx, bucket, key, r)
+	case <-time.After(10 * time.Millisecond):
+		return errors.New("unavailable")
+	}
+}
+
+func TestRecordDoesNotWaitForUploads(t *testing.T) {
+	c := testConfig(t)
+	c.Audit.Upload.Bucket = "audit"
+	c.Audit.Upload.BatchSize = 1
+	writer := &blockingWriter{memoryWriter: memoryWriter{objects: make(map[string][]byte)},
+		started: make(chan struct{}), release: make(chan struct{})}
+	l, err := Open(c, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordEvents(t, l, Event{Action: Read, Key: "a"})
+	<-writer.started
+
+	start := time.Now()
+	for i := 0; i < maxPendingBatches+5; i++ {
+		recordEvents(t, l, Event{Action: Read, Key: "b"})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Recording took %s while the upload was failing", elapsed)
+	}
+	close(writer.release)
+	l.Close()
+	//the batch being uploaded when the queue overflowed may still make it
+	if n := writer.count(); n < maxPendingBatches || n > maxPendingBatches+1 {
+		t.Errorf("Expected the last %d batches to be uploaded on close, got %d", maxPendingBatches, n)
+	}
+}
+
+func TestUploadsBatches(t *testing.T) {
+	c := testConfig(t)
+	c.Audit.Upload.Bucket = "audit"
+	c.Audit.Upload.Prefix = "gcs-proxy/"
+	c.Audit.Upload.BatchSize = 2
+	writer := &memoryWriter{objects: make(map[string][]byte)}
+	l, err := Open(c, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordEvents(t, l, Event{Action: Read, Key: "a"}, Event{Action: Read, Key: "b"}, Event{Action: Read, Key: "c"})
+	deadline := time.Now().Add(5 * time.Second)
+	for writer.count() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := writer.count(); n != 1 {
+		t.Errorf("Expected a single batch before closing, got %d", n)
+	}
+	l.Close()
+
+	var uploaded bytes.Buffer
+	for name, content := range writer.objects {
+		if !strings.HasPrefix(name, "audit/gcs-proxy/") {
+			t.Errorf("Unexpected object %s", name)
+		}
+		uploaded.Write(content)
+	}
+	if len(writer.objects) != 2 {
+		t.Errorf("Expected the remaining events to be uploaded on close, got %d batches", len(writer.objects))
+	}
+	local, err := ioutil.ReadFile(c.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.Len() != len(local) {
+		t.Errorf("Expected the uploaded batches to match the local log")
+	}
+}
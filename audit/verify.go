@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+//ChainError reports the first record breaking the hash chain
+type ChainError struct {
+	Line   int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+//Verify checks the integrity of the hash chain read from r, returning the number of verified events. The chain must
+//start with the first event ever recorded, so that removing events from the start of the log is detected too
+func Verify(r io.Reader) (int, error) {
+	scanner := newScanner(r)
+	var prev Event
+	count, line := 0, 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return count, &ChainError{Line: line, Reason: "malformed event: " + err.Error()}
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return count, err
+		}
+		switch {
+		case hash != e.Hash:
+			return count, &ChainError{Line: line, Reason: "event hash mismatch, the event has been altered"}
+		case count == 0 && (e.PrevHash != "" || e.Seq != 1):
+			return count, &ChainError{Line: line, Reason: "the first event isn't the start of the chain, events have been removed"}
+		case count > 0 && e.PrevHash != prev.Hash:
+			return count, &ChainError{Line: line, Reason: "previous hash mismatch, an event has been removed or reordered"}
+		case count > 0 && e.Seq != prev.Seq+1:
+			return count, &ChainError{Line: line, Reason: fmt.Sprintf("expected sequence number %d, found %d", prev.Seq+1, e.Seq)}
+		}
+		prev = e
+		count++
+	}
+	return count, scanner.Err()
+}
+
+//Filter selects events by user, key, action and time range. Zero fields match any event
+type Filter struct {
+	User string
+	//Key matches events for the supplied key or, when ending with *, for keys starting with the preceding prefix
+	Key    string
+	Action Action
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f Filter) matches(e Event) bool {
+	if f.User != "" && f.User != e.User {
+		return false
+	}
+	if f.Key != "" {
+		if prefix := strings.TrimSuffix(f.Key, "*"); prefix != f.Key {
+			if !strings.HasPrefix(e.Key, prefix) {
+				return false
+			}
+		} else if f.Key != e.Key {
+			return false
+		}
+	}
+	if f.Action != "" && f.Action != e.Action {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+//Query returns the events read from r matching the supplied filter
+func Query(r io.Reader, f Filter) ([]Event, error) {
+	scanner := newScanner(r)
+	var events []Event
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return events, fmt.Errorf("line %d: malformed event: %s", line, err.Error())
+		}
+		if f.matches(e) {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,348 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/metrics"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+const bytesPerMB = 1024 * 1024
+
+const defaultTTL = 30 * time.Second
+const defaultMaxMemoryMB = 128
+const defaultMaxObjectSizeMB = 8
+const defaultMaxEntries = 10000
+const defaultMaxDiskMB = 1024
+
+//coalescedCallTimeout bounds the upstream calls shared by coalesced lookups, as these outlive the requests waiting
+//for them
+const coalescedCallTimeout = time.Minute
+
+//Store decorates a store.ObjectStoreOps, caching object content in a bounded in-memory LRU optionally backed by
+//an on-disk tier. Content is keyed by bucket, key and generation, while metadata is revalidated against the
+//upstream store once older than the configured TTL. Concurrent misses for the same object are coalesced into
+//a single upstream request.
+type Store struct {
+	upstream      store.ObjectStoreOps
+	ttl           time.Duration
+	maxObjectSize int64
+
+	mu      sync.Mutex
+	meta    *lru
+	content *lru
+	disk    *diskTier
+
+	calls group
+
+	hits     uint64
+	diskHits uint64
+	misses   uint64
+}
+
+type metaEntry struct {
+	meta      store.ObjectMetadata
+	fetchedAt time.Time
+}
+
+//New wraps upstream in a cache configured from the supplied configuration
+func New(upstream store.ObjectStoreOps, c config.ProgramConfig) (*Store, error) {
+	ttl := c.Cache.TTL.Duration
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	maxMemoryMB := c.Cache.MaxMemoryMB
+	if maxMemoryMB <= 0 {
+		maxMemoryMB = defaultMaxMemoryMB
+	}
+	maxObjectSizeMB := c.Cache.MaxObjectSizeMB
+	if maxObjectSizeMB <= 0 {
+		maxObjectSizeMB = defaultMaxObjectSizeMB
+	}
+	maxEntries := c.Cache.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxEntries
+	}
+
+	s := &Store{
+		upstream:      upstream,
+		ttl:           ttl,
+		maxObjectSize: maxObjectSizeMB * bytesPerMB,
+		meta:          newLRU(int64(maxEntries), nil),
+		content:       newLRU(maxMemoryMB*bytesPerMB, nil),
+		calls:         group{timeout: coalescedCallTimeout},
+	}
+	if c.Cache.DiskDir != "" {
+		maxDiskMB := c.Cache.MaxDiskMB
+		if maxDiskMB <= 0 {
+			maxDiskMB = defaultMaxDiskMB
+		}
+		disk, err := newDiskTier(c.Cache.DiskDir, maxDiskMB*bytesPerMB)
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialise disk cache in %s: %s", c.Cache.DiskDir, err.Error())
+		}
+		s.disk = disk
+	}
+	return s, nil
+}
+
+func metaKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+func contentKey(bucket, key string, generation int64) string {
+	return fmt.Sprintf("%s/%s#%d", bucket, key, generation)
+}
+
+//GetObjectMetadata returns the cached metadata for the object, fetching it from the upstream store when stale
+func (s *Store) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	mk := metaKey(bucket, key)
+	s.mu.Lock()
+	v, cached := s.meta.get(mk)
+	s.mu.Unlock()
+	if cached {
+		if e := v.(metaEntry); time.Since(e.fetchedAt) < s.ttl {
+			return e.meta, nil
+		}
+	}
+
+	v, err := s.calls.do(ctx, "meta:"+mk, func(ctx context.Context) (interface{}, error) {
+		meta, err := s.upstream.GetObjectMetadata(ctx, bucket, key)
+		var notFound *store.ObjectNotFound
+		if errors.As(err, &notFound) {
+			s.mu.Lock()
+			s.meta.remove(mk)
+			s.mu.Unlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		//drop the content cached for a generation that has since been overwritten
+		var staleKey string
+		s.mu.Lock()
+		if old, ok := s.meta.get(mk); ok {
+			if generation := old.(metaEntry).meta.Generation(); generation != meta.Generation() {
+				staleKey = contentKey(bucket, key, generation)
+				s.content.remove(staleKey)
+			}
+		}
+		s.meta.add(mk, metaEntry{meta: meta, fetchedAt: time.Now()}, 1)
+		s.mu.Unlock()
+		if staleKey != "" && s.disk != nil {
+			s.disk.remove(staleKey)
+		}
+		return meta, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(store.ObjectMetadata), nil
+}
+
+//CopyObject writes the object content to w, serving it from the cache where possible
+func (s *Store) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	meta, err := s.GetObjectMetadata(ctx, bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	if meta.Size() > s.maxObjectSize {
+		logging.SetCacheStatus(ctx, "bypass")
+		return s.upstream.CopyObject(ctx, bucket, key, w)
+	}
+	content, err := s.fetch(ctx, bucket, key, meta)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(content)
+	return int64(n), err
+}
+
+//SignedURL delegates to the upstream store, when this is able to sign URLs
+func (s *Store) SignedURL(method, bucket, key string, expires time.Time) (string, error) {
+	signer, ok := s.upstream.(store.URLSigner)
+	if !ok {
+		return "", store.ErrNotSupported
+	}
+	return signer.SignedURL(method, bucket, key, expires)
+}
+
+func (s *Store) lookup(ctx context.Context, bucket, ck string) ([]byte, bool) {
+	s.mu.Lock()
+	v, ok := s.content.get(ck)
+	s.mu.Unlock()
+	if ok {
+		atomic.AddUint64(&s.hits, 1)
+		metrics.CacheLookups.WithLabelValues(bucket, "hit").Inc()
+		logging.SetCacheStatus(ctx, "hit")
+		return v.([]byte), true
+	}
+	if s.disk == nil {
+		return nil, false
+	}
+	content, ok := s.disk.get(ck)
+	if ok {
+		atomic.AddUint64(&s.diskHits, 1)
+		metrics.CacheLookups.WithLabelValues(bucket, "disk_hit").Inc()
+		logging.SetCacheStatus(ctx, "disk_hit")
+		s.mu.Lock()
+		s.content.add(ck, content, int64(len(content)))
+		s.mu.Unlock()
+	}
+	return content, ok
+}
+
+func (s *Store) fetch(ctx context.Context, bucket, key string, meta store.ObjectMetadata) ([]byte, error) {
+	ck := contentKey(bucket, key, meta.Generation())
+	if content, ok := s.lookup(ctx, bucket, ck); ok {
+		return content, nil
+	}
+	atomic.AddUint64(&s.misses, 1)
+	metrics.CacheLookups.WithLabelValues(bucket, "miss").Inc()
+	logging.SetCacheStatus(ctx, "miss")
+	v, err := s.calls.do(ctx, "content:"+ck, func(ctx context.Context) (interface{}, error) {
+		var buf bytes.Buffer
+		buf.Grow(int(meta.Size()))
+		if _, err := s.upstream.CopyObject(ctx, bucket, key, &buf); err != nil {
+			return nil, err
+		}
+		content := buf.Bytes()
+		if int64(len(content)) != meta.Size() {
+			//the object has been overwritten since its metadata was fetched: serve it without caching it
+			return content, nil
+		}
+		s.mu.Lock()
+		s.content.add(ck, content, int64(len(content)))
+		s.mu.Unlock()
+		if s.disk != nil {
+			if err := s.disk.put(ck, content); err != nil {
+				logging.Warnf("cannot write %s to the disk cache: %v", ck, err)
+			}
+		}
+		return content, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+//Stats summarises the content of the cache and the outcome of the lookups since the process started
+type Stats struct {
+	MetadataEntries int    `json:"metadata_entries"`
+	MemoryEntries   int    `json:"memory_entries"`
+	MemoryBytes     int64  `json:"memory_bytes"`
+	MaxMemoryBytes  int64  `json:"max_memory_bytes"`
+	DiskEntries     int    `json:"disk_entries"`
+	DiskBytes       int64  `json:"disk_bytes"`
+	MaxDiskBytes    int64  `json:"max_disk_bytes"`
+	Hits            uint64 `json:"hits"`
+	DiskHits        uint64 `json:"disk_hits"`
+	Misses          uint64 `json:"misses"`
+}
+
+//Stats returns the current size of the cache tiers and the lookup counters
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	stats := Stats{
+		MetadataEntries: s.meta.len(),
+		MemoryEntries:   s.content.len(),
+		MemoryBytes:     s.content.size,
+		MaxMemoryBytes:  s.content.maxSize,
+	}
+	s.mu.Unlock()
+	if s.disk != nil {
+		stats.DiskEntries, stats.DiskBytes, stats.MaxDiskBytes = s.disk.stats()
+	}
+	stats.Hits = atomic.LoadUint64(&s.hits)
+	stats.DiskHits = atomic.LoadUint64(&s.diskHits)
+	stats.Misses = atomic.LoadUint64(&s.misses)
+	return stats
+}
+
+//Clear drops the cached metadata and content, including the files of the disk tier. Lookups in flight complete
+//normally, possibly caching their result again
+func (s *Store) Clear() {
+	s.mu.Lock()
+	s.meta.clear()
+	s.content.clear()
+	s.mu.Unlock()
+	if s.disk != nil {
+		s.disk.clear()
+	}
+}
+
+//detached carries the values of its parent context (e.g. the active span) without inheriting its cancellation,
+//so that a coalesced upstream call isn't aborted when the client that initiated it goes away
+type detached struct {
+	parent context.Context
+}
+
+func (d detached) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (d detached) Done() <-chan struct{}             { return nil }
+func (d detached) Err() error                        { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+//group coalesces concurrent calls sharing the same key into a single execution
+type group struct {
+	timeout time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+//do runs fn once for the concurrent calls sharing the same key. fn runs in the background, with the values of the
+//ctx of the first caller but not its cancellation, up to the group timeout: callers going away don't abort the call
+//for the others, while each of them stops waiting as soon as its own ctx is done
+func (g *group) do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			callCtx, cancel := context.WithTimeout(detached{ctx}, g.timeout)
+			defer cancel()
+			c.value, c.err = fn(callCtx)
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.value, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//ListObjects delegates to the upstream store, when this is able to list objects. Listings are not cached
+func (s *Store) ListObjects(ctx context.Context, bucket, prefix, delimiter string, fn func(store.ListEntry) error) error {
+	lister, ok := s.upstream.(store.Lister)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	return lister.ListObjects(ctx, bucket, prefix, delimiter, fn)
+}
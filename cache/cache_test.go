@@ -0,0 +1,326 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+type testObject struct {
+	body       string
+	generation int64
+}
+
+func (o testObject) ContentType() string { return "text/plain" }
+func (o testObject) Size() int64         { return int64(len(o.body)) }
+func (o testObject) Updated() time.Time  { return time.Time{} }
+func (o testObject) Generation() int64   { return o.generation }
+
+func (o testObject) CacheControl() string        { return "" }
+func (o testObject) ContentEncoding() string     { return "" }
+func (o testObject) ContentLanguage() string     { return "" }
+func (o testObject) ContentDisposition() string  { return "" }
+func (o testObject) Metadata() map[string]string { return nil }
+
+//countingStore is an in-memory store counting the requests it serves
+type countingStore struct {
+	mu        sync.Mutex
+	objects   map[string]testObject
+	metaCalls int32
+	copyCalls int32
+	//release, when set, blocks CopyObject until closed
+	release chan struct{}
+}
+
+func (s *countingStore) put(key, body string, generation int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = testObject{body: body, generation: generation}
+}
+
+func (s *countingStore) get(bucket, key string) (testObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	if !ok {
+		return o, &store.ObjectNotFound{Bucket: bucket, Key: key}
+	}
+	return o, nil
+}
+
+func (s *countingStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	atomic.AddInt32(&s.metaCalls, 1)
+	return s.get(bucket, key)
+}
+
+func (s *countingStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	atomic.AddInt32(&s.copyCalls, 1)
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	o, err := s.get(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.WriteString(w, o.body)
+	return int64(n), err
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{objects: make(map[string]testObject)}
+}
+
+func testConfig(ttl time.Duration) config.ProgramConfig {
+	var c config.ProgramConfig
+	c.Cache.Enabled = true
+	c.Cache.TTL = config.Duration{Duration: ttl}
+	return c
+}
+
+func read(t *testing.T, s *Store, key string) string {
+	var buf bytes.Buffer
+	if _, err := s.CopyObject(context.Background(), "bucket", key, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestServesRepeatedReadsFromMemory(t *testing.T) {
+	upstream := newCountingStore()
+	upstream.put("key", "content", 1)
+	s, err := New(upstream, testConfig(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if content := read(t, s, "key"); content != "content" {
+			t.Errorf("Unexpected content %s", content)
+		}
+	}
+	if upstream.metaCalls != 1 || upstream.copyCalls != 1 {
+		t.Errorf("Unexpected upstream calls: %d metadata, %d copy", upstream.metaCalls, upstream.copyCalls)
+	}
+}
+
+func TestRevalidatesStaleMetadata(t *testing.T) {
+	upstream := newCountingStore()
+	upstream.put("key", "v1", 1)
+	s, err := New(upstream, testConfig(time.Nanosecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read(t, s, "key")
+	read(t, s, "key")
+	if upstream.copyCalls != 1 {
+		t.Errorf("Expected unchanged generation to be served from cache, got %d copy calls", upstream.copyCalls)
+	}
+
+	upstream.put("key", "v2", 2)
+	if content := read(t, s, "key"); content != "v2" {
+		t.Errorf("Unexpected content %s", content)
+	}
+	if upstream.copyCalls != 2 {
+		t.Errorf("Unexpected copy calls %d", upstream.copyCalls)
+	}
+}
+
+func TestCoalescesConcurrentMisses(t *testing.T) {
+	upstream := newCountingStore()
+	upstream.put("key", "content", 1)
+	upstream.release = make(chan struct{})
+	s, err := New(upstream, testConfig(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.GetObjectMetadata(context.Background(), "bucket", "key")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read(t, s, "key")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.release)
+	wg.Wait()
+
+	if upstream.copyCalls != 1 {
+		t.Errorf("Unexpected copy calls %d", upstream.copyCalls)
+	}
+}
+
+func TestCoalescedWaitersGiveUpOnCancellation(t *testing.T) {
+	upstream := newCountingStore()
+	upstream.put("key", "content", 1)
+	upstream.release = make(chan struct{})
+	s, err := New(upstream, testConfig(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.CopyObject(ctx, "bucket", "key", ioutil.Discard)
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the canceled read kept waiting for the upstream call")
+	}
+
+	//the shared call carries on for the other readers
+	close(upstream.release)
+	if content := read(t, s, "key"); content != "content" {
+		t.Errorf("Unexpected content %q", content)
+	}
+	if upstream.copyCalls != 1 {
+		t.Errorf("Unexpected copy calls %d", upstream.copyCalls)
+	}
+}
+
+func TestCoalescedCallsTimeOut(t *testing.T) {
+	upstream := newCountingStore()
+	upstream.put("key", "content", 1)
+	upstream.release = make(chan struct{})
+	defer close(upstream.release)
+	s, err := New(upstream, testConfig(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.calls.timeout = 50 * time.Millisecond
+
+	if _, err := s.CopyObject(context.Background(), "bucket", "key", ioutil.Discard); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestBypassesLargeObjects(t *testing.T) {
+	upstream := newCountingStore()
+	upstream.put("key", string(make([]byte, bytesPerMB+1)), 1)
+	c := testConfig(time.Minute)
+	c.Cache.MaxObjectSizeMB = 1
+	s, err := New(upstream, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read(t, s, "key")
+	read(t, s, "key")
+	if upstream.copyCalls != 2 {
+		t.Errorf("Unexpected copy calls %d", upstream.copyCalls)
+	}
+}
+
+func TestDiskTierSurvivesRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcs-proxy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := newCountingStore()
+	upstream.put("key", "content", 1)
+	c := testConfig(time.Minute)
+	c.Cache.DiskDir = dir
+
+	s, err := New(upstream, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(t, s, "key")
+
+	restarted, err := New(upstream, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := read(t, restarted, "key"); content != "content" {
+		t.Errorf("Unexpected content %s", content)
+	}
+	if upstream.copyCalls != 1 {
+		t.Errorf("Unexpected copy calls %d", upstream.copyCalls)
+	}
+}
+
+func TestClearDropsEveryTier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcs-proxy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := newCountingStore()
+	upstream.put("key", "content", 1)
+	c := testConfig(time.Minute)
+	c.Cache.DiskDir = dir
+	s, err := New(upstream, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(t, s, "key")
+	read(t, s, "key")
+
+	stats := s.Stats()
+	if stats.MetadataEntries != 1 || stats.MemoryEntries != 1 || stats.MemoryBytes != 7 || stats.DiskEntries != 1 || stats.DiskBytes != 7 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Unexpected lookups %+v", stats)
+	}
+
+	s.Clear()
+	if stats := s.Stats(); stats.MetadataEntries != 0 || stats.MemoryEntries != 0 || stats.DiskEntries != 0 || stats.DiskBytes != 0 {
+		t.Errorf("Unexpected stats after clearing %+v", stats)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the cached files to be removed, found %d", len(files))
+	}
+	read(t, s, "key")
+	if upstream.copyCalls != 2 {
+		t.Errorf("Unexpected copy calls %d", upstream.copyCalls)
+	}
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	var evicted []string
+	c := newLRU(10, func(key string, _ interface{}) { evicted = append(evicted, key) })
+	c.add("a", nil, 4)
+	c.add("b", nil, 4)
+	c.get("a")
+	c.add("c", nil, 4)
+
+	if _, ok := c.get("b"); ok {
+		t.Errorf("Expected b to be evicted")
+	}
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("Unexpected evictions %v", evicted)
+	}
+	c.add("d", nil, 11)
+	if c.len() != 2 {
+		t.Errorf("Unexpected length %d", c.len())
+	}
+}
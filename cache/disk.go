@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/afiore/gcs-proxy/logging"
+)
+
+const tempFilePrefix = ".tmp-"
+
+//diskTier stores cached objects as files named after the hash of their cache key
+type diskTier struct {
+	dir   string
+	mu    sync.Mutex
+	index *lru
+}
+
+func newDiskTier(dir string, maxSize int64) (*diskTier, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	d := &diskTier{dir: dir}
+	d.index = newLRU(maxSize, func(name string, _ interface{}) {
+		if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !os.IsNotExist(err) {
+			logging.Warnf("cannot remove cached file %s: %v", name, err)
+		}
+	})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	//index the files left by a previous run, oldest first so that they are the first to be evicted
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(f.Name(), tempFilePrefix) {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		d.index.add(f.Name(), nil, f.Size())
+	}
+	return d, nil
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *diskTier) get(key string) ([]byte, bool) {
+	name := fileName(key)
+	d.mu.Lock()
+	_, ok := d.index.get(name)
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	content, err := ioutil.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		logging.Warnf("cannot read cached file %s: %v", name, err)
+		d.remove(key)
+		return nil, false
+	}
+	return content, true
+}
+
+func (d *diskTier) put(key string, content []byte) error {
+	if int64(len(content)) > d.index.maxSize {
+		return nil
+	}
+	name := fileName(key)
+	tmp, err := ioutil.TempFile(d.dir, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(d.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	d.mu.Lock()
+	d.index.add(name, nil, int64(len(content)))
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *diskTier) remove(key string) {
+	d.mu.Lock()
+	d.index.remove(fileName(key))
+	d.mu.Unlock()
+}
+
+//stats returns the number of cached files and their total size
+func (d *diskTier) stats() (int, int64, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.index.len(), d.index.size, d.index.maxSize
+}
+
+//clear removes every cached file
+func (d *diskTier) clear() {
+	d.mu.Lock()
+	d.index.clear()
+	d.mu.Unlock()
+}
@@ -0,0 +1,85 @@
+package cache
+
+import "container/list"
+
+//lru is a size bounded least recently used cache. It is not safe for concurrent use
+type lru struct {
+	maxSize int64
+	size    int64
+	ll      *list.List
+	items   map[string]*list.Element
+	//onEvict, when set, is called for every entry dropped from the cache
+	onEvict func(key string, value interface{})
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+func newLRU(maxSize int64, onEvict func(key string, value interface{})) *lru {
+	return &lru{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		onEvict: onEvict,
+	}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+//add inserts or replaces the entry for key, evicting the least recently used entries if the cache
+//outgrows its maximum size. Entries larger than the maximum size are not added
+func (c *lru) add(key string, value interface{}, size int64) {
+	if size > c.maxSize {
+		c.remove(key)
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		c.size += size - e.size
+		e.value = value
+		e.size = size
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, size: size})
+		c.size += size
+	}
+	for c.size > c.maxSize {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lru) remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lru) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, e.key)
+	c.size -= e.size
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value)
+	}
+}
+
+func (c *lru) len() int {
+	return c.ll.Len()
+}
+
+//clear removes every entry, calling onEvict for each of them
+func (c *lru) clear() {
+	for c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
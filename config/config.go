@@ -1,18 +1,319 @@
 package config
 
+import (
+	"strings"
+	"time"
+)
+
 //ProgramConfig struct exposes the parsed program configuration
 type ProgramConfig struct {
-	Gcs gcs
-	Web web
+	Gcs     gcs
+	Web     web
+	Cache   cache
+	Tracing tracing
+	Log     logging
+	Audit   auditLog
+}
+
+const redacted = "[REDACTED]"
+
+//Redacted returns a copy of the configuration with its secrets masked, suitable for logging
+func (c ProgramConfig) Redacted() ProgramConfig {
+	c.Web.OAuth.ClientSecret = redact(c.Web.OAuth.ClientSecret)
+	c.Web.OAuth.SessionSecret = redact(c.Web.OAuth.SessionSecret)
+	c.Web.Share.Secret = redact(c.Web.Share.Secret)
+	c.Web.Admin.Token = redact(c.Web.Admin.Token)
+	return c
 }
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
 type gcs struct {
 	ServiceAccountFilePath string
 	Buckets                map[string]string
+	//Hosts serve a bucket at the root path of the requests addressed to a host name. They take precedence over the
+	//bucket aliases, which keep serving the requests for the other hosts
+	Hosts []HostRoute
+	//SignedRedirects maps bucket aliases to the policy selecting objects to be served via a redirect to a GCS signed URL
+	SignedRedirects map[string]RedirectPolicy
+	Resilience      resilience
+}
+
+//resilience configures the timeouts, retries and circuit breaker applied to the object store operations
+type resilience struct {
+	Enabled bool
+	//MetadataTimeout bounds each metadata lookup. Defaults to 10s
+	MetadataTimeout Duration
+	//CopyTimeout bounds each object transfer, including the time spent streaming it. Disabled by default
+	CopyTimeout Duration
+	//MaxRetries is the number of times a read failed by a transient error is retried, as long as no byte has been
+	//sent to the client. Defaults to 2, a negative value disables retries
+	MaxRetries int
+	//RetryBaseDelay is the base of the jittered exponential backoff between retries. Defaults to 100ms
+	RetryBaseDelay Duration
+	//BreakerFailures is the number of consecutive transient failures opening the circuit breaker. Defaults to 5,
+	//a negative value disables the breaker
+	BreakerFailures int
+	//BreakerCooldown is how long the open breaker fails calls fast before letting a probe through. Defaults to 30s
+	BreakerCooldown Duration
+}
+
+//HostRoute binds a bucket, and optionally a key prefix within it, to the requests addressed to a host
+type HostRoute struct {
+	//Host is matched case insensitively against the host requested by the client, ignoring the port. A leading *.
+	//matches a single subdomain label, e.g. *.pr.example.com matches 42.pr.example.com but not pr.example.com
+	Host   string
+	Bucket string
+	//Prefix is prepended to the request path to form the object key. {subdomain} is replaced by the label matched by
+	//a wildcard host, and the prefix of wildcard hosts defaults to {subdomain}/
+	Prefix string
+	//IndexDocument is the object served for paths ending with /, e.g. index.html
+	IndexDocument string
+	//Alias names the route in metrics, logs, header rules and signed redirects. Defaults to the host
+	Alias string
+}
+
+//RouteAlias returns the alias naming the route
+func (h HostRoute) RouteAlias() string {
+	if h.Alias != "" {
+		return h.Alias
+	}
+	return strings.ToLower(h.Host)
+}
+
+//AdminHost returns the address the admin listener binds to, applying the defaults of Web.Admin.Host
+func (c ProgramConfig) AdminHost() string {
+	switch {
+	case c.Web.Admin.Host != "":
+		return c.Web.Admin.Host
+	case c.Web.TLS.Enabled:
+		return c.Web.Host
+	default:
+		return "127.0.0.1"
+	}
+}
+
+//RedirectPolicy selects objects that, once the request is authorized, are served through a redirect
+//to a short-lived V4 signed URL rather than being streamed through the proxy
+type RedirectPolicy struct {
+	//MinSizeMB selects objects whose size is at least the supplied number of megabytes
+	MinSizeMB int64
+	//ContentTypes selects objects by content type. Entries are glob patterns (e.g. video/*)
+	ContentTypes []string
+	//TTL is the lifetime of the generated signed URLs
+	TTL Duration
 }
 type web struct {
-	Port  int16
-	OAuth oauth
+	//Host is the address of the interface the listeners bind to. Defaults to all interfaces
+	Host    string
+	Port    int16
+	OAuth   oauth `env:"OAUTH"`
+	Share   share
+	Metrics metrics
+	Admin   admin
+	//HeaderRules override the headers of the objects they match. The first matching rule applies
+	HeaderRules []HeaderRule
+	Rewrites    Rewrites
+	Compression Compression
+	//DrainPeriod is how long the server keeps serving requests while reporting itself as not ready, once asked to shut down
+	DrainPeriod Duration
+	//ShutdownTimeout bounds the time active transfers are given to complete on shutdown. Defaults to 30s
+	ShutdownTimeout Duration
+	Limits          limits
+	TLS             tlsConfig
+	//Scheme is the scheme clients use to reach the proxy (http or https), when this is terminated by a load balancer.
+	//Defaults to https when TLS is enabled and to the scheme of each request otherwise
+	Scheme string
+	//PublicURL is the base URL clients use to reach the proxy (e.g. https://files.example.com/docs). When set, it takes
+	//precedence over the scheme, host and forwarded headers of the requests when generating URLs
+	PublicURL string
+	//PathPrefix is the sub-path the proxy is mounted under. It is stripped from incoming requests and prepended to
+	//the generated URLs
+	PathPrefix string
+	//TrustedProxies lists the IPs or CIDRs of the reverse proxies whose X-Forwarded-* and Forwarded headers are honoured
+	TrustedProxies []string
+}
+
+//tlsConfig enables serving HTTPS, either with the supplied certificate or with certificates obtained through ACME
+type tlsConfig struct {
+	Enabled bool
+	//CertFile and KeyFile are PEM files, reloaded when modified
+	CertFile string
+	KeyFile  string
+	//ACMEDomains lists the host names to obtain certificates for from Let's Encrypt, in place of CertFile and KeyFile
+	ACMEDomains []string
+	//ACMECacheDir stores the obtained certificates and account key across restarts
+	ACMECacheDir string
+	//ACMEEmail is the contact address registered with the ACME account
+	ACMEEmail string
+	//RedirectPort is the plain HTTP port redirecting to HTTPS and answering ACME challenges. Disabled when 0
+	RedirectPort int16
+	//HSTSMaxAge is the max-age advertised in the Strict-Transport-Security header. Defaults to 1 year, a negative value
+	//disables the header
+	HSTSMaxAge Duration
+	//HSTSIncludeSubdomains extends the HSTS policy to subdomains
+	HSTSIncludeSubdomains bool
+}
+
+//limits protect the server from slow and greedy clients
+type limits struct {
+	//ReadHeaderTimeout bounds the time spent reading request headers. Defaults to 10s
+	ReadHeaderTimeout Duration
+	//ReadTimeout bounds the time spent reading requests, body included. Defaults to 1m
+	ReadTimeout Duration
+	//WriteTimeout bounds the time spent writing responses. Disabled by default, as it would cap the duration of downloads
+	WriteTimeout Duration
+	//IdleTimeout bounds the time keep-alive connections are kept open between requests. Defaults to 2m
+	IdleTimeout Duration
+	//MaxHeaderBytes bounds the size of request headers. Defaults to 64KiB
+	MaxHeaderBytes int
+	//MinThroughputBytesPerSec aborts transfers averaging a lower throughput over MinThroughputWindow. Disabled when 0
+	MinThroughputBytesPerSec int64
+	//MinThroughputWindow is the period over which the transfer throughput is measured. Defaults to 30s
+	MinThroughputWindow Duration
+	//MaxInFlight caps the object, login and share link requests served concurrently. Unlimited when 0
+	MaxInFlight int
+	//MaxInFlightPerIP caps the object, login and share link requests served concurrently to a single client IP.
+	//Unlimited when 0
+	MaxInFlightPerIP int
+}
+
+//Rewrites configures the redirects and internal rewrites applied to requests before their object key is resolved
+type Rewrites struct {
+	//Rules are evaluated in order, the first one matching the request applies
+	Rules []RewriteRule
+	//ObjectRedirects answers the requests for objects carrying website-redirect-location metadata, set through the
+	//x-goog-meta-website-redirect-location header, with a permanent redirect to its value
+	ObjectRedirects bool
+}
+
+//RewriteRule redirects, or rewrites internally, the requests it matches
+type RewriteRule struct {
+	//Path is a glob matched against the request path. `*` matches within a path segment and `**` across segments,
+	//capturing the matched text as $1, $2...
+	Path string
+	//Regex is a regular expression matched against the request path, in place of Path. Its groups are captured as
+	//$1, $2... or ${name}
+	Regex string
+	//Host is a glob the requested host must match. `*` matches a single label and `**` any number of them
+	Host string
+	//Headers and Query map request headers and query parameters to a glob their value must match. `*` alone only
+	//requires them to be present
+	Headers map[string]string
+	Query   map[string]string
+	//Target is the path, or for redirects the absolute URL, the captures are expanded into. The request query is
+	//preserved unless Target sets one
+	Target string
+	//Status is the redirect status, one of 301, 302, 307 or 308. When unset, the request path is rewritten internally
+	Status int
+}
+
+//Compression configures the negotiated compression of responses
+type Compression struct {
+	Enabled bool
+	//MinSizeBytes excludes smaller objects from compression
+	MinSizeBytes int64
+	//ContentTypes lists the globs (e.g. text/*) selecting compressible content types. Defaults to common text formats
+	ContentTypes []string
+	//Precompressed enables serving `.br` and `.gz` siblings of the compressible objects requested, when present
+	Precompressed bool
+}
+
+//HeaderRule overrides the caching and presentation headers of the objects it matches.
+//Empty match fields match any object, while empty header fields preserve the value stored along with the object
+type HeaderRule struct {
+	Alias string
+	//Path is a glob matched against the object key. `*` matches within a path segment, `**` across segments
+	Path string
+	//ContentType is a glob matched against the object content type (e.g. text/*)
+	ContentType string
+
+	CacheControl       string
+	ContentEncoding    string
+	ContentLanguage    string
+	ContentDisposition string
+}
+type cache struct {
+	Enabled bool
+	//TTL is how long cached metadata is trusted before being revalidated against the store
+	TTL Duration
+	//MaxMemoryMB bounds the size of the in-memory tier
+	MaxMemoryMB int64
+	//MaxObjectSizeMB excludes larger objects from caching
+	MaxObjectSizeMB int64
+	//MaxEntries bounds the number of cached metadata records
+	MaxEntries int
+	//DiskDir enables the on-disk tier, storing cached objects in the supplied directory
+	DiskDir string
+	//MaxDiskMB bounds the size of the on-disk tier
+	MaxDiskMB int64
+}
+
+type metrics struct {
+	Enabled bool
+	//Port of the listener exposing metrics, separate from the one serving objects
+	Port int16
+	//Path defaults to /metrics
+	Path string
+}
+
+//admin exposes the operational API used by on-call tooling on a separate listener
+type admin struct {
+	Enabled bool
+	//Host is the address the admin listener binds to. It defaults to Web.Host when TLS is enabled and to 127.0.0.1
+	//otherwise, as the token would then travel in clear text
+	Host string
+	//Port of the admin listener, separate from the ones serving objects and metrics
+	Port int16
+	//Token authenticates the admin requests, sent as a bearer token. Must be at least 32 bytes long
+	Token string `secret:"true"`
+}
+
+type tracing struct {
+	Enabled bool
+	//Endpoint is the host:port of the OTLP/HTTP collector. Defaults to localhost:4318
+	Endpoint string
+	//Insecure disables TLS when connecting to the collector
+	Insecure bool
+	//ServiceName defaults to gcs-proxy
+	ServiceName string
+	//SampleRatio is the fraction of new traces to sample. Defaults to 1
+	SampleRatio float64
+}
+
+type logging struct {
+	//Level is one of debug, info, warn or error. Defaults to info
+	Level string
+	//Sink is either stderr (default), stdout or the path of a file to append records to
+	Sink string
+	//AccessLog enables a structured record for every served request
+	AccessLog bool
 }
+
+type auditLog struct {
+	Enabled bool
+	//File is the path of the append-only, hash chained audit log
+	File   string
+	Upload auditUpload
+}
+
+//auditUpload configures the batched upload of audit events to a GCS bucket
+type auditUpload struct {
+	//Bucket receives the audit events. Uploads are disabled when empty
+	Bucket string
+	//Prefix is prepended to the names of the uploaded objects
+	Prefix string
+	//BatchSize is the number of events triggering an upload. Defaults to 1000
+	BatchSize int
+	//Interval is the maximum time events wait before being uploaded. Defaults to 5m
+	Interval Duration
+}
+
 type creds struct {
 	Username string
 	Password string
@@ -20,7 +321,36 @@ type creds struct {
 
 type oauth struct {
 	ClientID           string
-	ClientSecret       string
+	ClientSecret       string `secret:"true"`
 	AllowedHostDomains []string
-	SessionSecret      string
+	SessionSecret      string `secret:"true"`
+	//CallbackURL is the OAuth redirect URL registered with Google. Defaults to the callback path resolved against the
+	//URL clients reach the proxy with
+	CallbackURL string
+}
+
+type share struct {
+	//Secret used to sign share links. Defaults to the OAuth session secret when empty
+	Secret string `secret:"true"`
+	//DefaultTTL is the link lifetime applied when the issuer doesn't request one
+	DefaultTTL Duration
+	//MaxTTL caps the lifetime an issuer can request
+	MaxTTL Duration
+}
+
+//Duration wraps time.Duration so that it can be decoded from strings such as "15m" or "24h"
+type Duration struct {
+	time.Duration
+}
+
+//UnmarshalText parses a duration string into d
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+//MarshalText formats d as a duration string
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
 }
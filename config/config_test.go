@@ -0,0 +1,454 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	return writeConfigAs(t, "config.toml", content)
+}
+
+func writeConfigAs(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	saFile := filepath.Join(dir, "sa.json")
+	if err := ioutil.WriteFile(saFile, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	content = strings.Replace(content, "SA_FILE", saFile, 1)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const validConfig = `[Gcs]
+ServiceAccountFilePath = "SA_FILE"
+[Gcs.Buckets]
+b1 = "bucket1"
+
+[Web]
+Port = 8080
+[Web.OAuth]
+ClientID = "client-id"
+ClientSecret = "client-secret"
+SessionSecret = "0123456789abcdef0123456789abcdef"
+AllowedHostDomains = ["lenses.io"]
+`
+
+func fieldErrors(t *testing.T, err error) []FieldError {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	return validationErr.Errors
+}
+
+func TestLoadValidConfig(t *testing.T) {
+	c, err := Load(writeConfig(t, validConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Gcs.Buckets["b1"] != "bucket1" || c.Web.Port != 8080 {
+		t.Errorf("Unexpected configuration %+v", c)
+	}
+}
+
+func TestUnknownKeysAreReportedWithLines(t *testing.T) {
+	content := strings.Replace(validConfig, `ClientID = "client-id"`, "ClientID = \"client-id\"\nClientId2 = \"typo\"", 1)
+	_, err := Load(writeConfig(t, content))
+	errs := fieldErrors(t, err)
+	if len(errs) != 1 || errs[0].Key != "Web.OAuth.ClientId2" || errs[0].Line != 10 || errs[0].Msg != "unknown key" {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	content := strings.NewReplacer(
+		`ClientSecret = "client-secret"`, `ClientSecret = ""`,
+		`SessionSecret = "0123456789abcdef0123456789abcdef"`, `SessionSecret = "secret"`,
+		`b1 = "bucket1"`, "b1 = \"bucket1\"\n\"b1/archive\" = \"bucket2\"\nb10 = \"bucket3\"",
+	).Replace(validConfig)
+	_, err := Load(writeConfig(t, content))
+
+	byKey := make(map[string]FieldError)
+	for _, e := range fieldErrors(t, err) {
+		byKey[e.Key] = e
+	}
+	for key, line := range map[string]int{
+		"Web.OAuth.ClientSecret":  12,
+		"Web.OAuth.SessionSecret": 13,
+		"Gcs.Buckets.b1/archive":  5,
+	} {
+		if e, ok := byKey[key]; !ok || e.Line != line {
+			t.Errorf("Expected an error for %s at line %d, got %v", key, line, byKey)
+		}
+	}
+	if e, ok := byKey["Gcs.Buckets.b10"]; ok {
+		t.Errorf("Expected aliases sharing a prefix within a segment to be accepted, got %v", e)
+	}
+}
+
+func TestAdminConfigIsValidated(t *testing.T) {
+	content := validConfig + `[Web.Metrics]
+Enabled = true
+Port = 9090
+[Web.Admin]
+Enabled = true
+Host = "0.0.0.0"
+Port = 9090
+Token = "short"
+`
+	_, err := Load(writeConfig(t, content))
+	byKey := make(map[string]FieldError)
+	for _, e := range fieldErrors(t, err) {
+		byKey[e.Key] = e
+	}
+	if _, ok := byKey["Web.Admin.Port"]; !ok {
+		t.Errorf("Expected the admin port clashing with the metrics one to be rejected, got %v", byKey)
+	}
+	if _, ok := byKey["Web.Admin.Token"]; !ok {
+		t.Errorf("Expected the short admin token to be rejected, got %v", byKey)
+	}
+	if _, ok := byKey["Web.Admin.Host"]; !ok {
+		t.Errorf("Expected the admin API to be kept off public interfaces without TLS, got %v", byKey)
+	}
+	for _, test := range []struct {
+		c    ProgramConfig
+		host string
+	}{
+		{ProgramConfig{Web: web{Host: "0.0.0.0"}}, "127.0.0.1"},
+		{ProgramConfig{Web: web{Host: "0.0.0.0", TLS: tlsConfig{Enabled: true}}}, "0.0.0.0"},
+		{ProgramConfig{Web: web{Host: "0.0.0.0", Admin: admin{Host: "::1"}}}, "::1"},
+	} {
+		if host := test.c.AdminHost(); host != test.host {
+			t.Errorf("Unexpected admin host %s, expected %s", host, test.host)
+		}
+	}
+	if c := (ProgramConfig{Web: web{Admin: admin{Token: "token"}}}).Redacted(); c.Web.Admin.Token != redacted {
+		t.Errorf("Expected the admin token to be redacted, got %s", c.Web.Admin.Token)
+	}
+}
+
+func TestHostRoutesAreValidated(t *testing.T) {
+	content := strings.Replace(validConfig, "[Web]", `[[Gcs.Hosts]]
+Host = "*.pr.example.com"
+Bucket = "previews"
+Prefix = "pr-{subdomain}/"
+[[Gcs.Hosts]]
+Host = "reports.example.com"
+Bucket = "reports"
+Alias = "reports"
+
+[Gcs.SignedRedirects.reports]
+MinSizeMB = 10
+
+[Web]`, 1)
+	c, err := Load(writeConfig(t, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Gcs.Hosts) != 2 || c.Gcs.Hosts[0].RouteAlias() != "*.pr.example.com" || c.Gcs.Hosts[1].RouteAlias() != "reports" {
+		t.Errorf("Unexpected host routes %+v", c.Gcs.Hosts)
+	}
+
+	content = strings.Replace(validConfig, "[Web]", `[[Gcs.Hosts]]
+Host = "reports.*.com"
+Bucket = "reports"
+[[Gcs.Hosts]]
+Host = "docs.example.com"
+Prefix = "{subdomain}/"
+Alias = "b1"
+
+[Web]`, 1)
+	_, err = Load(writeConfig(t, content))
+	byKey := make(map[string]FieldError)
+	for _, e := range fieldErrors(t, err) {
+		byKey[e.Key] = e
+	}
+	for _, key := range []string{"Gcs.Hosts.1.Host", "Gcs.Hosts.2.Bucket", "Gcs.Hosts.2.Prefix", "Gcs.Hosts.2.Alias"} {
+		if _, ok := byKey[key]; !ok {
+			t.Errorf("Expected an error for %s, got %v", key, byKey)
+		}
+	}
+}
+
+func TestRewriteRulesAreValidated(t *testing.T) {
+	content := validConfig + `[[Web.Rewrites.Rules]]
+Path = "/b1/reports/**"
+Target = "/b1/archive/$1"
+Status = 301
+[[Web.Rewrites.Rules]]
+Regex = "^/b1/(?P<file>[^/]+$"
+Target = "b1/${file}"
+[[Web.Rewrites.Rules]]
+Path = "/b1/*"
+Regex = "^/b1/.*$"
+Target = "ftp://example.com"
+Status = 303
+`
+	_, err := Load(writeConfig(t, content))
+	byKey := make(map[string]FieldError)
+	for _, e := range fieldErrors(t, err) {
+		byKey[e.Key] = e
+	}
+	for _, key := range []string{"Web.Rewrites.Rules.2.Regex", "Web.Rewrites.Rules.2.Target", "Web.Rewrites.Rules.3", "Web.Rewrites.Rules.3.Status"} {
+		if _, ok := byKey[key]; !ok {
+			t.Errorf("Expected an error for %s, got %v", key, byKey)
+		}
+	}
+	if _, ok := byKey["Web.Rewrites.Rules.1"]; ok || len(byKey) != 4 {
+		t.Errorf("Unexpected errors %v", byKey)
+	}
+}
+
+func TestSampleConfigIsValid(t *testing.T) {
+	_, err := Load("../config.toml")
+	for _, e := range fieldErrors(t, err) {
+		//the sample refers to a service account file that only exists on the author's machine
+		if e.Key != "Gcs.ServiceAccountFilePath" {
+			t.Errorf("Unexpected error in the sample configuration: %v", e)
+		}
+	}
+}
+
+func mapLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for key, expected := range map[string]string{
+		"Web.OAuth.ClientID":             "GCS_PROXY_WEB_OAUTH_CLIENT_ID",
+		"Web.TLS.ACMEDomains":            "GCS_PROXY_WEB_TLS_ACME_DOMAINS",
+		"Web.Limits.MaxInFlightPerIP":    "GCS_PROXY_WEB_LIMITS_MAX_IN_FLIGHT_PER_IP",
+		"Gcs.ServiceAccountFilePath":     "GCS_PROXY_GCS_SERVICE_ACCOUNT_FILE_PATH",
+		"Cache.MaxMemoryMB":              "GCS_PROXY_CACHE_MAX_MEMORY_MB",
+		"Web.TLS.HSTSIncludeSubdomains":  "GCS_PROXY_WEB_TLS_HSTS_INCLUDE_SUBDOMAINS",
+		"Web.Share.Secret":               "GCS_PROXY_WEB_SHARE_SECRET",
+		"Gcs.Resilience.BreakerCooldown": "GCS_PROXY_GCS_RESILIENCE_BREAKER_COOLDOWN",
+	} {
+		if name := EnvName(key); name != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, key, name)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "session-secret")
+	if err := ioutil.WriteFile(secretFile, []byte("fedcba9876543210fedcba9876543210\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var c ProgramConfig
+	c.Web.Port = 8080
+	c.Web.OAuth.ClientID = "from-file"
+	err = c.ApplyEnv(mapLookup(map[string]string{
+		"GCS_PROXY_WEB_PORT":                           "9090",
+		"GCS_PROXY_WEB_OAUTH_CLIENT_ID":                "from-env",
+		"GCS_PROXY_WEB_OAUTH_SESSION_SECRET_FILE":      secretFile,
+		"GCS_PROXY_WEB_OAUTH_ALLOWED_HOST_DOMAINS":     "lenses.io, example.com",
+		"GCS_PROXY_GCS_BUCKETS":                        `{"b1": "bucket1"}`,
+		"GCS_PROXY_GCS_RESILIENCE_ENABLED":             "true",
+		"GCS_PROXY_GCS_RESILIENCE_METADATA_TIMEOUT":    "5s",
+		"GCS_PROXY_TRACING_SAMPLE_RATIO":               "0.5",
+		"GCS_PROXY_GCS_SIGNED_REDIRECTS":               `{"b1": {"MinSizeMB": 10, "TTL": "15m"}}`,
+		"GCS_PROXY_WEB_LIMITS_MIN_THROUGHPUT_WINDOW":   "30s",
+		"GCS_PROXY_WEB_LIMITS_MAX_IN_FLIGHT_PER_IP":    "4",
+		"GCS_PROXY_UNRELATED_VARIABLE_IS_IGNORED":      "x",
+		"GCS_PROXY_WEB_OAUTH_CLIENT_SECRET_IS_IGNORED": "x",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Web.Port != 9090 || c.Web.OAuth.ClientID != "from-env" || c.Web.Limits.MaxInFlightPerIP != 4 {
+		t.Errorf("Unexpected web configuration %+v", c.Web)
+	}
+	if c.Web.OAuth.SessionSecret != "fedcba9876543210fedcba9876543210" {
+		t.Errorf("Unexpected session secret %q", c.Web.OAuth.SessionSecret)
+	}
+	if domains := c.Web.OAuth.AllowedHostDomains; len(domains) != 2 || domains[1] != "example.com" {
+		t.Errorf("Unexpected allowed domains %v", domains)
+	}
+	if c.Gcs.Buckets["b1"] != "bucket1" || c.Gcs.SignedRedirects["b1"].TTL.Minutes() != 15 {
+		t.Errorf("Unexpected gcs configuration %+v", c.Gcs)
+	}
+	if !c.Gcs.Resilience.Enabled || c.Gcs.Resilience.MetadataTimeout.Seconds() != 5 || c.Tracing.SampleRatio != 0.5 {
+		t.Errorf("Unexpected configuration %+v", c)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	var c ProgramConfig
+	err := c.ApplyEnv(mapLookup(map[string]string{
+		"GCS_PROXY_WEB_PORT":                      "not-a-port",
+		"GCS_PROXY_WEB_OAUTH_CLIENT_SECRET":       "secret",
+		"GCS_PROXY_WEB_OAUTH_CLIENT_SECRET_FILE":  "/some/file",
+		"GCS_PROXY_WEB_OAUTH_SESSION_SECRET_FILE": "/does/not/exist",
+	}))
+	keys := map[string]bool{}
+	for _, fe := range fieldErrors(t, err) {
+		keys[fe.Key] = true
+	}
+	for _, key := range []string{"Web.Port", "Web.OAuth.ClientSecret", "Web.OAuth.SessionSecret"} {
+		if !keys[key] {
+			t.Errorf("Expected an error for %s, got %v", key, err)
+		}
+	}
+}
+
+func TestLoadAppliesEnvBeforeValidating(t *testing.T) {
+	defer func(lookup func(string) (string, bool)) { lookupEnv = lookup }(lookupEnv)
+	lookupEnv = mapLookup(map[string]string{"GCS_PROXY_WEB_OAUTH_SESSION_SECRET": "too-short"})
+	_, err := Load(writeConfig(t, validConfig))
+	errs := fieldErrors(t, err)
+	if len(errs) != 1 || errs[0].Key != "Web.OAuth.SessionSecret" {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+}
+
+func TestWatchReportsChanges(t *testing.T) {
+	path := writeConfig(t, validConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan struct{}, 10)
+	go Watch(ctx, path, 10*time.Millisecond, func() { changes <- struct{}{} })
+
+	select {
+	case <-changes:
+		t.Fatal("Unexpected change notification for an untouched file")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := ioutil.WriteFile(path, []byte(validConfig+"\n[Cache]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a change notification")
+	}
+}
+
+func TestLoadAppliesOverridesAfterEnv(t *testing.T) {
+	defer func(lookup func(string) (string, bool)) { lookupEnv = lookup }(lookupEnv)
+	lookupEnv = mapLookup(map[string]string{"GCS_PROXY_WEB_PORT": "9090", "GCS_PROXY_LOG_LEVEL": "debug"})
+	c, err := Load(writeConfig(t, validConfig), func(c *ProgramConfig) {
+		c.Web.Host, c.Web.Port = "127.0.0.1", 7000
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Web.Host != "127.0.0.1" || c.Web.Port != 7000 || c.Log.Level != "debug" {
+		t.Errorf("Unexpected configuration %+v", c)
+	}
+
+	_, err = Load(writeConfig(t, validConfig), func(c *ProgramConfig) { c.Web.Host = "not a host:80" })
+	if errs := fieldErrors(t, err); len(errs) != 1 || errs[0].Key != "Web.Host" {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+}
+
+const validYAMLConfig = `Gcs:
+  ServiceAccountFilePath: SA_FILE
+  Buckets:
+    b1: bucket1
+Web:
+  Port: 8080
+  OAuth:
+    ClientID: client-id
+    ClientSecret: client-secret
+    SessionSecret: 0123456789abcdef0123456789abcdef
+    AllowedHostDomains: [lenses.io]
+  Limits:
+    ReadTimeout: 30s
+`
+
+func TestLoadYAMLConfig(t *testing.T) {
+	c, err := Load(writeConfigAs(t, "config.yaml", validYAMLConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Gcs.Buckets["b1"] != "bucket1" || c.Web.Port != 8080 || c.Web.Limits.ReadTimeout.Seconds() != 30 {
+		t.Errorf("Unexpected configuration %+v", c)
+	}
+
+	invalid := strings.Replace(validYAMLConfig, "  Port: 8080", "  Port: eighty\n  Bogus: true", 1)
+	invalid = strings.Replace(invalid, "0123456789abcdef0123456789abcdef", "short", 1)
+	_, err = Load(writeConfigAs(t, "config.yml", invalid))
+	errs := fieldErrors(t, err)
+	expected := []FieldError{
+		{Key: "Web.Port", Line: 6},
+		{Key: "Web.Bogus", Line: 7},
+		{Key: "Web.OAuth.SessionSecret", Line: 11},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Unexpected errors %v", errs)
+	}
+	for i, e := range expected {
+		if errs[i].Key != e.Key || errs[i].Line != e.Line {
+			t.Errorf("Expected %s at line %d, got %v", e.Key, e.Line, errs[i])
+		}
+	}
+}
+
+func TestLoadJSONConfig(t *testing.T) {
+	content := `{
+	"Gcs": {"ServiceAccountFilePath": "SA_FILE", "Buckets": {"b1": "bucket1"}},
+	"Web": {
+		"Port": 8080,
+		"OAuth": {
+			"ClientID": "client-id",
+			"ClientSecret": "client-secret",
+			"SessionSecret": "0123456789abcdef0123456789abcdef",
+			"AllowedHostDomains": "lenses.io"
+		}
+	}
+}`
+	_, err := Load(writeConfigAs(t, "config.json", content))
+	if errs := fieldErrors(t, err); len(errs) != 1 || errs[0].Key != "Web.OAuth.AllowedHostDomains" || errs[0].Line != 9 {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+	if _, err := Load(writeConfigAs(t, "config.ini", content)); err == nil || !strings.Contains(err.Error(), "unsupported configuration format") {
+		t.Errorf("Expected an unsupported format error, got %v", err)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	sample, err := Decode("../config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{FormatTOML, FormatYAML, FormatJSON} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, sample, format); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(writeConfigAs(t, "config."+format, buf.String()))
+		if err != nil {
+			t.Fatalf("Cannot decode the %s encoding: %v\n%s", format, err, buf.String())
+		}
+		if !reflect.DeepEqual(decoded, sample) {
+			t.Errorf("The %s encoding doesn't round trip:\n%s", format, buf.String())
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//EnvPrefix prefixes the environment variables overriding configuration fields
+const EnvPrefix = "GCS_PROXY_"
+
+//secretFileSuffix is appended to the variable of secret fields to read their value from the file it names
+const secretFileSuffix = "_FILE"
+
+var textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+//EnvName returns the environment variable overriding the field with the supplied dotted path (e.g. Web.OAuth.ClientID
+//is overridden by GCS_PROXY_WEB_OAUTH_CLIENT_ID)
+func EnvName(key string) string {
+	t := reflect.TypeOf(ProgramConfig{})
+	var segments []string
+	for _, name := range strings.Split(key, ".") {
+		f, ok := t.FieldByName(name)
+		if !ok {
+			return ""
+		}
+		segments = append(segments, envSegment(f))
+		t = f.Type
+	}
+	return EnvPrefix + strings.Join(segments, "_")
+}
+
+//envSegment converts the field name from camel case to upper snake case, unless overridden by its env tag
+func envSegment(f reflect.StructField) string {
+	if tag := f.Tag.Get("env"); tag != "" {
+		return tag
+	}
+	runes := []rune(f.Name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			acronymEnd := unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || acronymEnd {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+//ApplyEnv overrides the configuration fields with the GCS_PROXY_* variables returned by lookup. Lists of strings are
+//comma separated, maps and lists of tables are JSON encoded. Secret fields can also be read from the file named by
+//the variable suffixed with _FILE
+func (c *ProgramConfig) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs []FieldError
+	applyEnv(reflect.ValueOf(c).Elem(), "", strings.TrimSuffix(EnvPrefix, "_"), lookup, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: errs}
+}
+
+func applyEnv(v reflect.Value, key, env string, lookup func(string) (string, bool), errs *[]FieldError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		fieldKey := f.Name
+		if key != "" {
+			fieldKey = key + "." + f.Name
+		}
+		fieldEnv := env + "_" + envSegment(f)
+		field := v.Field(i)
+		if f.Type.Kind() == reflect.Struct && !reflect.PtrTo(f.Type).Implements(textUnmarshaler) {
+			applyEnv(field, fieldKey, fieldEnv, lookup, errs)
+			continue
+		}
+
+		value, ok := lookup(fieldEnv)
+		if f.Tag.Get("secret") == "true" {
+			if path, fromFile := lookup(fieldEnv + secretFileSuffix); fromFile {
+				if ok {
+					*errs = append(*errs, FieldError{Key: fieldKey, Msg: fmt.Sprintf("both %s and %s%s are set", fieldEnv, fieldEnv, secretFileSuffix)})
+					continue
+				}
+				content, err := ioutil.ReadFile(path)
+				if err != nil {
+					*errs = append(*errs, FieldError{Key: fieldKey, Msg: fmt.Sprintf("cannot read %s%s: %s", fieldEnv, secretFileSuffix, err.Error())})
+					continue
+				}
+				value, ok = strings.TrimRight(string(content), "\r\n"), true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			*errs = append(*errs, FieldError{Key: fieldKey, Msg: fmt.Sprintf("invalid value in %s: %s", fieldEnv, err.Error())})
+		}
+	}
+}
+
+//setField parses the string value into the field according to its type
+func setField(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int16, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+			return nil
+		}
+		return unmarshalJSON(field, value)
+	case reflect.Map:
+		return unmarshalJSON(field, value)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+func unmarshalJSON(field reflect.Value, value string) error {
+	target := reflect.New(field.Type())
+	if err := json.Unmarshal([]byte(value), target.Interface()); err != nil {
+		return err
+	}
+	field.Set(target.Elem())
+	return nil
+}
+
+//lookupEnv is the lookup function reading the process environment
+var lookupEnv = os.LookupEnv
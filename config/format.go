@@ -0,0 +1,408 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+//Configuration formats, selected by the extension of the configuration file
+const (
+	FormatTOML = "toml"
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+//FormatOf returns the configuration format matching the extension of path
+func FormatOf(path string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		return FormatTOML, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".json":
+		return FormatJSON, nil
+	default:
+		return "", fmt.Errorf("%s: unsupported configuration format, expected a .toml, .yaml, .yml or .json file", path)
+	}
+}
+
+//decode parses the configuration document, returning the unknown keys and type mismatches found along with the
+//first line of each key, indexed by lowercase dotted path
+func decode(format string, content []byte) (ProgramConfig, []FieldError, map[string]int, error) {
+	var c ProgramConfig
+	if format == FormatTOML {
+		meta, err := toml.Decode(string(content), &c)
+		if err != nil {
+			return c, nil, nil, err
+		}
+		var errs []FieldError
+		for _, key := range meta.Undecoded() {
+			errs = append(errs, FieldError{Key: key.String(), Msg: "unknown key"})
+		}
+		return c, errs, keyLines(content), nil
+	}
+
+	//JSON documents are valid YAML, which lets both formats share the decoder reporting line numbers
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return c, nil, nil, err
+	}
+	d := nodeDecoder{lines: make(map[string]int)}
+	if len(root.Content) > 0 {
+		d.decode(root.Content[0], reflect.ValueOf(&c).Elem(), "")
+	}
+	return c, d.errs, d.lines, nil
+}
+
+//nodeDecoder decodes YAML nodes into the configuration, matching keys to field names case insensitively
+type nodeDecoder struct {
+	errs  []FieldError
+	lines map[string]int
+}
+
+var yamlLinePrefix = regexp.MustCompile(`^line \d+: `)
+
+func (d *nodeDecoder) fail(key string, n *yaml.Node, format string, args ...interface{}) {
+	d.errs = append(d.errs, FieldError{Key: key, Line: n.Line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (d *nodeDecoder) decode(n *yaml.Node, v reflect.Value, key string) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	isText := reflect.PtrTo(v.Type()).Implements(textUnmarshaler)
+	switch {
+	case v.Kind() == reflect.Struct && !isText:
+		if n.Kind != yaml.MappingNode {
+			d.fail(key, n, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			name, value := n.Content[i].Value, n.Content[i+1]
+			fieldKey := joinKey(key, name)
+			d.record(fieldKey, n.Content[i].Line)
+			field, ok := fieldByName(v, name)
+			if !ok {
+				d.fail(fieldKey, n.Content[i], "unknown key")
+				continue
+			}
+			d.decode(value, field, fieldKey)
+		}
+	case v.Kind() == reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			d.fail(key, n, "expected a mapping")
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			name := n.Content[i].Value
+			entryKey := joinKey(key, name)
+			d.record(entryKey, n.Content[i].Line)
+			entry := reflect.New(v.Type().Elem()).Elem()
+			d.decode(n.Content[i+1], entry, entryKey)
+			v.SetMapIndex(reflect.ValueOf(name).Convert(v.Type().Key()), entry)
+		}
+	case v.Kind() == reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			d.fail(key, n, "expected a list")
+			return
+		}
+		items := reflect.MakeSlice(v.Type(), len(n.Content), len(n.Content))
+		for i, item := range n.Content {
+			d.decode(item, items.Index(i), key)
+		}
+		v.Set(items)
+	default:
+		if n.Kind != yaml.ScalarNode {
+			d.fail(key, n, "expected a single value")
+			return
+		}
+		if err := n.Decode(v.Addr().Interface()); err != nil {
+			msg := err.Error()
+			if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) > 0 {
+				msg = yamlLinePrefix.ReplaceAllString(typeErr.Errors[0], "")
+			}
+			d.fail(key, n, "%s", msg)
+		}
+	}
+}
+
+func (d *nodeDecoder) record(key string, line int) {
+	key = strings.ToLower(key)
+	if _, ok := d.lines[key]; !ok {
+		d.lines[key] = line
+	}
+}
+
+func joinKey(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+//fieldByName returns the exported field of the struct matching name case insensitively
+func fieldByName(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" && strings.EqualFold(f.Name, name) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+//Decode reads the configuration at path in the format matching its extension, without applying overrides nor
+//validating it. Unknown keys and type mismatches are reported as a ValidationError
+func Decode(path string) (ProgramConfig, error) {
+	c, errs, _, err := read(path)
+	if err != nil {
+		return c, err
+	}
+	if len(errs) > 0 {
+		return c, &ValidationError{File: path, Errors: errs}
+	}
+	return c, nil
+}
+
+//Encode writes the configuration in the supplied format, omitting the settings left to their defaults
+func Encode(w io.Writer, c ProgramConfig, format string) error {
+	root := toNode(reflect.ValueOf(c))
+	if root == nil {
+		root = &yaml.Node{Kind: yaml.MappingNode}
+	}
+	var buf bytes.Buffer
+	switch format {
+	case FormatYAML:
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(root); err != nil {
+			return err
+		}
+		enc.Close()
+	case FormatJSON:
+		writeJSON(&buf, root, "")
+		buf.WriteString("\n")
+	case FormatTOML:
+		writeTOML(&buf, root, nil)
+	default:
+		return fmt.Errorf("unsupported configuration format %s", format)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+//toNode converts the value into a YAML node tree following the declaration order of struct fields, returning nil
+//for zero values
+func toNode(v reflect.Value) *yaml.Node {
+	if v.IsZero() {
+		return nil
+	}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		if err != nil {
+			return nil
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: string(text)}
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			if value := toNode(v.Field(i)); value != nil {
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.Type().Field(i).Name}, value)
+			}
+		}
+		if len(n.Content) == 0 {
+			return nil
+		}
+		return n
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		for _, k := range keys {
+			value := toNode(v.MapIndex(k))
+			if value == nil {
+				value = emptyNode(v.Type().Elem())
+			}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k.String()}, value)
+		}
+		return n
+	case reflect.Slice:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		for i := 0; i < v.Len(); i++ {
+			item := toNode(v.Index(i))
+			if item == nil {
+				item = emptyNode(v.Type().Elem())
+			}
+			n.Content = append(n.Content, item)
+		}
+		return n
+	case reflect.String:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.String()}
+	case reflect.Bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v.Bool())}
+	case reflect.Int, reflect.Int16, reflect.Int64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.FormatInt(v.Int(), 10)}
+	case reflect.Float64:
+		value := strconv.FormatFloat(v.Float(), 'f', -1, 64)
+		if !strings.Contains(value, ".") {
+			value += ".0"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: value}
+	}
+	return nil
+}
+
+//emptyNode returns the node of a zero value kept as a map entry or list item, where it can't be omitted
+func emptyNode(t reflect.Type) *yaml.Node {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return &yaml.Node{Kind: yaml.MappingNode}
+	case reflect.Slice:
+		return &yaml.Node{Kind: yaml.SequenceNode}
+	case reflect.String:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str"}
+	case reflect.Bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "false"}
+	case reflect.Float64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: "0.0"}
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: "0"}
+	}
+}
+
+//quote formats s as a JSON string, which is also a valid TOML basic string
+func quote(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func scalar(n *yaml.Node) string {
+	if n.Tag == "!!str" {
+		return quote(n.Value)
+	}
+	return n.Value
+}
+
+func writeJSON(buf *bytes.Buffer, n *yaml.Node, indent string) {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, close, step := "{", "}", 2
+		if n.Kind == yaml.SequenceNode {
+			open, close, step = "[", "]", 1
+		}
+		if len(n.Content) == 0 {
+			buf.WriteString(open + close)
+			return
+		}
+		buf.WriteString(open + "\n")
+		for i := 0; i < len(n.Content); i += step {
+			buf.WriteString(indent + "  ")
+			if step == 2 {
+				buf.WriteString(quote(n.Content[i].Value) + ": ")
+			}
+			writeJSON(buf, n.Content[i+step-1], indent+"  ")
+			if i+step < len(n.Content) {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + close)
+	default:
+		buf.WriteString(scalar(n))
+	}
+}
+
+var bareTOMLKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKey(key string) string {
+	if bareTOMLKey.MatchString(key) {
+		return key
+	}
+	return quote(key)
+}
+
+//isTable tells whether the node is written as a TOML table, or as an array of tables
+func isTable(n *yaml.Node) bool {
+	if n.Kind == yaml.MappingNode {
+		return true
+	}
+	return n.Kind == yaml.SequenceNode && len(n.Content) > 0 && n.Content[0].Kind == yaml.MappingNode
+}
+
+func onlyTables(n *yaml.Node) bool {
+	for i := 1; i < len(n.Content); i += 2 {
+		if !isTable(n.Content[i]) {
+			return false
+		}
+	}
+	return len(n.Content) > 0
+}
+
+//writeTOML writes the key/value pairs of the mapping, followed by its tables and arrays of tables
+func writeTOML(buf *bytes.Buffer, n *yaml.Node, table []string) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i].Value, n.Content[i+1]
+		if isTable(value) {
+			continue
+		}
+		buf.WriteString(tomlKey(key) + " = ")
+		if value.Kind == yaml.SequenceNode {
+			items := make([]string, len(value.Content))
+			for j, item := range value.Content {
+				items[j] = scalar(item)
+			}
+			buf.WriteString("[" + strings.Join(items, ", ") + "]\n")
+			continue
+		}
+		buf.WriteString(scalar(value) + "\n")
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i].Value, n.Content[i+1]
+		if !isTable(value) {
+			continue
+		}
+		path := append(append([]string{}, table...), tomlKey(key))
+		header := strings.Join(path, ".")
+		if value.Kind == yaml.MappingNode {
+			//tables only holding other tables are implicitly defined by their headers
+			if !onlyTables(value) {
+				if buf.Len() > 0 {
+					buf.WriteString("\n")
+				}
+				buf.WriteString("[" + header + "]\n")
+			}
+			writeTOML(buf, value, path)
+			continue
+		}
+		for _, item := range value.Content {
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+			}
+			buf.WriteString("[[" + header + "]]\n")
+			writeTOML(buf, item, path)
+		}
+	}
+}
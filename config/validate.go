@@ -0,0 +1,374 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//minSecretLength is the minimum length, in bytes, of the secrets signing session cookies and share links
+const minSecretLength = 32
+
+//FieldError reports an invalid configuration entry
+type FieldError struct {
+	//Key is the dotted path of the entry (e.g. Web.OAuth.SessionSecret)
+	Key string
+	//Line is the line the entry, or its enclosing table, is defined at. Zero when unknown
+	Line int
+	Msg  string
+}
+
+func (e FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Key, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Msg)
+}
+
+//ValidationError lists the problems found in a configuration
+type ValidationError struct {
+	//File is the path of the validated file, if any
+	File   string
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		lines[i] = fe.Error()
+		if e.File != "" {
+			lines[i] = e.File + ": " + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Override modifies the configuration after it has been read, e.g. to apply command line flags
+type Override func(c *ProgramConfig)
+
+//Load reads the configuration at path, in the TOML, YAML or JSON format matching its extension, then applies the
+//overrides set in the environment followed by the supplied ones, reporting unknown keys along with the problems found
+//by Validate
+func Load(path string, overrides ...Override) (ProgramConfig, error) {
+	c, errs, lines, err := read(path)
+	if err != nil {
+		return c, err
+	}
+	if err := c.ApplyEnv(lookupEnv); err != nil {
+		errs = append(errs, err.(*ValidationError).Errors...)
+	} else {
+		for _, override := range overrides {
+			override(&c)
+		}
+		if err := c.Validate(); err != nil {
+			//keys that couldn't be decoded are already reported
+			failed := make(map[string]bool, len(errs))
+			for _, e := range errs {
+				failed[e.Key] = true
+			}
+			for _, e := range err.(*ValidationError).Errors {
+				if !failed[e.Key] {
+					errs = append(errs, e)
+				}
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return c, nil
+	}
+	for i := range errs {
+		if errs[i].Line == 0 {
+			errs[i].Line = lineOf(lines, errs[i].Key)
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return c, &ValidationError{File: path, Errors: errs}
+}
+
+//read decodes the configuration file at path, returning the problems found in its document along with the line of
+//each of its keys
+func read(path string) (ProgramConfig, []FieldError, map[string]int, error) {
+	format, err := FormatOf(path)
+	if err != nil {
+		return ProgramConfig{}, nil, nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ProgramConfig{}, nil, nil, fmt.Errorf("cannot read the configuration: %s", err.Error())
+	}
+	c, errs, lines, err := decode(format, content)
+	if err != nil {
+		return c, nil, nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	for i := range errs {
+		if errs[i].Line == 0 {
+			errs[i].Line = lineOf(lines, errs[i].Key)
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return c, errs, lines, nil
+}
+
+//keyLines maps the lowercase dotted path of the tables and keys defined in a TOML document to their first line
+func keyLines(content []byte) map[string]int {
+	lines := make(map[string]int)
+	record := func(key string, line int) {
+		key = strings.ToLower(key)
+		if _, ok := lines[key]; !ok {
+			lines[key] = line
+		}
+	}
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "["):
+			table = unquoteKey(strings.Trim(strings.SplitN(line, "]", 2)[0], "[ "))
+			record(table, n)
+		case strings.Contains(line, "="):
+			key := unquoteKey(strings.SplitN(line, "=", 2)[0])
+			if table != "" {
+				key = table + "." + key
+			}
+			record(key, n)
+		}
+	}
+	return lines
+}
+
+func unquoteKey(key string) string {
+	parts := strings.Split(strings.TrimSpace(key), ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+//lineOf returns the line of the key or, when this isn't defined, of the closest enclosing table
+func lineOf(lines map[string]int, key string) int {
+	parts := strings.Split(strings.ToLower(key), ".")
+	for i := len(parts); i > 0; i-- {
+		if line, ok := lines[strings.Join(parts[:i], ".")]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+//Validate checks that required fields are set, secrets are strong enough, aliases don't overlap and the referenced
+//files are readable
+func (c ProgramConfig) Validate() error {
+	var errs []FieldError
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Key: key, Msg: fmt.Sprintf(format, args...)})
+	}
+	readable := func(key, path string) {
+		if path == "" {
+			fail(key, "is required")
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			fail(key, "cannot read %s", path)
+			return
+		}
+		f.Close()
+	}
+
+	readable("Gcs.ServiceAccountFilePath", c.Gcs.ServiceAccountFilePath)
+	if len(c.Gcs.Buckets) == 0 && len(c.Gcs.Hosts) == 0 {
+		fail("Gcs.Buckets", "at least one bucket alias or host is required")
+	}
+	aliases := make([]string, 0, len(c.Gcs.Buckets))
+	for alias, bucket := range c.Gcs.Buckets {
+		aliases = append(aliases, alias)
+		switch {
+		case alias == "" || strings.HasPrefix(alias, "/") || strings.HasSuffix(alias, "/"):
+			fail("Gcs.Buckets."+alias, "aliases must not be empty, nor start or end with /")
+		case bucket == "":
+			fail("Gcs.Buckets."+alias, "bucket name is required")
+		}
+	}
+	sort.Strings(aliases)
+	for i, a := range aliases {
+		for _, b := range aliases[i+1:] {
+			//aliases are matched on whole path segments, hence /b1 would also match requests for /b1/archive
+			if strings.HasPrefix(b, a+"/") {
+				fail("Gcs.Buckets."+b, "overlaps with alias %s", a)
+			}
+		}
+	}
+	routeAliases := make(map[string]bool, len(c.Gcs.Buckets)+len(c.Gcs.Hosts))
+	for alias := range c.Gcs.Buckets {
+		routeAliases[alias] = true
+	}
+	hosts := make(map[string]bool, len(c.Gcs.Hosts))
+	for i, route := range c.Gcs.Hosts {
+		key := fmt.Sprintf("Gcs.Hosts.%d", i+1)
+		host := strings.ToLower(route.Host)
+		wildcard := strings.HasPrefix(host, "*.")
+		switch {
+		case host == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.ContainsAny(host, ":/ ") ||
+			strings.HasPrefix(strings.TrimPrefix(host, "*."), ".") || strings.HasSuffix(host, "."):
+			fail(key+".Host", "must be a host name, optionally starting with *.")
+		case hosts[host]:
+			fail(key+".Host", "%s is bound to more than one route", route.Host)
+		}
+		hosts[host] = true
+		if route.Bucket == "" {
+			fail(key+".Bucket", "bucket name is required")
+		}
+		if strings.HasPrefix(route.Prefix, "/") {
+			fail(key+".Prefix", "must not start with /")
+		}
+		if !wildcard && strings.Contains(route.Prefix, "{subdomain}") {
+			fail(key+".Prefix", "{subdomain} is only defined for wildcard hosts")
+		}
+		if strings.Contains(route.IndexDocument, "/") {
+			fail(key+".IndexDocument", "must be an object name, without /")
+		}
+		if alias := route.RouteAlias(); routeAliases[alias] {
+			fail(key+".Alias", "%s is already used by another route", alias)
+		} else {
+			routeAliases[alias] = true
+		}
+	}
+	for alias := range c.Gcs.SignedRedirects {
+		if !routeAliases[alias] {
+			fail("Gcs.SignedRedirects."+alias, "unknown bucket alias")
+		}
+	}
+
+	w := c.Web
+	if w.Host != "" && net.ParseIP(w.Host) == nil && strings.ContainsAny(w.Host, ":/ ") {
+		fail("Web.Host", "must be an IP address or a host name")
+	}
+	if w.Port <= 0 {
+		fail("Web.Port", "must be a positive port number")
+	}
+	if w.OAuth.ClientID == "" {
+		fail("Web.OAuth.ClientID", "is required")
+	}
+	if w.OAuth.ClientSecret == "" {
+		fail("Web.OAuth.ClientSecret", "is required")
+	}
+	if len(w.OAuth.AllowedHostDomains) == 0 {
+		fail("Web.OAuth.AllowedHostDomains", "at least one domain is required")
+	}
+	if len(w.OAuth.SessionSecret) < minSecretLength {
+		fail("Web.OAuth.SessionSecret", "must be at least %d bytes long", minSecretLength)
+	}
+	if w.Share.Secret != "" && len(w.Share.Secret) < minSecretLength {
+		fail("Web.Share.Secret", "must be at least %d bytes long", minSecretLength)
+	}
+	if w.OAuth.CallbackURL != "" {
+		if u, err := url.Parse(w.OAuth.CallbackURL); err != nil || !u.IsAbs() {
+			fail("Web.OAuth.CallbackURL", "must be an absolute URL")
+		}
+	}
+	for i, rule := range w.HeaderRules {
+		if rule.Alias != "" && !routeAliases[rule.Alias] {
+			fail("Web.HeaderRules", "rule %d refers to unknown bucket alias %s", i+1, rule.Alias)
+		}
+	}
+	for i, rule := range w.Rewrites.Rules {
+		key := fmt.Sprintf("Web.Rewrites.Rules.%d", i+1)
+		switch {
+		case (rule.Path == "") == (rule.Regex == ""):
+			fail(key, "exactly one of Path and Regex is required")
+		case rule.Regex != "":
+			if _, err := regexp.Compile(rule.Regex); err != nil {
+				fail(key+".Regex", "%v", err)
+			}
+		}
+		switch rule.Status {
+		case 0:
+			if !strings.HasPrefix(rule.Target, "/") {
+				fail(key+".Target", "rewrites must target a path starting with /")
+			}
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			if u, err := url.Parse(rule.Target); err != nil || (!strings.HasPrefix(rule.Target, "/") && u.Scheme != "http" && u.Scheme != "https") {
+				fail(key+".Target", "redirects must target a path starting with / or an absolute http or https URL")
+			}
+		default:
+			fail(key+".Status", "must be one of 301, 302, 307 or 308, or unset for internal rewrites")
+		}
+	}
+	if w.Scheme != "" && w.Scheme != "http" && w.Scheme != "https" {
+		fail("Web.Scheme", "must be either http or https")
+	}
+	if w.PublicURL != "" {
+		if u, err := url.Parse(w.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("Web.PublicURL", "must be an absolute http or https URL")
+		}
+	}
+	for _, proxy := range w.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			fail("Web.TrustedProxies", "%s is neither an IP nor a CIDR", proxy)
+		}
+	}
+	if w.TLS.Enabled {
+		if len(w.TLS.ACMEDomains) > 0 {
+			if w.TLS.ACMECacheDir == "" {
+				fail("Web.TLS.ACMECacheDir", "is required to obtain certificates through ACME")
+			}
+		} else {
+			readable("Web.TLS.CertFile", w.TLS.CertFile)
+			readable("Web.TLS.KeyFile", w.TLS.KeyFile)
+		}
+		if w.TLS.RedirectPort != 0 && w.TLS.RedirectPort == w.Port {
+			fail("Web.TLS.RedirectPort", "must differ from Web.Port")
+		}
+	}
+	if w.Metrics.Enabled && (w.Metrics.Port <= 0 || w.Metrics.Port == w.Port) {
+		fail("Web.Metrics.Port", "must be a positive port number, different from Web.Port")
+	}
+	if w.Admin.Enabled {
+		if w.Admin.Port <= 0 || w.Admin.Port == w.Port || (w.Metrics.Enabled && w.Admin.Port == w.Metrics.Port) ||
+			(w.TLS.Enabled && w.Admin.Port == w.TLS.RedirectPort) {
+			fail("Web.Admin.Port", "must be a positive port number, different from the other listeners")
+		}
+		if len(w.Admin.Token) < minSecretLength {
+			fail("Web.Admin.Token", "must be at least %d bytes long", minSecretLength)
+		}
+		if host := c.AdminHost(); !w.TLS.Enabled && !isLoopback(host) {
+			fail("Web.Admin.Host", "must be a loopback address unless Web.TLS is enabled, as the admin token would travel in clear text")
+		}
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		fail("Log.Level", "must be one of debug, info, warn or error")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("Tracing.SampleRatio", "must be between 0 and 1")
+	}
+	if c.Audit.Enabled && c.Audit.File == "" {
+		fail("Audit.File", "is required")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: errs}
+}
+
+//isLoopback reports whether host names a loopback interface. An empty host binds every interface
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+//Watch polls the file at path every interval, calling changed when its modification time or size differ from the
+//previous check. It returns when ctx is done
+func Watch(ctx context.Context, path string, interval time.Duration, changed func()) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			//the file may be briefly missing while being replaced, check again on the next tick
+			continue
+		}
+		if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			changed()
+		}
+	}
+}
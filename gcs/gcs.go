@@ -3,20 +3,30 @@ package gcs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/afiore/gcs-proxy/store"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
+var errClosed = errors.New("the store has been closed")
+
 //Object represents a GCP storage record
 type object struct {
-	key    string
-	attrs  *storage.ObjectAttrs
-	reader *storage.Reader
+	key   string
+	attrs *storage.ObjectAttrs
 }
 
 func (o object) ContentType() string {
@@ -28,50 +38,225 @@ func (o object) Size() int64 {
 func (o object) Updated() time.Time {
 	return o.attrs.Updated
 }
+func (o object) Generation() int64 {
+	return o.attrs.Generation
+}
+func (o object) CacheControl() string {
+	return o.attrs.CacheControl
+}
+func (o object) ContentEncoding() string {
+	return o.attrs.ContentEncoding
+}
+func (o object) ContentLanguage() string {
+	return o.attrs.ContentLanguage
+}
+func (o object) ContentDisposition() string {
+	return o.attrs.ContentDisposition
+}
+func (o object) Metadata() map[string]string {
+	return o.attrs.Metadata
+}
 
 type gcpStore struct {
 	saFilePath string
 	ctx        context.Context
+
+	clientOnce sync.Once
+	client     *storage.Client
+	clientErr  error
+
+	jwtMu      sync.Mutex
+	jwtConf    *jwt.Config
+	jwtModTime time.Time
+}
+
+//storageClient lazily initialises a client shared across all the store operations
+func (s *gcpStore) storageClient() (*storage.Client, error) {
+	s.clientOnce.Do(func() {
+		s.client, s.clientErr = storage.NewClient(s.ctx, option.WithCredentialsFile(s.saFilePath))
+	})
+	return s.client, s.clientErr
 }
 
-func (s *gcpStore) getObject(bucketName, objectKey string) (o *object, err error) {
-	var attrs *storage.ObjectAttrs
-	client, err := storage.NewClient(s.ctx, option.WithCredentialsFile(s.saFilePath))
+//jwtConfig lazily parses the service account key used to sign URLs, shared across all the signing operations. The
+//key is parsed again when the file changes, so that rotated keys are picked up, while failures aren't remembered
+func (s *gcpStore) jwtConfig() (*jwt.Config, error) {
+	info, err := os.Stat(s.saFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("cannot read service account file: %s", err.Error())
 	}
-	bucket := client.Bucket(bucketName)
-	obj := bucket.Object(objectKey)
-	attrs, err = obj.Attrs(s.ctx)
-
-	if errors.Is(err, storage.ErrObjectNotExist) {
-		return o, &store.ObjectNotFound{Bucket: bucketName, Key: objectKey}
+	s.jwtMu.Lock()
+	defer s.jwtMu.Unlock()
+	if s.jwtConf != nil && info.ModTime().Equal(s.jwtModTime) {
+		return s.jwtConf, nil
 	}
+	saJSON, err := ioutil.ReadFile(s.saFilePath)
 	if err != nil {
-		return o, err
+		return nil, fmt.Errorf("cannot read service account file: %s", err.Error())
 	}
-	r, err := obj.NewReader(s.ctx)
+	conf, err := google.JWTConfigFromJSON(saJSON)
 	if err != nil {
-		return o, err
+		return nil, fmt.Errorf("cannot parse service account file: %s", err.Error())
 	}
-	return &object{key: objectKey, attrs: attrs, reader: r}, nil
+	s.jwtConf, s.jwtModTime = conf, info.ModTime()
+	return conf, nil
 }
 
-func (s *gcpStore) GetObjectMetadata(bucketName, objectKey string) (store.ObjectMetadata, error) {
-	o, err := s.getObject(bucketName, objectKey)
+func (s *gcpStore) objectHandle(bucketName, objectKey string) (*storage.ObjectHandle, error) {
+	client, err := s.storageClient()
 	if err != nil {
 		return nil, err
 	}
-	return o, nil
+	return client.Bucket(bucketName).Object(objectKey), nil
 }
 
-func (s *gcpStore) CopyObject(bucket, key string, w io.Writer) (written int64, err error) {
-	o, err := s.getObject(bucket, key)
-	defer o.reader.Close()
+func (s *gcpStore) GetObjectMetadata(ctx context.Context, bucketName, objectKey string) (store.ObjectMetadata, error) {
+	obj, err := s.objectHandle(bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, classify("GetObjectMetadata", bucketName, objectKey, err)
+	}
+	return &object{key: objectKey, attrs: attrs}, nil
+}
+
+func (s *gcpStore) CopyObject(ctx context.Context, bucketName, objectKey string, w io.Writer) (written int64, err error) {
+	obj, err := s.objectHandle(bucketName, objectKey)
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(w, o.reader)
+	//objects are copied as stored so that the body matches the Content-Encoding and size reported in their metadata
+	r, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return 0, classify("CopyObject", bucketName, objectKey, err)
+	}
+	defer r.Close()
+	written, err = io.Copy(w, r)
+	//failures while copying may come from either side, hence only cancellations are classified
+	if err != nil && ctx.Err() != nil {
+		return written, classify("CopyObject", bucketName, objectKey, ctx.Err())
+	}
+	return written, err
+}
+
+//classify maps the errors returned by the GCS client to the store error kinds
+func classify(op, bucketName, objectKey string, err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return &store.ObjectNotFound{Bucket: bucketName, Key: objectKey}
+	}
+	var kind error
+	var apiErr *googleapi.Error
+	var netErr net.Error
+	switch {
+	case errors.Is(err, storage.ErrBucketNotExist):
+		kind = store.ErrNotFound
+	case errors.Is(err, context.Canceled):
+		kind = store.ErrCanceled
+	case errors.As(err, &apiErr):
+		switch {
+		case apiErr.Code == http.StatusNotFound:
+			kind = store.ErrNotFound
+		case apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden:
+			kind = store.ErrForbidden
+		case apiErr.Code == http.StatusPreconditionFailed:
+			kind = store.ErrPreconditionFailed
+		case apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500:
+			kind = store.ErrUnavailable
+		}
+	case errors.As(err, &netErr) && !errors.Is(err, context.DeadlineExceeded):
+		kind = store.ErrUnavailable
+	}
+	if kind == nil {
+		return err
+	}
+	return &store.Error{Op: op, Bucket: bucketName, Key: objectKey, Kind: kind, Err: err}
+}
+
+//PutObject creates or overwrites the object with the content read from r
+func (s *gcpStore) PutObject(ctx context.Context, bucketName, objectKey string, r io.Reader) error {
+	obj, err := s.objectHandle(bucketName, objectKey)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := obj.NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		//cancelling the context aborts the upload, leaving any previous version of the object in place
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+//ListObjects lists the objects of the bucket whose key starts with prefix, grouping them by common prefix when
+//delimiter is not empty
+func (s *gcpStore) ListObjects(ctx context.Context, bucketName, prefix, delimiter string, fn func(store.ListEntry) error) error {
+	client, err := s.storageClient()
+	if err != nil {
+		return err
+	}
+	it := client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: delimiter})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return classify("ListObjects", bucketName, prefix, err)
+		}
+		entry := store.ListEntry{Key: attrs.Prefix}
+		if attrs.Prefix == "" {
+			entry = store.ListEntry{Key: attrs.Name, Metadata: &object{key: attrs.Name, attrs: attrs}}
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+//CheckBucket verifies that the bucket exists and is accessible by fetching its attributes
+func (s *gcpStore) CheckBucket(ctx context.Context, bucketName string) error {
+	client, err := s.storageClient()
+	if err != nil {
+		return err
+	}
+	if _, err := client.Bucket(bucketName).Attrs(ctx); err != nil {
+		return classify("CheckBucket", bucketName, "", err)
+	}
+	return nil
+}
+
+//Close releases the client shared by the store operations. Operations invoked afterwards fail
+func (s *gcpStore) Close() error {
+	initialised := true
+	s.clientOnce.Do(func() {
+		initialised = false
+		s.clientErr = errClosed
+	})
+	if initialised && s.client != nil {
+		return s.client.Close()
+	}
+	return nil
+}
+
+//SignedURL issues a V4 signed URL for requesting the supplied object with method, using the configured service account
+//key
+func (s *gcpStore) SignedURL(method, bucket, key string, expires time.Time) (string, error) {
+	conf, err := s.jwtConfig()
+	if err != nil {
+		return "", err
+	}
+	return storage.SignedURL(bucket, key, &storage.SignedURLOptions{
+		GoogleAccessID: conf.Email,
+		PrivateKey:     conf.PrivateKey,
+		Method:         method,
+		Expires:        expires,
+		Scheme:         storage.SigningSchemeV4,
+	})
 }
 
 //StoreOps implements basic storage operations on GCP storage
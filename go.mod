@@ -6,8 +6,16 @@ require (
 	cloud.google.com/go/storage v1.8.0
 	// github.com/influxdata/toml v0.0.0-20180607005434-2a2e3012f7cf
 	github.com/BurntSushi/toml v0.3.1
+	github.com/andybalholm/brotli v1.0.5
+	github.com/gorilla/securecookie v1.1.1
+	github.com/prometheus/client_golang v1.11.1
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	// github.com/naoina/go-stringutil v0.1.0 // indirect
 	google.golang.org/api v0.25.0
-	github.com/gorilla/securecookie v1.1.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const accessEntryKey contextKey = iota
+
+//AccessEntry describes a served request. Its fields are filled in by the handlers processing the request
+type AccessEntry struct {
+	mu         sync.Mutex
+	Time       time.Time
+	RequestID  string
+	Method     string
+	Path       string
+	RemoteAddr string
+	PeerAddr   string
+	User       string
+	Alias      string
+	Bucket     string
+	Key        string
+	Status     int
+	Bytes      int64
+	Duration   time.Duration
+	Cache      string
+}
+
+//WithAccessEntry returns a context carrying the supplied entry
+func WithAccessEntry(ctx context.Context, e *AccessEntry) context.Context {
+	return context.WithValue(ctx, accessEntryKey, e)
+}
+
+//AccessEntryFrom returns the entry carried by the context, if any
+func AccessEntryFrom(ctx context.Context) (*AccessEntry, bool) {
+	e, ok := ctx.Value(accessEntryKey).(*AccessEntry)
+	return e, ok
+}
+
+//SetUser records the identity of the user issuing the request
+func SetUser(ctx context.Context, user string) {
+	if e, ok := AccessEntryFrom(ctx); ok {
+		e.mu.Lock()
+		e.User = user
+		e.mu.Unlock()
+	}
+}
+
+//SetObject records the object targeted by the request
+func SetObject(ctx context.Context, alias, bucket, key string) {
+	if e, ok := AccessEntryFrom(ctx); ok {
+		e.mu.Lock()
+		e.Alias, e.Bucket, e.Key = alias, bucket, key
+		e.mu.Unlock()
+	}
+}
+
+//SetCacheStatus records whether the object was served from the cache (e.g. hit, disk_hit, miss, bypass)
+func SetCacheStatus(ctx context.Context, status string) {
+	if e, ok := AccessEntryFrom(ctx); ok {
+		e.mu.Lock()
+		e.Cache = status
+		e.mu.Unlock()
+	}
+}
+
+//Complete records the outcome of the request
+func (e *AccessEntry) Complete(status int, written int64, elapsed time.Duration) {
+	e.mu.Lock()
+	e.Status, e.Bytes, e.Duration = status, written, elapsed
+	e.mu.Unlock()
+}
+
+//Access emits the access log record for a served request, unless access logging is disabled.
+//Access records are not subject to the configured log level
+func Access(e *AccessEntry) {
+	e.mu.Lock()
+	record := map[string]interface{}{
+		"msg":         "access",
+		"request_id":  e.RequestID,
+		"method":      e.Method,
+		"path":        e.Path,
+		"remote_addr": e.RemoteAddr,
+		"peer_addr":   e.PeerAddr,
+		"status":      e.Status,
+		"bytes":       e.Bytes,
+		"duration_ms": float64(e.Duration) / float64(time.Millisecond),
+		"start_time":  e.Time.UTC().Format(time.RFC3339Nano),
+	}
+	for k, v := range map[string]string{
+		"user":   e.User,
+		"alias":  e.Alias,
+		"bucket": e.Bucket,
+		"key":    e.Key,
+		"cache":  e.Cache,
+	} {
+		if v != "" {
+			record[k] = v
+		}
+	}
+	e.mu.Unlock()
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	if std.accessLog {
+		std.encode(Info, record)
+	}
+}
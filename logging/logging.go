@@ -0,0 +1,169 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+//Level is the severity of a log record
+type Level int
+
+const (
+	//Debug records are only emitted when troubleshooting
+	Debug Level = iota
+	//Info records report normal operation, including access logs
+	Info
+	//Warn records report recoverable problems
+	Warn
+	//Error records report failures
+	Error
+)
+
+var levelNames = map[Level]string{
+	Debug: "debug",
+	Info:  "info",
+	Warn:  "warn",
+	Error: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+//ParseLevel parses a level name (debug, info, warn or error)
+func ParseLevel(name string) (Level, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", name)
+}
+
+//Logger writes JSON log records, one per line
+type Logger struct {
+	mu        sync.Mutex
+	out       io.Writer
+	level     Level
+	accessLog bool
+}
+
+var std = &Logger{out: os.Stderr, level: Info}
+
+//Setup configures the log level and sink from the supplied configuration and routes the records written
+//through the standard library log package to the JSON logger
+func Setup(c config.ProgramConfig) (io.Closer, error) {
+	level := Info
+	if c.Log.Level != "" {
+		var err error
+		if level, err = ParseLevel(c.Log.Level); err != nil {
+			return nil, err
+		}
+	}
+	var out io.WriteCloser = nopCloser{os.Stderr}
+	switch c.Log.Sink {
+	case "", "stderr":
+	case "stdout":
+		out = nopCloser{os.Stdout}
+	default:
+		f, err := os.OpenFile(c.Log.Sink, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+
+	Configure(out, level, c.Log.AccessLog)
+	return out, nil
+}
+
+//Configure sets the sink and level of the JSON logger, routing the standard library log package through it
+func Configure(out io.Writer, level Level, accessLog bool) {
+	std.mu.Lock()
+	std.out = out
+	std.level = level
+	std.accessLog = accessLog
+	std.mu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdlibWriter{})
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+//stdlibWriter adapts the standard library logger output to info records
+type stdlibWriter struct{}
+
+func (stdlibWriter) Write(p []byte) (int, error) {
+	std.write(Info, map[string]interface{}{"msg": strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+func (l *Logger) write(level Level, record map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	l.encode(level, record)
+}
+
+//encode writes the record regardless of the configured level. Must be called with l.mu held
+func (l *Logger) encode(level Level, record map[string]interface{}) {
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": Error.String(), "msg": "cannot encode log record: " + err.Error()})
+	}
+	l.out.Write(append(line, '\n'))
+}
+
+//Enabled returns true when records of the supplied level are emitted
+func Enabled(level Level) bool {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	return level >= std.level
+}
+
+//Log emits a record with the supplied message and fields
+func Log(level Level, msg string, fields map[string]interface{}) {
+	record := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["msg"] = msg
+	std.write(level, record)
+}
+
+//Debugf emits a formatted debug record
+func Debugf(format string, args ...interface{}) {
+	Log(Debug, fmt.Sprintf(format, args...), nil)
+}
+
+//Infof emits a formatted info record
+func Infof(format string, args ...interface{}) {
+	Log(Info, fmt.Sprintf(format, args...), nil)
+}
+
+//Warnf emits a formatted warning record
+func Warnf(format string, args ...interface{}) {
+	Log(Warn, fmt.Sprintf(format, args...), nil)
+}
+
+//Errorf emits a formatted error record
+func Errorf(format string, args ...interface{}) {
+	Log(Error, fmt.Sprintf(format, args...), nil)
+}
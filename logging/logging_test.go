@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	var out bytes.Buffer
+	Configure(&out, Warn, false)
+	defer Configure(os.Stderr, Info, false)
+
+	Debugf("debug")
+	Infof("info")
+	Warnf("warning %d", 1)
+	Errorf("error")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected records %v", lines)
+	}
+	var record map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "warn" || record["msg"] != "warning 1" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestStandardLoggerIsRouted(t *testing.T) {
+	var out bytes.Buffer
+	Configure(&out, Info, false)
+	defer Configure(os.Stderr, Info, false)
+
+	log.Printf("legacy %s", "message")
+	var record map[string]string
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "info" || record["msg"] != "legacy message" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	var out bytes.Buffer
+	Configure(&out, Info, false)
+	defer Configure(os.Stderr, Info, false)
+
+	Access(&AccessEntry{RequestID: "id"})
+	if out.Len() != 0 {
+		t.Errorf("Unexpected access record %s", out.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, err := ParseLevel("DEBUG"); err != nil || l != Debug {
+		t.Errorf("Unexpected level %v (%v)", l, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/afiore/gcs-proxy/audit"
+)
+
+const auditUsage = `usage:
+  %[1]s audit verify <audit.log>
+  %[1]s audit query [-user <identity>] [-key <key or prefix*>] [-action <action>] [-since <RFC3339>] [-until <RFC3339>] <audit.log>
+`
+
+//runAudit implements the audit subcommands, returning the process exit code
+func runAudit(progName string, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintf(stderr, auditUsage, progName)
+		return 2
+	}
+	switch args[0] {
+	case "verify":
+		return verifyAuditLog(progName, args[1:])
+	case "query":
+		return queryAuditLog(progName, args[1:])
+	default:
+		fmt.Fprintf(stderr, auditUsage, progName)
+		return 2
+	}
+}
+
+func verifyAuditLog(progName string, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(stderr, auditUsage, progName)
+		return 2
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer f.Close()
+	n, err := audit.Verify(f)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: integrity check failed after %d valid events: %s\n", args[0], n, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: %d events verified\n", args[0], n)
+	return 0
+}
+
+func queryAuditLog(progName string, args []string) int {
+	flags := flag.NewFlagSet("audit query", flag.ContinueOnError)
+	var filter audit.Filter
+	var action, since, until string
+	flags.StringVar(&filter.User, "user", "", "identity of the user (e.g. jane@example.com, share:<link id>)")
+	flags.StringVar(&filter.Key, "key", "", "object key, or key prefix when ending with *")
+	flags.StringVar(&action, "action", "", "one of read, share_read, share_mint")
+	flags.StringVar(&since, "since", "", "include events at or after this RFC3339 time")
+	flags.StringVar(&until, "until", "", "include events before this RFC3339 time")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Fprintf(stderr, auditUsage, progName)
+		return 2
+	}
+	filter.Action = audit.Action(action)
+	for _, bound := range []struct {
+		value string
+		t     *time.Time
+	}{{since, &filter.Since}, {until, &filter.Until}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			fmt.Fprintf(stderr, "invalid time %s: %s\n", bound.value, err)
+			return 2
+		}
+		*bound.t = t
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer f.Close()
+	events, err := audit.Query(f, filter)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	enc := json.NewEncoder(stdout)
+	for _, e := range events {
+		enc.Encode(e)
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+//stdout and stderr receive the output of the subcommands
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+//Exit codes returned by the subcommands
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+const usage = `usage: %[1]s <command> [flags]
+
+Commands:
+  serve        run the proxy
+  validate     check a configuration and exit
+  config       convert a configuration between the TOML, YAML and JSON formats
+  gen-secret   print a random secret, e.g. for Web.OAuth.SessionSecret
+  version      print the build information
+  healthcheck  probe the health checks of a running proxy, e.g. from a container health check
+  audit        verify or query an audit log
+  ls           list the bucket aliases, or the objects under an alias/prefix
+  cat          write the content of objects to the standard output
+  stat         print the metadata of an object
+  cp           download objects to local files
+
+Run '%[1]s <command> -h' for the flags of a command.
+'%[1]s </path/to/config.toml>' is short for '%[1]s serve -config </path/to/config.toml>'.
+`
+
+//command implements a subcommand, returning the process exit code
+type command func(progName string, args []string) int
+
+var commands = map[string]command{
+	"serve":       runServe,
+	"validate":    runValidate,
+	"config":      runConfig,
+	"gen-secret":  runGenSecret,
+	"version":     runVersion,
+	"healthcheck": runHealthcheck,
+	"audit":       runAudit,
+	"ls":          runLs,
+	"cat":         runCat,
+	"stat":        runStat,
+	"cp":          runCp,
+}
+
+//run dispatches the command line to the subcommands, returning the process exit code
+func run(progName string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, usage, progName)
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		fmt.Fprintf(stdout, usage, progName)
+		return exitOK
+	}
+	if cmd, ok := commands[args[0]]; ok {
+		return cmd(progName, args[1:])
+	}
+	//kept for compatibility with the former command line, which only took the configuration path
+	if strings.HasPrefix(args[0], "-") || strings.ContainsAny(args[0], "./") {
+		return runServe(progName, args)
+	}
+	fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+	fmt.Fprintf(stderr, usage, progName)
+	return exitUsage
+}
+
+//newFlagSet returns a flag set for the subcommand, printing the supplied synopsis and description on -h
+func newFlagSet(progName, name, synopsis, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "usage: %s %s %s\n\n%s\n", progName, name, synopsis, description)
+		fmt.Fprintln(out, "\nFlags:")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+//parseFlags parses the subcommand arguments, returning the exit code to terminate with when parsing did not succeed
+func parseFlags(flags *flag.FlagSet, args []string) (int, bool) {
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return exitOK, false
+	}
+	if err != nil {
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+//configFlags select the configuration file and override its settings. Overrides take precedence over the
+//environment variables, which take precedence over the file
+type configFlags struct {
+	path     string
+	listen   string
+	logLevel string
+}
+
+func (f *configFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.path, "config", "", "path to the configuration (.toml, .yaml or .json), which can also be supplied as the only argument")
+	flags.StringVar(&f.listen, "listen", "", "address to listen on (e.g. :8080 or 127.0.0.1:8080), overriding Web.Host and Web.Port")
+	flags.StringVar(&f.logLevel, "log-level", "", "one of debug, info, warn or error, overriding Log.Level")
+}
+
+//resolve returns the configuration path and the overrides, once the flags have been parsed. The path is taken from
+//the only positional argument, when supplied
+func (f *configFlags) resolve(args []string) (string, []config.Override, error) {
+	path := f.path
+	switch {
+	case len(args) > 1 || (len(args) == 1 && path != ""):
+		return "", nil, fmt.Errorf("expected a single configuration path, got %s", strings.Join(append(args, path), " "))
+	case len(args) == 1:
+		path = args[0]
+	case path == "":
+		return "", nil, fmt.Errorf("a configuration path is required")
+	}
+
+	var overrides []config.Override
+	if f.listen != "" {
+		host, portValue, err := net.SplitHostPort(f.listen)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid listen address %s: %s", f.listen, err)
+		}
+		port, err := strconv.ParseInt(portValue, 10, 16)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid listen port %s", portValue)
+		}
+		overrides = append(overrides, func(c *config.ProgramConfig) {
+			c.Web.Host, c.Web.Port = host, int16(port)
+		})
+	}
+	if level := f.logLevel; level != "" {
+		overrides = append(overrides, func(c *config.ProgramConfig) {
+			c.Log.Level = level
+		})
+	}
+	return path, overrides, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/server"
+)
+
+const testConfig = `[Gcs]
+ServiceAccountFilePath = "SA_FILE"
+[Gcs.Buckets]
+b1 = "bucket1"
+
+[Web]
+Port = 8080
+[Web.OAuth]
+ClientID = "client-id"
+ClientSecret = "client-secret"
+SessionSecret = "0123456789abcdef0123456789abcdef"
+AllowedHostDomains = ["lenses.io"]
+`
+
+//runCommand runs the command line, returning the exit code along with the standard output and error
+func runCommand(args ...string) (int, string, string) {
+	var out, errOut bytes.Buffer
+	stdout, stderr = &out, &errOut
+	defer func() { stdout, stderr = os.Stdout, os.Stderr }()
+	code := run("gcs-proxy", args)
+	return code, out.String(), errOut.String()
+}
+
+//writeConfig writes the configuration to a temporary directory, along with the service account file it refers to
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	saFile := filepath.Join(dir, "sa.json")
+	if err := ioutil.WriteFile(saFile, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte(strings.Replace(content, "SA_FILE", saFile, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type commandTest struct {
+	name   string
+	args   []string
+	code   int
+	stdout string
+	stderr string
+}
+
+func runCommandTests(t *testing.T, tests []commandTest) {
+	for _, test := range tests {
+		code, out, errOut := runCommand(test.args...)
+		if code != test.code {
+			t.Errorf("%s: unexpected exit code %d\nstdout: %s\nstderr: %s", test.name, code, out, errOut)
+		}
+		if !strings.Contains(out, test.stdout) {
+			t.Errorf("%s: expected %q in the standard output, got %q", test.name, test.stdout, out)
+		}
+		if !strings.Contains(errOut, test.stderr) {
+			t.Errorf("%s: expected %q in the standard error, got %q", test.name, test.stderr, errOut)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	runCommandTests(t, []commandTest{
+		{"no command", nil, exitUsage, "", "usage: gcs-proxy <command>"},
+		{"help", []string{"help"}, exitOK, "Commands:", ""},
+		{"-h", []string{"-h"}, exitOK, "Commands:", ""},
+		{"unknown command", []string{"frobnicate"}, exitUsage, "", `unknown command "frobnicate"`},
+		{"command help", []string{"version", "-h"}, exitOK, "", "usage: gcs-proxy version"},
+		{"unknown flag", []string{"version", "-frobnicate"}, exitUsage, "", "flag provided but not defined"},
+		{"former command line", []string{"./missing.toml"}, exitFailure, "", "missing.toml"},
+	})
+}
+
+func TestValidate(t *testing.T) {
+	valid := writeConfig(t, testConfig)
+	invalid := writeConfig(t, strings.Replace(testConfig, `ClientSecret = "client-secret"`, `ClientSecret = ""`, 1))
+	runCommandTests(t, []commandTest{
+		{"valid", []string{"validate", valid}, exitOK, "configuration is valid", ""},
+		{"-config", []string{"validate", "-config", valid}, exitOK, "configuration is valid", ""},
+		{"override", []string{"validate", "-listen", "127.0.0.1:9000", valid}, exitOK, "configuration is valid", ""},
+		{"invalid", []string{"validate", invalid}, exitFailure, "", "Web.OAuth.ClientSecret"},
+		{"invalid override", []string{"validate", "-log-level", "loud", valid}, exitFailure, "", "Log.Level"},
+		{"invalid listen address", []string{"validate", "-listen", "9000", valid}, exitUsage, "", "invalid listen address"},
+		{"missing path", []string{"validate"}, exitUsage, "", "a configuration path is required"},
+		{"two paths", []string{"validate", "-config", valid, valid}, exitUsage, "", "expected a single configuration path"},
+	})
+}
+
+func TestGenSecret(t *testing.T) {
+	runCommandTests(t, []commandTest{
+		{"too short", []string{"gen-secret", "-bytes", "16"}, exitUsage, "", "expected at least 32 bytes"},
+		{"argument", []string{"gen-secret", "extra"}, exitUsage, "", "expected at least 32 bytes"},
+	})
+	for _, n := range []int{minSecretBytes, 48} {
+		code, out, _ := runCommand("gen-secret", "-bytes", strconv.Itoa(n))
+		secret, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(out))
+		if code != exitOK || err != nil || len(secret) != n {
+			t.Errorf("Unexpected secret %q (exit code %d, %v)", out, code, err)
+		}
+	}
+	_, first, _ := runCommand("gen-secret")
+	if _, second, _ := runCommand("gen-secret"); first == second {
+		t.Errorf("Expected random secrets, got %s twice", first)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	runCommandTests(t, []commandTest{
+		{"text", []string{"version"}, exitOK, "gcs-proxy ", ""},
+		{"argument", []string{"version", "-json=maybe"}, exitUsage, "", "invalid boolean value"},
+	})
+	code, out, _ := runCommand("version", "-json")
+	var info map[string]string
+	if err := json.Unmarshal([]byte(out), &info); code != exitOK || err != nil || info["version"] == "" || info["go_version"] == "" {
+		t.Errorf("Unexpected JSON build information %q (exit code %d, %v)", out, code, err)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	ready := int32(1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == server.HealthzPath:
+			w.Write([]byte("ok\n"))
+		case r.URL.Path == server.ReadyzPath && atomic.LoadInt32(&ready) == 1:
+			w.Write([]byte("ready\n"))
+		case r.URL.Path == server.ReadyzPath:
+			http.Error(w, "storage: unavailable", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer proxy.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	runCommandTests(t, []commandTest{
+		{"live", []string{"healthcheck", "-url", proxy.URL}, exitOK, "ok", ""},
+		{"ready", []string{"healthcheck", "-url", proxy.URL + "/", "-ready"}, exitOK, "ready", ""},
+		{"path prefix", []string{"healthcheck", "-url", proxy.URL + "/prefix"}, exitFailure, "", "404"},
+		{"unreachable", []string{"healthcheck", "-url", unreachable.URL, "-timeout", "1s"}, exitFailure, "", "connection refused"},
+		{"argument", []string{"healthcheck", "extra"}, exitUsage, "", "usage: gcs-proxy healthcheck"},
+	})
+	atomic.StoreInt32(&ready, 0)
+	runCommandTests(t, []commandTest{
+		{"not ready", []string{"healthcheck", "-url", proxy.URL, "-ready"}, exitFailure, "", "storage: unavailable"},
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+const configUsage = `usage:
+  %[1]s config convert [-to toml|yaml|json] <input> [<output>]
+`
+
+//runConfig implements the config subcommands, returning the process exit code
+func runConfig(progName string, args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintf(stderr, configUsage, progName)
+		return exitUsage
+	}
+	switch args[0] {
+	case "convert":
+		return convertConfig(progName, args[1:])
+	case "-h", "-help", "--help":
+		fmt.Fprintf(stdout, configUsage, progName)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, configUsage, progName)
+		return exitUsage
+	}
+}
+
+func convertConfig(progName string, args []string) int {
+	flags := newFlagSet(progName, "config convert", "[flags] <input> [<output>]",
+		"Converts the configuration to the format selected by -to or by the extension of the output file, writing it to\n"+
+			"the standard output when no output is supplied. Settings left to their defaults are omitted, while\n"+
+			"environment overrides are not applied.")
+	to := flags.String("to", "", "output format, one of toml, yaml or json")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 || (flags.NArg() == 1 && *to == "") {
+		flags.Usage()
+		return exitUsage
+	}
+	format := *to
+	if format == "" {
+		var err error
+		if format, err = config.FormatOf(flags.Arg(1)); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+	}
+	switch format {
+	case config.FormatTOML, config.FormatYAML, config.FormatJSON:
+	default:
+		fmt.Fprintf(stderr, "unsupported format %s, expected one of toml, yaml or json\n", format)
+		return exitUsage
+	}
+
+	c, err := config.Decode(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	var out bytes.Buffer
+	if err := config.Encode(&out, c, format); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	if flags.NArg() == 1 {
+		stdout.Write(out.Bytes())
+		return exitOK
+	}
+	if err := ioutil.WriteFile(flags.Arg(1), out.Bytes(), 0640); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/afiore/gcs-proxy/server"
+)
+
+//runHealthcheck implements the healthcheck subcommand, returning the process exit code. It lets container health
+//checks probe the proxy without requiring an HTTP client in the image
+func runHealthcheck(progName string, args []string) int {
+	flags := newFlagSet(progName, "healthcheck", "[flags]",
+		"Probes the liveness (or readiness) check of a running proxy, exiting with 0 when healthy and 1 otherwise.")
+	baseURL := flags.String("url", "http://127.0.0.1:8080", "base URL of the proxy, including Web.PathPrefix when set")
+	ready := flags.Bool("ready", false, "probe the readiness check rather than the liveness one")
+	timeout := flags.Duration("timeout", 5*time.Second, "time allowed for the probe")
+	insecure := flags.Bool("insecure", false, "skip the verification of the TLS certificate")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	path := server.HealthzPath
+	if *ready {
+		path = server.ReadyzPath
+	}
+	client := &http.Client{Timeout: *timeout}
+	if *insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Get(strings.TrimSuffix(*baseURL, "/") + path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(stderr, "%s: %s\n%s\n", path, resp.Status, strings.TrimSpace(string(body)))
+		return exitFailure
+	}
+	fmt.Fprintln(stdout, strings.TrimSpace(string(body)))
+	return exitOK
+}
@@ -1,56 +1,242 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
-	"github.com/BurntSushi/toml"
+	"github.com/afiore/gcs-proxy/audit"
 	"github.com/afiore/gcs-proxy/config"
 	"github.com/afiore/gcs-proxy/gcs"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/metrics"
 	"github.com/afiore/gcs-proxy/server"
+	"github.com/afiore/gcs-proxy/store"
+	"github.com/afiore/gcs-proxy/tracing"
 )
 
 func main() {
-	var conf config.ProgramConfig
+	os.Exit(run(os.Args[0], os.Args[1:]))
+}
+
+//runServe implements the serve subcommand, returning the process exit code
+func runServe(progName string, args []string) int {
+	var cf configFlags
+	flags := newFlagSet(progName, "serve", "[flags] [</path/to/config.toml>]",
+		"Runs the proxy until it receives SIGTERM or SIGINT, reloading the configuration on SIGHUP.")
+	cf.register(flags)
+	dryRun := flags.Bool("dry-run", false, "print the effective configuration, with secrets redacted, and exit without serving")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	path, overrides, err := cf.resolve(flags.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		flags.Usage()
+		return exitUsage
+	}
+	conf, err := config.Load(path, overrides...)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration:\n%s\n", err)
+		return exitFailure
+	}
+	if *dryRun {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(conf.Redacted()); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailure
+		}
+		return exitOK
+	}
+	if err := serve(path, overrides, conf); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
 
-	progName := os.Args[0]
-	if len(os.Args) < 2 {
-		os.Stderr.WriteString(fmt.Sprintf("usage: %s </path/to/config.toml>", progName))
-		os.Exit(1)
-		return
+//serve runs the proxy until it fails or is asked to shut down, releasing its resources before returning.
+//The configuration is reloaded from path, along with the overrides, when the file changes or on SIGHUP
+func serve(path string, overrides []config.Override, conf config.ProgramConfig) error {
+	logSink, err := logging.Setup(conf)
+	if err != nil {
+		return fmt.Errorf("Couldn't initialise logging: %s", err)
 	}
-	configPath := os.Args[1]
-	configBytes, err := ioutil.ReadFile(configPath)
+	defer logSink.Close()
+
+	shutdownTracing, err := tracing.Setup(conf)
 	if err != nil {
-		log.Fatalf("usage: %s </path/to/config.toml>", progName)
+		return fmt.Errorf("Couldn't initialise tracing: %s", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	err = toml.Unmarshal(configBytes, &conf)
+	gcsStore := gcs.StoreOps(conf.Gcs.ServiceAccountFilePath)
+	if closer, ok := gcsStore.(io.Closer); ok {
+		defer closer.Close()
+	}
+	var auditLog *audit.Log
+	if conf.Audit.Enabled {
+		writer, _ := gcsStore.(store.ObjectWriter)
+		auditLog, err = audit.Open(conf, writer)
+		if err != nil {
+			return fmt.Errorf("Couldn't open audit log: %s", err)
+		}
+		defer auditLog.Close()
+	}
+
+	objStore, layers, err := decorateStore(conf, gcsStore)
 	if err != nil {
-		log.Fatalf("Couldn't parse configuration file: %s", err)
+		return err
 	}
+	shareLinks := server.NewShareLinks(conf, auditLog)
+	sessions := server.NewSessions(server.DefaultSessionWindow)
+	transfers := server.NewTransfers()
+	build := func(conf config.ProgramConfig) http.Handler {
+		gcsHandler := server.ServeFromBuckets(conf.Gcs.Buckets, objStore,
+			server.WithHostRoutes(conf.Gcs.Hosts),
+			server.WithRewrites(conf.Web.Rewrites),
+			server.WithSignedRedirects(conf.Gcs.SignedRedirects),
+			server.WithHeaderRules(conf.Web.HeaderRules),
+			server.WithCompression(conf.Web.Compression),
+			server.WithAuditLog(auditLog),
+			server.WithMinThroughput(conf.Web.Limits.MinThroughputBytesPerSec, conf.Web.Limits.MinThroughputWindow.Duration),
+			server.WithTransferTracker(transfers),
+		)
+		serverHandler := server.ValidatingSession(conf.Web.OAuth.AllowedHostDomains, conf.Web.OAuth.SessionSecret, gcsHandler,
+			server.WithShareLinks(shareLinks), server.WithSessionTracker(sessions))
+		shareHandler := server.ValidatingSession(conf.Web.OAuth.AllowedHostDomains, conf.Web.OAuth.SessionSecret, shareLinks.Mint)
+		googleOAuth := server.Handlers(conf)
 
-	store := gcs.StoreOps(conf.Gcs.ServiceAccountFilePath)
-	gcsHandler := server.ServeFromBuckets(conf.Gcs.Buckets, store)
-	serverHandler := server.ValidatingSession(conf.Web.OAuth.AllowedHostDomains, conf.Web.OAuth.SessionSecret, gcsHandler)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", serverHandler)
+		mux.HandleFunc("/auth/google/login", googleOAuth.Login)
+		mux.HandleFunc("/auth/google/callback", googleOAuth.Callback)
+		mux.HandleFunc(server.ShareLinkPath, shareHandler)
+		return mux
+	}
+	app := server.NewReloadable(build(conf))
+	configReloader := &reloader{path: path, overrides: overrides, current: conf, handler: app, shareLinks: shareLinks, build: build}
+	metrics.ConfigLoaded()
 
+	limited := server.Limited(conf.Web.Limits.MaxInFlight, conf.Web.Limits.MaxInFlightPerIP, app)
 	mux := http.NewServeMux()
+	mux.Handle("/", limited)
+	mux.Handle("/auth/google/login", limited)
+	mux.Handle("/auth/google/callback", limited)
+	mux.Handle(server.ShareLinkPath, limited)
 
-	googleOAuth := server.Handlers(conf)
+	health := server.NewHealth(configReloader.config, gcsStore)
+	mux.HandleFunc(server.HealthzPath, health.Healthz)
+	mux.HandleFunc(server.ReadyzPath, health.Readyz)
+	mux.HandleFunc(server.VersionPath, health.Version)
 
-	mux.HandleFunc("/", serverHandler)
-	mux.HandleFunc("/auth/google/login", googleOAuth.Login)
-	mux.HandleFunc("/auth/google/callback", googleOAuth.Callback)
+	handler, err := server.ExternalURL(conf, server.AccessLogged(server.Traced(server.Recovering(mux))))
+	if err != nil {
+		return fmt.Errorf("Couldn't resolve the public URL: %s", err)
+	}
+	handler = server.HSTS(conf, handler)
+	httpServer := server.NewHTTPServer(listenAddress(conf, conf.Web.Port), handler, conf)
+	servers := []*http.Server{httpServer}
+	if conf.Web.TLS.Enabled {
+		tlsSetup, err := server.NewTLS(conf)
+		if err != nil {
+			return fmt.Errorf("Couldn't initialise TLS: %s", err)
+		}
+		httpServer.TLSConfig = tlsSetup.Config
+		if port := conf.Web.TLS.RedirectPort; port != 0 {
+			servers = append(servers, server.NewHTTPServer(listenAddress(conf, port), tlsSetup.Redirect, conf))
+		}
+	}
+	if conf.Web.Metrics.Enabled {
+		servers = append(servers, metricsServer(conf))
+	}
+	if conf.Web.Admin.Enabled {
+		adminHandler := server.NewAdmin(conf.Web.Admin.Token, server.AdminState{
+			Config:    configReloader.config,
+			Health:    health,
+			Sessions:  sessions,
+			Transfers: transfers,
+			Cache:     layers.cache,
+			Breaker:   layers.resilience,
+		})
+		adminAddress := net.JoinHostPort(conf.AdminHost(), strconv.Itoa(int(conf.Web.Admin.Port)))
+		adminServer := server.NewHTTPServer(adminAddress, server.AccessLogged(server.Recovering(adminHandler)), conf)
+		//the admin API shares the certificate of the proxy, validation keeping it on a loopback address otherwise
+		adminServer.TLSConfig = httpServer.TLSConfig
+		logging.Infof("Exposing the admin API on %s at %s", adminAddress, server.AdminPath)
+		servers = append(servers, adminServer)
+	}
+
+	signals, stopSignals := shutdownSignals()
+	defer stopSignals()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	changes := make(chan struct{}, 1)
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go config.Watch(watchCtx, path, configCheckInterval, func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errc <- listen(srv)
+		}(srv)
+	}
+	logging.Log(logging.Info, "Loading server", map[string]interface{}{"config": conf.Redacted()})
 
-	httpServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", conf.Web.Port),
-		Handler: mux,
+	for running := true; running; {
+		select {
+		case err := <-errc:
+			return err
+		case <-hangups:
+			logging.Infof("received SIGHUP, reloading the configuration from %s", path)
+			configReloader.reload()
+		case <-changes:
+			logging.Infof("the configuration file %s changed, reloading it", path)
+			configReloader.reload()
+		case sig := <-signals:
+			logging.Infof("received %s, shutting down", sig)
+			running = false
+		}
 	}
+	shutdown(conf, health, servers, signals)
+	return nil
+}
+
+//listen serves HTTPS on servers configured with TLS and plain HTTP on the others
+func listen(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
 
-	http.HandleFunc("/", serverHandler)
-	log.Printf("Loading server with config: %+v", conf)
-	log.Fatal(httpServer.ListenAndServe())
+//listenAddress returns the address to listen on for the supplied port
+func listenAddress(conf config.ProgramConfig, port int16) string {
+	return net.JoinHostPort(conf.Web.Host, strconv.Itoa(int(port)))
+}
+
+func metricsServer(conf config.ProgramConfig) *http.Server {
+	path := conf.Web.Metrics.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, metrics.Handler())
+	logging.Infof("Exposing metrics on port %d at %s", conf.Web.Metrics.Port, path)
+	return server.NewHTTPServer(listenAddress(conf, conf.Web.Metrics.Port), mux, conf)
 }
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/gcs"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/server"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+//objectSession gives the object commands access to the bucket aliases and host routes through the same store layers
+//as the proxy
+type objectSession struct {
+	buckets  map[string]string
+	resolver *server.Resolver
+	//host, when set, is the host name paths are resolved as requested on, selecting its host route
+	host    string
+	store   store.ObjectStoreOps
+	backend store.ObjectStoreOps
+	logSink io.Closer
+}
+
+//openObjects parses the flags of an object command, loads the configuration and sets up its store. It returns the
+//exit code to terminate with when the command can't proceed
+func openObjects(flags *flag.FlagSet, args []string, minArgs, maxArgs int) (*objectSession, int, bool) {
+	var cf configFlags
+	flags.StringVar(&cf.path, "config", "", "path to the configuration, .toml, .yaml or .json (required)")
+	flags.StringVar(&cf.logLevel, "log-level", "", "one of debug, info, warn or error, overriding Log.Level")
+	host := flags.String("host", "", "resolve paths as requested on this host name, through its host route")
+	if code, ok := parseFlags(flags, args); !ok {
+		return nil, code, false
+	}
+	if flags.NArg() < minArgs || (maxArgs >= 0 && flags.NArg() > maxArgs) {
+		flags.Usage()
+		return nil, exitUsage, false
+	}
+	path, overrides, err := cf.resolve(nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		flags.Usage()
+		return nil, exitUsage, false
+	}
+	conf, err := config.Load(path, overrides...)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid configuration:\n%s\n", err)
+		return nil, exitFailure, false
+	}
+	if conf.Log.Sink == "stdout" {
+		//the standard output is reserved to the command output
+		conf.Log.Sink = "stderr"
+	}
+	//the disk tier is owned by the server, which may be running next to the command: indexing it would delete the
+	//temporary files of its transfers and evict its entries
+	conf.Cache.DiskDir = ""
+	logSink, err := logging.Setup(conf)
+	if err != nil {
+		fmt.Fprintf(stderr, "Couldn't initialise logging: %s\n", err)
+		return nil, exitFailure, false
+	}
+	backend := gcs.StoreOps(conf.Gcs.ServiceAccountFilePath)
+	objStore, _, err := decorateStore(conf, backend)
+	if err != nil {
+		logSink.Close()
+		fmt.Fprintln(stderr, err)
+		return nil, exitFailure, false
+	}
+	resolver := server.NewResolver(conf.Gcs.Buckets, server.WithHostRoutes(conf.Gcs.Hosts), server.WithRewrites(conf.Web.Rewrites))
+	return &objectSession{buckets: conf.Gcs.Buckets, resolver: resolver, host: *host, store: objStore, backend: backend,
+		logSink: logSink}, exitOK, true
+}
+
+func (o *objectSession) close() {
+	if closer, ok := o.backend.(io.Closer); ok {
+		closer.Close()
+	}
+	o.logSink.Close()
+}
+
+//resolve maps an object path (e.g. alias/path/to/key) to its alias, bucket and key, the way the proxy maps request
+//paths: rewrite rules apply, then the host route of the session host, if any, and the bucket aliases
+func (o *objectSession) resolve(objectPath string) (alias, bucket, key string, err error) {
+	return o.resolver.Resolve(o.host, "/"+strings.TrimPrefix(objectPath, "/"))
+}
+
+//resolvePrefix maps a path to its alias, bucket and key prefix, along with the path the keys under the prefix are
+//printed relative to. A bare alias (e.g. alias) denotes the root of its bucket
+func (o *objectSession) resolvePrefix(objectPath string) (bucket, prefix, display string, err error) {
+	display = strings.TrimPrefix(objectPath, "/")
+	if o.host == "" && !strings.Contains(display, "/") {
+		display += "/"
+	}
+	_, bucket, prefix, err = o.resolver.ResolvePrefix(o.host, "/"+display)
+	return bucket, prefix, display, err
+}
+
+//list reports the entries under the supplied prefix, or all the objects under it when recursive
+func (o *objectSession) list(ctx context.Context, bucket, prefix string, recursive bool, fn func(store.ListEntry) error) error {
+	lister, ok := o.store.(store.Lister)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	delimiter := "/"
+	if recursive {
+		delimiter = ""
+	}
+	return lister.ListObjects(ctx, bucket, prefix, delimiter, fn)
+}
+
+//runLs implements the ls subcommand, returning the process exit code
+func runLs(progName string, args []string) int {
+	flags := newFlagSet(progName, "ls", "-config <config.toml> [flags] [<alias>[/prefix]]",
+		"Lists the objects and common prefixes under the supplied path, or the bucket aliases when none is supplied.")
+	recursive := flags.Bool("r", false, "list all the objects under the prefix, rather than grouping them by directory")
+	long := flags.Bool("l", false, "also print the size, update time and content type of the objects")
+	objects, code, ok := openObjects(flags, args, 0, 1)
+	if !ok {
+		return code
+	}
+	defer objects.close()
+	return exitCode(objects.ls(context.Background(), flags.Arg(0), *recursive, *long))
+}
+
+//ls prints the objects and common prefixes under the supplied path, or the bucket aliases when the path is empty
+func (o *objectSession) ls(ctx context.Context, objectPath string, recursive, long bool) error {
+	out := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+	if objectPath == "" && o.host == "" {
+		aliases := make([]string, 0, len(o.buckets))
+		for alias := range o.buckets {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		for _, alias := range aliases {
+			fmt.Fprintf(out, "%s/\t%s\n", alias, o.buckets[alias])
+		}
+		return nil
+	}
+
+	bucket, prefix, display, err := o.resolvePrefix(objectPath)
+	if err != nil {
+		return err
+	}
+	return o.list(ctx, bucket, prefix, recursive, func(e store.ListEntry) error {
+		path := display + strings.TrimPrefix(e.Key, prefix)
+		switch {
+		case !long:
+			fmt.Fprintln(out, path)
+		case e.Metadata == nil:
+			fmt.Fprintf(out, "\t\t\t%s\n", path)
+		default:
+			fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", e.Metadata.Size(), e.Metadata.Updated().UTC().Format(time.RFC3339), e.Metadata.ContentType(), path)
+		}
+		return nil
+	})
+}
+
+//runCat implements the cat subcommand, returning the process exit code
+func runCat(progName string, args []string) int {
+	flags := newFlagSet(progName, "cat", "-config <config.toml> [flags] <alias/key>...",
+		"Writes the content of the objects to the standard output.")
+	objects, code, ok := openObjects(flags, args, 1, -1)
+	if !ok {
+		return code
+	}
+	defer objects.close()
+	return exitCode(objects.cat(context.Background(), flags.Args()))
+}
+
+//cat writes the content of the objects to the standard output, stopping at the first failure
+func (o *objectSession) cat(ctx context.Context, objectPaths []string) error {
+	for _, objectPath := range objectPaths {
+		_, bucket, key, err := o.resolve(objectPath)
+		if err != nil {
+			return err
+		}
+		if err := o.copyObject(ctx, bucket, key, stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//objectStat is the description of an object printed by stat
+type objectStat struct {
+	Bucket             string            `json:"bucket"`
+	Key                string            `json:"key"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"content_type"`
+	Updated            time.Time         `json:"updated"`
+	Generation         int64             `json:"generation"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentEncoding    string            `json:"content_encoding,omitempty"`
+	ContentLanguage    string            `json:"content_language,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+//runStat implements the stat subcommand, returning the process exit code
+func runStat(progName string, args []string) int {
+	flags := newFlagSet(progName, "stat", "-config <config.toml> [flags] <alias/key>",
+		"Prints the metadata of the object, as fetched by the proxy before serving it.")
+	asJSON := flags.Bool("json", false, "print the metadata as JSON")
+	objects, code, ok := openObjects(flags, args, 1, 1)
+	if !ok {
+		return code
+	}
+	defer objects.close()
+	return exitCode(objects.stat(context.Background(), flags.Arg(0), *asJSON))
+}
+
+//stat prints the metadata of the object, as a table or as JSON
+func (o *objectSession) stat(ctx context.Context, objectPath string, asJSON bool) error {
+	_, bucket, key, err := o.resolve(objectPath)
+	if err != nil {
+		return err
+	}
+	meta, err := o.store.GetObjectMetadata(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	stat := objectStat{
+		Bucket:             bucket,
+		Key:                key,
+		Size:               meta.Size(),
+		ContentType:        meta.ContentType(),
+		Updated:            meta.Updated().UTC(),
+		Generation:         meta.Generation(),
+		CacheControl:       meta.CacheControl(),
+		ContentEncoding:    meta.ContentEncoding(),
+		ContentLanguage:    meta.ContentLanguage(),
+		ContentDisposition: meta.ContentDisposition(),
+		Metadata:           meta.Metadata(),
+	}
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stat)
+	}
+	out := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+	for _, field := range [][2]interface{}{
+		{"Bucket", stat.Bucket},
+		{"Key", stat.Key},
+		{"Size", stat.Size},
+		{"Content-Type", stat.ContentType},
+		{"Updated", stat.Updated.Format(time.RFC3339)},
+		{"Generation", stat.Generation},
+		{"Cache-Control", stat.CacheControl},
+		{"Content-Encoding", stat.ContentEncoding},
+		{"Content-Language", stat.ContentLanguage},
+		{"Content-Disposition", stat.ContentDisposition},
+	} {
+		fmt.Fprintf(out, "%s:\t%v\n", field[0], field[1])
+	}
+	names := make([]string, 0, len(stat.Metadata))
+	for name := range stat.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "x-goog-meta-%s:\t%s\n", name, stat.Metadata[name])
+	}
+	return nil
+}
+
+//errRecursiveToStdout is returned by cp when asked to copy a prefix to the standard output
+var errRecursiveToStdout = errors.New("recursive copies require a destination directory")
+
+//runCp implements the cp subcommand, returning the process exit code
+func runCp(progName string, args []string) int {
+	flags := newFlagSet(progName, "cp", "-config <config.toml> [flags] <alias/key> <destination>",
+		"Downloads the object to the destination file or directory, or to the standard output when the destination is -.\n"+
+			"With -r, downloads all the objects under the alias/prefix into the destination directory.")
+	recursive := flags.Bool("r", false, "download all the objects under the prefix, preserving their relative paths")
+	objects, code, ok := openObjects(flags, args, 2, 2)
+	if !ok {
+		return code
+	}
+	defer objects.close()
+	err := objects.cp(context.Background(), flags.Arg(0), flags.Arg(1), *recursive)
+	if err == errRecursiveToStdout {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+	return exitCode(err)
+}
+
+//cp downloads the object to the dest file or directory, or to the standard output when dest is -. When recursive, it
+//downloads all the objects under the prefix into the dest directory
+func (o *objectSession) cp(ctx context.Context, objectPath, dest string, recursive bool) error {
+	if recursive {
+		if dest == "-" {
+			return errRecursiveToStdout
+		}
+		bucket, prefix, _, err := o.resolvePrefix(objectPath)
+		if err != nil {
+			return err
+		}
+		return o.copyTree(ctx, bucket, prefix, dest, stdout)
+	}
+	_, bucket, key, err := o.resolve(objectPath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(key))
+	}
+	return o.download(ctx, bucket, key, dest)
+}
+
+//exitCode reports the error of an object command on the standard error, returning the process exit code
+func exitCode(err error) int {
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+//copyTree downloads the objects under the prefix into the dest directory, preserving their path relative to the
+//prefix and printing the files written to out. Objects whose relative path would escape dest, e.g. through ..
+//segments, are skipped and reported by the returned error once the other objects are downloaded
+func (o *objectSession) copyTree(ctx context.Context, bucket, prefix, dest string, out io.Writer) error {
+	root := filepath.Clean(dest)
+	var skipped int
+	err := o.list(ctx, bucket, prefix, true, func(e store.ListEntry) error {
+		if strings.HasSuffix(e.Key, "/") {
+			//placeholder objects created by the console to represent directories
+			return nil
+		}
+		target, ok := confined(root, strings.TrimPrefix(e.Key, prefix))
+		if !ok {
+			logging.Warnf("skipping %s: its path resolves outside of %s", e.Key, root)
+			skipped++
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := o.download(ctx, bucket, e.Key, target); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, target)
+		return nil
+	})
+	if err == nil && skipped > 0 {
+		err = fmt.Errorf("skipped %d objects whose path resolves outside of %s", skipped, root)
+	}
+	return err
+}
+
+//confined joins the slash separated relative path to root, reporting false when the result isn't strictly under root
+func confined(root, relative string) (string, bool) {
+	relative = filepath.FromSlash(relative)
+	if relative == "" || filepath.IsAbs(relative) || filepath.VolumeName(relative) != "" {
+		return "", false
+	}
+	target := filepath.Join(root, relative)
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return target, true
+}
+
+//download copies the object to the file at dest, or to the standard output when dest is -. Partially written files
+//are removed
+func (o *objectSession) download(ctx context.Context, bucket, key, dest string) error {
+	if dest == "-" {
+		return o.copyObject(ctx, bucket, key, stdout)
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	err = o.copyObject(ctx, bucket, key, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+//copyObject writes the content of the object to w. The store returns the objects stored with gzip content encoding
+//as they are stored, for the proxy to serve them compressed: these are decompressed, as a client would
+func (o *objectSession) copyObject(ctx context.Context, bucket, key string, w io.Writer) error {
+	meta, err := o.store.GetObjectMetadata(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(meta.ContentEncoding(), "gzip") {
+		_, err := o.store.CopyObject(ctx, bucket, key, w)
+		return err
+	}
+	compressed, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		_, err := o.store.CopyObject(ctx, bucket, key, pw)
+		pw.CloseWithError(err)
+		copied <- err
+	}()
+	zr, err := gzip.NewReader(compressed)
+	if err == nil {
+		_, err = io.Copy(w, zr)
+	}
+	//unblock the copy when decompression fails
+	compressed.CloseWithError(err)
+	if copyErr := <-copied; copyErr != nil && copyErr != err {
+		return copyErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot decompress %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/server"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+type memObject struct {
+	contentType     string
+	contentEncoding string
+	body            string
+	metadata        map[string]string
+}
+
+func (o memObject) ContentType() string         { return o.contentType }
+func (o memObject) Size() int64                 { return int64(len(o.body)) }
+func (o memObject) Updated() time.Time          { return time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC) }
+func (o memObject) Generation() int64           { return 1 }
+func (o memObject) CacheControl() string        { return "" }
+func (o memObject) ContentEncoding() string     { return o.contentEncoding }
+func (o memObject) ContentLanguage() string     { return "" }
+func (o memObject) ContentDisposition() string  { return "" }
+func (o memObject) Metadata() map[string]string { return o.metadata }
+
+//memStore is an in memory store.Lister, keyed by bucket and object key
+type memStore map[string]map[string]memObject
+
+func (s memStore) get(bucket, key string) (memObject, error) {
+	o, ok := s[bucket][key]
+	if !ok {
+		return o, &store.ObjectNotFound{Bucket: bucket, Key: key}
+	}
+	return o, nil
+}
+
+func (s memStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	return s.get(bucket, key)
+}
+
+func (s memStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	o, err := s.get(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.WriteString(w, o.body)
+	return int64(n), err
+}
+
+func (s memStore) ListObjects(ctx context.Context, bucket, prefix, delimiter string, fn func(store.ListEntry) error) error {
+	keys := make([]string, 0, len(s[bucket]))
+	for key := range s[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var lastPrefix string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := store.ListEntry{Key: key, Metadata: s[bucket][key]}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entry = store.ListEntry{Key: key[:len(prefix)+i+len(delimiter)]}
+			if entry.Key == lastPrefix {
+				continue
+			}
+			lastPrefix = entry.Key
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//newObjects constructs a session resolving the b1 alias, and the host routes and rewrites set through opts, to bucket1
+func newObjects(objects map[string]memObject, opts ...server.Option) *objectSession {
+	buckets := map[string]string{"b1": "bucket1"}
+	return &objectSession{buckets: buckets, resolver: server.NewResolver(buckets, opts...), store: memStore{"bucket1": objects}}
+}
+
+func testObjects(opts ...server.Option) *objectSession {
+	return newObjects(map[string]memObject{
+		"reports/q3.html":      {contentType: "text/html", body: "q3"},
+		"reports/2020/q4.html": {contentType: "text/html", body: "q4"},
+		"reports/archive/":     {},
+		"index.html":           {contentType: "text/html", body: "index", metadata: map[string]string{"owner": "ops"}},
+	}, opts...)
+}
+
+//captureStdout runs the object command, returning what it wrote to the standard output
+func captureStdout(command func() error) (string, error) {
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	err := command()
+	return out.String(), err
+}
+
+func TestLs(t *testing.T) {
+	ctx := context.Background()
+	objects := testObjects()
+	for _, tc := range []struct {
+		name, path      string
+		recursive, long bool
+		expected        []string
+	}{
+		{"aliases", "", false, false, []string{"b1/ bucket1"}},
+		{"alias", "b1", false, false, []string{"b1/index.html", "b1/reports/"}},
+		{"prefix", "b1/reports/", false, false, []string{"b1/reports/2020/", "b1/reports/archive/", "b1/reports/q3.html"}},
+		{"recursive", "b1/reports/", true, false,
+			[]string{"b1/reports/2020/q4.html", "b1/reports/archive/", "b1/reports/q3.html"}},
+		{"long", "b1", false, true, []string{"5 2020-05-01T12:00:00Z text/html b1/index.html", "b1/reports/"}},
+	} {
+		out, err := captureStdout(func() error { return objects.ls(ctx, tc.path, tc.recursive, tc.long) })
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			lines = append(lines, strings.Join(strings.Fields(line), " "))
+		}
+		if strings.Join(lines, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("%s: unexpected output %q", tc.name, out)
+		}
+	}
+	if _, err := captureStdout(func() error { return objects.ls(ctx, "missing/", false, false) }); err == nil {
+		t.Errorf("expected an error for an unknown alias")
+	}
+}
+
+func TestCat(t *testing.T) {
+	ctx := context.Background()
+	objects := testObjects()
+	out, err := captureStdout(func() error { return objects.cat(ctx, []string{"b1/index.html", "/b1/reports/q3.html"}) })
+	if err != nil || out != "indexq3" {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+	out, err = captureStdout(func() error {
+		return objects.cat(ctx, []string{"b1/index.html", "b1/missing.html", "b1/reports/q3.html"})
+	})
+	if !errors.Is(err, store.ErrNotFound) || out != "index" {
+		t.Errorf("expected cat to stop at the missing object, got %q (%v)", out, err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	objects := testObjects()
+	out, err := captureStdout(func() error { return objects.stat(ctx, "b1/index.html", false) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"Bucket:", "bucket1", "Size:", "5", "Updated:", "2020-05-01T12:00:00Z", "x-goog-meta-owner:", "ops"} {
+		if !strings.Contains(out, field) {
+			t.Errorf("expected %q in %q", field, out)
+		}
+	}
+
+	out, err = captureStdout(func() error { return objects.stat(ctx, "b1/index.html", true) })
+	var stat objectStat
+	if err == nil {
+		err = json.Unmarshal([]byte(out), &stat)
+	}
+	if err != nil || stat.Key != "index.html" || stat.ContentType != "text/html" || stat.Metadata["owner"] != "ops" {
+		t.Errorf("unexpected JSON %q (%v)", out, err)
+	}
+	if _, err := captureStdout(func() error { return objects.stat(ctx, "b1/missing.html", false) }); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCp(t *testing.T) {
+	ctx := context.Background()
+	objects := testObjects()
+	dest, err := ioutil.TempDir("", "cp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	//to a file, to a directory and to the standard output
+	if _, err := captureStdout(func() error { return objects.cp(ctx, "b1/index.html", filepath.Join(dest, "copy.html"), false) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := captureStdout(func() error { return objects.cp(ctx, "b1/reports/q3.html", dest, false) }); err != nil {
+		t.Fatal(err)
+	}
+	for rel, body := range map[string]string{"copy.html": "index", "q3.html": "q3"} {
+		if content, err := ioutil.ReadFile(filepath.Join(dest, rel)); err != nil || string(content) != body {
+			t.Errorf("%s: unexpected content %q (%v)", rel, content, err)
+		}
+	}
+	if out, err := captureStdout(func() error { return objects.cp(ctx, "b1/index.html", "-", false) }); err != nil || out != "index" {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+
+	//a missing object leaves no partial file behind
+	missing := filepath.Join(dest, "missing.html")
+	if _, err := captureStdout(func() error { return objects.cp(ctx, "b1/missing.html", missing, false) }); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("a partial download was left behind")
+	}
+
+	tree := filepath.Join(dest, "tree")
+	out, err := captureStdout(func() error { return objects.cp(ctx, "b1/reports/", tree, true) })
+	if err != nil || strings.Count(out, "\n") != 2 {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(tree, "2020", "q4.html")); err != nil || string(content) != "q4" {
+		t.Errorf("unexpected content %q (%v)", content, err)
+	}
+	if _, err := captureStdout(func() error { return objects.cp(ctx, "b1/reports/", "-", true) }); err != errRecursiveToStdout {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	escaping := newObjects(map[string]memObject{
+		"prefix/../../escaped": {body: "escaped"},
+		"prefix/kept":          {body: "kept"},
+	})
+	traversal := filepath.Join(dest, "traversal", "dest")
+	if _, err := captureStdout(func() error { return escaping.cp(ctx, "b1/prefix/", traversal, true) }); err == nil {
+		t.Errorf("expected the escaping object to be reported")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("object written outside of the destination")
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(traversal, "kept")); err != nil || string(content) != "kept" {
+		t.Errorf("unexpected content %q (%v)", content, err)
+	}
+}
+
+func TestCpUsage(t *testing.T) {
+	config := writeConfig(t, testConfig)
+	runCommandTests(t, []commandTest{
+		{"recursive to stdout", []string{"cp", "-config", config, "-r", "b1/reports/", "-"}, exitUsage, "", errRecursiveToStdout.Error()},
+		{"missing destination", []string{"cp", "-config", config, "b1/index.html"}, exitUsage, "", "usage: gcs-proxy cp"},
+	})
+}
+
+func TestObjectsResolveLikeTheProxy(t *testing.T) {
+	ctx := context.Background()
+	objects := testObjects(
+		server.WithHostRoutes([]config.HostRoute{{Host: "reports.example.com", Bucket: "bucket1", Prefix: "reports/",
+			IndexDocument: "q3.html"}}),
+		server.WithRewrites(config.Rewrites{Rules: []config.RewriteRule{
+			{Path: "/b1/latest.html", Target: "/b1/reports/q3.html"},
+			{Path: "/b1/old/**", Target: "/b1/reports/$1", Status: http.StatusMovedPermanently},
+		}}),
+	)
+	for _, tc := range []struct {
+		host, path, body string
+	}{
+		{"", "b1/latest.html", "q3"},
+		{"reports.example.com", "2020/q4.html", "q4"},
+		{"Reports.Example.com:8080", "/", "q3"},
+		{"other.example.com", "b1/index.html", "index"},
+	} {
+		objects.host = tc.host
+		if out, err := captureStdout(func() error { return objects.cat(ctx, []string{tc.path}) }); err != nil || out != tc.body {
+			t.Errorf("%s on %s: unexpected output %q (%v)", tc.path, tc.host, out, err)
+		}
+	}
+
+	objects.host = ""
+	if _, err := captureStdout(func() error { return objects.cat(ctx, []string{"b1/old/q3.html"}) }); err == nil ||
+		!strings.Contains(err.Error(), "redirected to /b1/reports/q3.html") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	objects.host = "reports.example.com"
+	out, err := captureStdout(func() error { return objects.ls(ctx, "", false, false) })
+	if err != nil || out != "2020/\narchive/\nq3.html\n" {
+		t.Errorf("unexpected listing %q (%v)", out, err)
+	}
+}
+
+func TestObjectsDecompressGzipEncodedObjects(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("uncompressed content"))
+	zw.Close()
+	objects := newObjects(map[string]memObject{
+		"data.json": {contentType: "application/json", contentEncoding: "gzip", body: compressed.String()},
+		"bad.json":  {contentType: "application/json", contentEncoding: "gzip", body: "not gzip"},
+	})
+	ctx := context.Background()
+	if out, err := captureStdout(func() error { return objects.cat(ctx, []string{"b1/data.json"}) }); err != nil ||
+		out != "uncompressed content" {
+		t.Errorf("unexpected output %q (%v)", out, err)
+	}
+	if _, err := captureStdout(func() error { return objects.cat(ctx, []string{"b1/bad.json"}) }); err == nil {
+		t.Errorf("expected an error for a corrupted object")
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	dest, err := ioutil.TempDir("", "cp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	var out bytes.Buffer
+	if err := testObjects().copyTree(context.Background(), "bucket1", "reports/", dest, &out); err != nil {
+		t.Fatal(err)
+	}
+	for rel, body := range map[string]string{"q3.html": "q3", filepath.Join("2020", "q4.html"): "q4"} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, rel))
+		if err != nil || string(content) != body {
+			t.Errorf("%s: unexpected content %q (%v)", rel, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "archive")); !os.IsNotExist(err) {
+		t.Errorf("directory placeholders shouldn't be downloaded")
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 2 {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestCopyTreeStaysUnderTheDestination(t *testing.T) {
+	parent, err := ioutil.TempDir("", "cp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dest := filepath.Join(parent, "dest")
+
+	objects := &objectSession{store: memStore{"bucket1": {
+		"prefix/../../escaped":  {body: "escaped"},
+		"prefix/../sibling":     {body: "sibling"},
+		"prefix//etc/absolute":  {body: "absolute"},
+		"prefix/nested/../kept": {body: "kept"},
+	}}}
+	err = objects.copyTree(context.Background(), "bucket1", "prefix/", dest+string(filepath.Separator), ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "skipped 3 objects") {
+		t.Errorf("unexpected error %v", err)
+	}
+	for _, path := range []string{filepath.Join(parent, "escaped"), filepath.Join(parent, "sibling")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s written outside of the destination", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "etc")); !os.IsNotExist(err) {
+		t.Errorf("absolute paths should be skipped")
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dest, "kept")); err != nil || string(content) != "kept" {
+		t.Errorf("unexpected content %q (%v)", content, err)
+	}
+}
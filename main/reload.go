@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/metrics"
+	"github.com/afiore/gcs-proxy/server"
+)
+
+//configCheckInterval is how often the configuration file is checked for changes
+const configCheckInterval = 10 * time.Second
+
+//reloader re-reads the configuration file and swaps the handlers built from it. Only the routing table, rewrite
+//rules, access control, OAuth, share link and response settings are reloaded: the listeners, limits, TLS, storage,
+//cache, logging, tracing and audit settings keep the values read on startup
+type reloader struct {
+	path       string
+	overrides  []config.Override
+	handler    *server.Reloadable
+	shareLinks settingsReloader
+	build      func(config.ProgramConfig) http.Handler
+
+	mu      sync.Mutex
+	current config.ProgramConfig
+}
+
+//settingsReloader is implemented by the components applying reloaded settings in place, e.g. server.ShareLinks
+type settingsReloader interface {
+	Reload(config.ProgramConfig)
+}
+
+//config returns the configuration currently in effect
+func (r *reloader) config() config.ProgramConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+//reload installs the configuration read from the file, keeping the current one when it is invalid
+func (r *reloader) reload() {
+	conf, err := config.Load(r.path, r.overrides...)
+	metrics.ObserveConfigReload(err)
+	if err != nil {
+		logging.Errorf("rejected the configuration reloaded from %s, keeping the current one:\n%s", r.path, err)
+		return
+	}
+	if !reflect.DeepEqual(startupSettings(conf), startupSettings(r.config())) {
+		logging.Warnf("the configuration reloaded from %s changes settings that only apply after a restart", r.path)
+	}
+	r.shareLinks.Reload(conf)
+	r.handler.Swap(r.build(conf))
+	r.mu.Lock()
+	r.current = conf
+	r.mu.Unlock()
+	logging.Log(logging.Info, "Reloaded configuration", map[string]interface{}{"config": conf.Redacted()})
+}
+
+//startupSettings clears the settings that are applied on reload, leaving the ones only read on startup
+func startupSettings(c config.ProgramConfig) config.ProgramConfig {
+	c.Gcs.Buckets = nil
+	c.Gcs.Hosts = nil
+	c.Gcs.SignedRedirects = nil
+	c.Web.OAuth = config.ProgramConfig{}.Web.OAuth
+	c.Web.Share = config.ProgramConfig{}.Web.Share
+	c.Web.HeaderRules = nil
+	c.Web.Rewrites = config.Rewrites{}
+	c.Web.Compression = config.Compression{}
+	return c
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/metrics"
+	"github.com/afiore/gcs-proxy/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+//recordingSettings records the configurations it is asked to reload
+type recordingSettings struct {
+	reloaded []config.ProgramConfig
+}
+
+func (s *recordingSettings) Reload(c config.ProgramConfig) {
+	s.reloaded = append(s.reloaded, c)
+}
+
+func testReloader(t *testing.T) (*reloader, *recordingSettings) {
+	path := writeConfig(t, testConfig)
+	conf, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the handlers report the aliases they have been built with
+	build := func(c config.ProgramConfig) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for alias := range c.Gcs.Buckets {
+				fmt.Fprintln(w, alias)
+			}
+		})
+	}
+	settings := &recordingSettings{}
+	return &reloader{path: path, current: conf, handler: server.NewReloadable(build(conf)), shareLinks: settings,
+		build: build}, settings
+}
+
+func servedAliases(r *reloader) string {
+	w := httptest.NewRecorder()
+	r.handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	return strings.TrimSpace(w.Body.String())
+}
+
+func TestReloadKeepsTheCurrentConfigOnErrors(t *testing.T) {
+	r, settings := testReloader(t)
+	content, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, broken := range map[string]func() error{
+		"malformed": func() error { return ioutil.WriteFile(r.path, []byte("[Gcs\nb1 = "), 0600) },
+		"invalid": func() error {
+			invalid := strings.Replace(string(content), `ClientSecret = "client-secret"`, `ClientSecret = ""`, 1)
+			return ioutil.WriteFile(r.path, []byte(invalid), 0600)
+		},
+		"unreadable": func() error { return os.Remove(r.path) },
+	} {
+		if err := broken(); err != nil {
+			t.Fatal(err)
+		}
+		failures := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues("failure"))
+		r.reload()
+		if aliases := servedAliases(r); aliases != "b1" {
+			t.Errorf("%s: expected the current handler to be kept, got aliases %q", name, aliases)
+		}
+		if _, ok := r.config().Gcs.Buckets["b1"]; !ok || r.config().Web.OAuth.ClientSecret != "client-secret" {
+			t.Errorf("%s: expected the current config to be kept, got %+v", name, r.config())
+		}
+		if len(settings.reloaded) != 0 {
+			t.Errorf("%s: expected the share settings to be kept", name)
+		}
+		if testutil.ToFloat64(metrics.ConfigLastReloadSuccessful) != 0 ||
+			testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues("failure")) != failures+1 {
+			t.Errorf("%s: expected the reload failure to be recorded", name)
+		}
+	}
+
+	//a valid file is applied once fixed
+	fixed := strings.Replace(string(content), `b1 = "bucket1"`, `b2 = "bucket2"`, 1)
+	if err := ioutil.WriteFile(r.path, []byte(fixed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r.reload()
+	if aliases := servedAliases(r); aliases != "b2" {
+		t.Errorf("expected the reloaded handler to be served, got aliases %q", aliases)
+	}
+	if len(settings.reloaded) != 1 || settings.reloaded[0].Gcs.Buckets["b2"] != "bucket2" {
+		t.Errorf("expected the share settings to be reloaded, got %+v", settings.reloaded)
+	}
+	if testutil.ToFloat64(metrics.ConfigLastReloadSuccessful) != 1 {
+		t.Errorf("expected the reload to be recorded as successful")
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+//minSecretBytes matches the minimum length of the session and share link secrets
+const minSecretBytes = 32
+
+//runGenSecret implements the gen-secret subcommand, returning the process exit code
+func runGenSecret(progName string, args []string) int {
+	flags := newFlagSet(progName, "gen-secret", "[flags]",
+		"Prints a random, URL safe base64 encoded secret, suitable for Web.OAuth.SessionSecret or Web.Share.Secret.")
+	n := flags.Int("bytes", minSecretBytes, "number of random bytes to encode")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if flags.NArg() > 0 || *n < minSecretBytes {
+		fmt.Fprintf(stderr, "expected at least %d bytes and no arguments\n", minSecretBytes)
+		flags.Usage()
+		return exitUsage
+	}
+	secret := make([]byte, *n)
+	if _, err := rand.Read(secret); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	fmt.Fprintln(stdout, base64.RawURLEncoding.EncodeToString(secret))
+	return exitOK
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/server"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+//shutdownSignals relays the termination signals asking the proxy to shut down. The first starts the graceful
+//shutdown, a second one interrupts it
+func shutdownSignals() (<-chan os.Signal, func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	return signals, func() { signal.Stop(signals) }
+}
+
+//shutdown gracefully stops the servers. Readiness is reported as false for the drain period, letting load balancers
+//stop routing new requests, before the servers stop accepting connections and wait for the active transfers to
+//complete, up to the shutdown timeout. The servers are shut down concurrently, so that each gets the whole timeout
+//rather than what a slower one left. A further signal interrupts the active transfers straight away
+func shutdown(conf config.ProgramConfig, health *server.Health, servers []*http.Server, signals <-chan os.Signal) {
+	health.ShuttingDown()
+	timeout := conf.Web.ShutdownTimeout.Duration
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			logging.Warnf("received %s, interrupting active transfers", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if drain := conf.Web.DrainPeriod.Duration; drain > 0 {
+		logging.Infof("reporting the server as not ready for %s before closing listeners", drain)
+		select {
+		case <-time.After(drain):
+		case <-ctx.Done():
+		}
+	}
+
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	defer cancelTimeout()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logging.Warnf("closing the connections still active on %s: %v", srv.Addr, err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+	logging.Infof("server stopped")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/server"
+)
+
+//slowServer serves /slow requests once released, answering the other paths straight away
+type slowServer struct {
+	srv     *http.Server
+	url     string
+	started chan struct{}
+	release chan struct{}
+}
+
+func startSlowServer(t *testing.T) *slowServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &slowServer{url: "http://" + ln.Addr().String(), started: make(chan struct{}, 1), release: make(chan struct{})}
+	s.srv = &http.Server{Addr: ln.Addr().String(), Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			s.started <- struct{}{}
+			select {
+			case <-s.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte("done"))
+	})}
+	go s.srv.Serve(ln)
+	t.Cleanup(func() { s.srv.Close() })
+	return s
+}
+
+//get requests the path on a new connection, returning the response body
+func (s *slowServer) get(path string) (string, error) {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	resp, err := client.Get(s.url + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+//inFlight starts a /slow request, waiting for the server to receive it
+func (s *slowServer) inFlight(t *testing.T) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		body, err := s.get("/slow")
+		if err == nil && body != "done" {
+			err = fmt.Errorf("unexpected body %q", body)
+		}
+		result <- err
+	}()
+	select {
+	case <-s.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the in-flight request didn't reach the server")
+	}
+	return result
+}
+
+func noConfig() config.ProgramConfig { return config.ProgramConfig{} }
+
+func shutdownConfig(drain, timeout time.Duration) config.ProgramConfig {
+	var conf config.ProgramConfig
+	conf.Web.DrainPeriod = config.Duration{Duration: drain}
+	conf.Web.ShutdownTimeout = config.Duration{Duration: timeout}
+	return conf
+}
+
+//startShutdown shuts the server down in the background, closing the returned channel once done
+func startShutdown(conf config.ProgramConfig, health *server.Health, s *slowServer, signals <-chan os.Signal) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		shutdown(conf, health, []*http.Server{s.srv}, signals)
+		close(done)
+	}()
+	return done
+}
+
+func shuttingDown(health *server.Health) bool {
+	w := httptest.NewRecorder()
+	health.Readyz(w, httptest.NewRequest("GET", server.ReadyzPath, nil))
+	var resp struct{ Checks map[string]string }
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code == http.StatusServiceUnavailable && resp.Checks["shutdown"] == "shutting down"
+}
+
+func TestShutdownDrainsBeforeClosingListeners(t *testing.T) {
+	s := startSlowServer(t)
+	health := server.NewHealth(noConfig, nil)
+	request := s.inFlight(t)
+	done := startShutdown(shutdownConfig(time.Second, 10*time.Second), health, s, make(chan os.Signal))
+
+	//new requests keep being served during the drain period, while readiness fails
+	time.Sleep(50 * time.Millisecond)
+	if !shuttingDown(health) {
+		t.Errorf("expected readiness to fail while draining")
+	}
+	if body, err := s.get("/fast"); err != nil || body != "done" {
+		t.Errorf("expected new requests to be served while draining, got %q (%v)", body, err)
+	}
+
+	//then the listener is closed, while the in-flight request is allowed to complete
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.get("/fast"); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new requests are still served after the drain period")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the in-flight request completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(s.release)
+	if err := <-request; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return once the in-flight request completed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := startSlowServer(t)
+	request := s.inFlight(t)
+	start := time.Now()
+	done := startShutdown(shutdownConfig(0, 200*time.Millisecond), server.NewHealth(noConfig, nil), s, make(chan os.Signal))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return after its timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("shutdown returned after %s, before its timeout", elapsed)
+	}
+	if err := <-request; err == nil {
+		t.Errorf("expected the connection of the in-flight request to be closed")
+	}
+	if _, err := s.get("/fast"); err == nil {
+		t.Errorf("expected new requests to be refused")
+	}
+}
+
+func TestShutdownInterruptedBySecondSignal(t *testing.T) {
+	s := startSlowServer(t)
+	request := s.inFlight(t)
+	signals := make(chan os.Signal, 1)
+	done := startShutdown(shutdownConfig(time.Minute, time.Minute), server.NewHealth(noConfig, nil), s, signals)
+
+	//the signal cuts both the drain period and the wait for the in-flight transfers short
+	signals <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown wasn't interrupted by the second signal")
+	}
+	if err := <-request; err == nil {
+		t.Errorf("expected the in-flight request to be interrupted")
+	}
+	if _, err := s.get("/fast"); err == nil {
+		t.Errorf("expected new requests to be refused")
+	}
+}
+
+func TestShutdownStopsServersConcurrently(t *testing.T) {
+	proxy, metrics := startSlowServer(t), startSlowServer(t)
+	request := proxy.inFlight(t)
+	done := make(chan struct{})
+	go func() {
+		shutdown(shutdownConfig(0, 10*time.Second), server.NewHealth(noConfig, nil), []*http.Server{proxy.srv, metrics.srv}, make(chan os.Signal))
+		close(done)
+	}()
+
+	//the transfer still active on the main listener doesn't hold the shutdown of the others back
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := metrics.get("/fast"); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the metrics server is still serving while the main listener drains")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown returned before the in-flight request completed")
+	default:
+	}
+	close(proxy.release)
+	if err := <-request; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return once the in-flight request completed")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/afiore/gcs-proxy/cache"
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/metrics"
+	"github.com/afiore/gcs-proxy/resilience"
+	"github.com/afiore/gcs-proxy/store"
+	"github.com/afiore/gcs-proxy/tracing"
+)
+
+//storeLayers references the decorators inspected by the admin API, nil when disabled in the configuration
+type storeLayers struct {
+	cache      *cache.Store
+	resilience *resilience.Store
+}
+
+//decorateStore wraps the backend with the metrics, resilience, cache and tracing layers enabled in the configuration
+func decorateStore(conf config.ProgramConfig, backend store.ObjectStoreOps) (store.ObjectStoreOps, storeLayers, error) {
+	var layers storeLayers
+	objStore := backend
+	if conf.Web.Metrics.Enabled {
+		objStore = metrics.InstrumentStore(objStore)
+	}
+	if conf.Gcs.Resilience.Enabled {
+		layers.resilience = resilience.New(objStore, conf)
+		objStore = layers.resilience
+	}
+	if conf.Cache.Enabled {
+		cached, err := cache.New(objStore, conf)
+		if err != nil {
+			return nil, layers, fmt.Errorf("Couldn't initialise cache: %s", err)
+		}
+		layers.cache = cached
+		objStore = cached
+	}
+	return tracing.InstrumentStore(objStore), layers, nil
+}
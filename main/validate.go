@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+//runValidate implements the validate subcommand, returning the process exit code
+func runValidate(progName string, args []string) int {
+	var cf configFlags
+	flags := newFlagSet(progName, "validate", "[flags] [</path/to/config.toml>]",
+		"Checks the configuration, along with the environment and flag overrides, reporting every problem found.")
+	cf.register(flags)
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	path, overrides, err := cf.resolve(flags.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		flags.Usage()
+		return exitUsage
+	}
+	if _, err := config.Load(path, overrides...); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailure
+	}
+	fmt.Fprintf(stdout, "%s: configuration is valid\n", path)
+	return exitOK
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/afiore/gcs-proxy/version"
+)
+
+//runVersion implements the version subcommand, returning the process exit code
+func runVersion(progName string, args []string) int {
+	flags := newFlagSet(progName, "version", "[flags]", "Prints the build information.")
+	asJSON := flags.Bool("json", false, "print the build information as JSON")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	info := version.Info()
+	if *asJSON {
+		if err := json.NewEncoder(stdout).Encode(info); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailure
+		}
+		return exitOK
+	}
+	fmt.Fprintf(stdout, "gcs-proxy %s", info.Version)
+	if info.Commit != "" {
+		fmt.Fprintf(stdout, " (commit %s)", info.Commit)
+	}
+	if info.Date != "" {
+		fmt.Fprintf(stdout, " built %s", info.Date)
+	}
+	fmt.Fprintf(stdout, " with %s\n", info.GoVersion)
+	return exitOK
+}
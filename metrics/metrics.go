@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gcs_proxy"
+
+//Registry holds the proxy metrics exposed on the metrics listener
+var Registry = prometheus.NewRegistry()
+
+var (
+	//Requests counts the requests served by bucket alias and status class
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests served, by bucket alias and status class.",
+	}, []string{"alias", "status_class"})
+
+	//RequestDuration tracks the time taken to serve requests, by bucket alias and status class
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve requests, by bucket alias and status class.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 9),
+	}, []string{"alias", "status_class"})
+
+	//ResponseBytes counts the bytes written in response bodies, by bucket alias
+	ResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_response_bytes_total",
+		Help:      "Bytes written in response bodies, by bucket alias.",
+	}, []string{"alias"})
+
+	//AuthOutcomes counts session validations and logins by outcome
+	AuthOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_outcomes_total",
+		Help:      "Session validations and OAuth logins, by outcome.",
+	}, []string{"outcome"})
+
+	//UpstreamDuration tracks the latency of object store operations
+	UpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of object store operations, by operation and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 9),
+	}, []string{"operation", "outcome"})
+
+	//CacheLookups counts object cache lookups by bucket and result
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Object cache lookups, by bucket and result (hit, disk_hit or miss).",
+	}, []string{"bucket", "result"})
+
+	//ConfigReloads counts configuration reload attempts by result
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Configuration reload attempts, by result (success or failure).",
+	}, []string{"result"})
+
+	//ConfigLastReloadSuccessful reports whether the last configuration reload was applied
+	ConfigLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload was applied (1) or rejected (0).",
+	})
+
+	//ConfigLastReloadSuccessTimestamp records when the configuration was last loaded successfully
+	ConfigLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Unix time of the last successful configuration load.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		Requests,
+		RequestDuration,
+		ResponseBytes,
+		AuthOutcomes,
+		UpstreamDuration,
+		CacheLookups,
+		ConfigReloads,
+		ConfigLastReloadSuccessful,
+		ConfigLastReloadSuccessTimestamp,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+//Handler exposes the registered metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+//StatusClass maps an HTTP status code to its class (e.g. 2xx)
+func StatusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+//ObserveRequest records the outcome of a request served for the supplied bucket alias
+func ObserveRequest(alias string, status int, written int64, elapsed time.Duration) {
+	if alias == "" {
+		alias = "none"
+	}
+	class := StatusClass(status)
+	Requests.WithLabelValues(alias, class).Inc()
+	RequestDuration.WithLabelValues(alias, class).Observe(elapsed.Seconds())
+	ResponseBytes.WithLabelValues(alias).Add(float64(written))
+}
+
+//ConfigLoaded records that the configuration was loaded successfully on startup
+func ConfigLoaded() {
+	ConfigLastReloadSuccessful.Set(1)
+	ConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+}
+
+//ObserveConfigReload records the outcome of a configuration reload
+func ObserveConfigReload(err error) {
+	if err != nil {
+		ConfigReloads.WithLabelValues("failure").Inc()
+		ConfigLastReloadSuccessful.Set(0)
+		return
+	}
+	ConfigReloads.WithLabelValues("success").Inc()
+	ConfigLoaded()
+}
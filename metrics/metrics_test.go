@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/store"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type missingObjectStore struct{}
+
+func (s missingObjectStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	return nil, &store.ObjectNotFound{Bucket: bucket, Key: key}
+}
+func (s missingObjectStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	return 0, &store.ObjectNotFound{Bucket: bucket, Key: key}
+}
+
+func TestStatusClass(t *testing.T) {
+	for status, expected := range map[int]string{200: "2xx", 302: "3xx", 404: "4xx", 503: "5xx"} {
+		if class := StatusClass(status); class != expected {
+			t.Errorf("Unexpected class %s for %d", class, status)
+		}
+	}
+}
+
+func TestObserveRequest(t *testing.T) {
+	ObserveRequest("reports", 200, 128, time.Millisecond)
+	ObserveRequest("reports", 404, 10, time.Millisecond)
+
+	if v := testutil.ToFloat64(Requests.WithLabelValues("reports", "2xx")); v != 1 {
+		t.Errorf("Unexpected request count %v", v)
+	}
+	if v := testutil.ToFloat64(ResponseBytes.WithLabelValues("reports")); v != 138 {
+		t.Errorf("Unexpected response bytes %v", v)
+	}
+}
+
+func TestInstrumentStore(t *testing.T) {
+	s := InstrumentStore(missingObjectStore{})
+	s.GetObjectMetadata(context.Background(), "bucket", "key")
+
+	if n := testutil.CollectAndCount(UpstreamDuration); n != 1 {
+		t.Errorf("Unexpected number of upstream series %d", n)
+	}
+	if _, err := s.(store.URLSigner).SignedURL(http.MethodGet, "bucket", "key", time.Now()); err != store.ErrNotSupported {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestHandlerExposesMetrics(t *testing.T) {
+	AuthOutcomes.WithLabelValues("login").Inc()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.Contains(w.Body.String(), `gcs_proxy_auth_outcomes_total{outcome="login"} 1`) {
+		t.Errorf("Expected auth outcomes in %s", w.Body.String())
+	}
+}
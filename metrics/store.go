@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/afiore/gcs-proxy/store"
+)
+
+type instrumentedStore struct {
+	upstream store.ObjectStoreOps
+}
+
+//InstrumentStore decorates the supplied store, tracking the latency and outcome of its operations
+func InstrumentStore(upstream store.ObjectStoreOps) store.ObjectStoreOps {
+	return &instrumentedStore{upstream: upstream}
+}
+
+func outcome(err error) string {
+	var notFound *store.ObjectNotFound
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &notFound):
+		return "not_found"
+	default:
+		return "error"
+	}
+}
+
+func observe(operation string, start time.Time, err error) {
+	UpstreamDuration.WithLabelValues(operation, outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+func (s *instrumentedStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	start := time.Now()
+	meta, err := s.upstream.GetObjectMetadata(ctx, bucket, key)
+	observe("get_metadata", start, err)
+	return meta, err
+}
+
+func (s *instrumentedStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	start := time.Now()
+	n, err := s.upstream.CopyObject(ctx, bucket, key, w)
+	observe("copy_object", start, err)
+	return n, err
+}
+
+func (s *instrumentedStore) SignedURL(method, bucket, key string, expires time.Time) (string, error) {
+	signer, ok := s.upstream.(store.URLSigner)
+	if !ok {
+		return "", store.ErrNotSupported
+	}
+	start := time.Now()
+	u, err := signer.SignedURL(method, bucket, key, expires)
+	observe("sign_url", start, err)
+	return u, err
+}
+
+func (s *instrumentedStore) ListObjects(ctx context.Context, bucket, prefix, delimiter string, fn func(store.ListEntry) error) error {
+	lister, ok := s.upstream.(store.Lister)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	start := time.Now()
+	err := lister.ListObjects(ctx, bucket, prefix, delimiter, fn)
+	observe("list_objects", start, err)
+	return err
+}
@@ -0,0 +1,142 @@
+package resilience
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/afiore/gcs-proxy/store"
+)
+
+//errCircuitOpen is returned without calling the upstream store while the breaker is open
+var errCircuitOpen = errors.New("circuit breaker open")
+
+//State of a circuit breaker
+type State int
+
+const (
+	//Closed lets every call through
+	Closed State = iota
+	//Open fails every call fast, until the cooldown elapses
+	Open
+	//HalfOpen lets a single probe through, deciding whether to close or reopen the breaker
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+//MarshalText encodes the state by name
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+//BreakerStatus describes the circuit breaker of a Store
+type BreakerStatus struct {
+	State State `json:"state"`
+	//Failures counts the consecutive failures recorded since the breaker last closed
+	Failures  int `json:"failures"`
+	Threshold int `json:"threshold"`
+	//OpenedAt is the time the breaker last opened, zero if it never did
+	OpenedAt time.Time     `json:"opened_at"`
+	Cooldown time.Duration `json:"cooldown_ns"`
+}
+
+//OpenError reports a call rejected by an open circuit breaker. It matches store.ErrUnavailable
+type OpenError struct {
+	Op         string
+	Bucket     string
+	Key        string
+	retryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("%s %s/%s: %s", e.Op, e.Bucket, e.Key, errCircuitOpen.Error())
+}
+
+//Is makes the error match store.ErrUnavailable
+func (e *OpenError) Is(target error) bool { return target == store.ErrUnavailable }
+
+//RetryAfter returns the time left before the breaker lets a probe through
+func (e *OpenError) RetryAfter() time.Duration { return e.retryAfter }
+
+//breaker opens after a number of consecutive failures, failing calls fast for the cooldown period
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+//allow reports whether a call can proceed or, if not, how long the caller should wait before retrying
+func (b *breaker) allow() (bool, time.Duration) {
+	if b.threshold <= 0 {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		elapsed := b.now().Sub(b.openedAt)
+		if elapsed < b.cooldown {
+			return false, b.cooldown - elapsed
+		}
+		b.state = HalfOpen
+		b.probing = true
+		return true, 0
+	case HalfOpen:
+		if b.probing {
+			return false, b.cooldown
+		}
+		b.probing = true
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+//record updates the breaker with the outcome of a call it allowed
+func (b *breaker) record(failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.state = Closed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == HalfOpen || b.failures >= b.threshold {
+		b.state = Open
+		b.openedAt = b.now()
+	}
+}
+
+func (b *breaker) current() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStatus{State: b.state, Failures: b.failures, Threshold: b.threshold, OpenedAt: b.openedAt, Cooldown: b.cooldown}
+}
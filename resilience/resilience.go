@@ -0,0 +1,187 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+const defaultMetadataTimeout = 10 * time.Second
+const defaultMaxRetries = 2
+const defaultRetryBaseDelay = 100 * time.Millisecond
+const defaultBreakerFailures = 5
+const defaultBreakerCooldown = 30 * time.Second
+
+//Store decorates a store.ObjectStoreOps, bounding its operations with timeouts, retrying idempotent reads failed
+//by transient errors and failing fast through a circuit breaker while the upstream store is unhealthy
+type Store struct {
+	upstream        store.ObjectStoreOps
+	metadataTimeout time.Duration
+	copyTimeout     time.Duration
+	maxRetries      int
+	retryBaseDelay  time.Duration
+	breaker         *breaker
+	sleep           func(ctx context.Context, d time.Duration) error
+}
+
+//New wraps upstream in the resilience policy defined in the supplied configuration
+func New(upstream store.ObjectStoreOps, c config.ProgramConfig) *Store {
+	r := c.Gcs.Resilience
+	metadataTimeout := r.MetadataTimeout.Duration
+	if metadataTimeout <= 0 {
+		metadataTimeout = defaultMetadataTimeout
+	}
+	maxRetries := r.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	retryBaseDelay := r.RetryBaseDelay.Duration
+	if retryBaseDelay <= 0 {
+		retryBaseDelay = defaultRetryBaseDelay
+	}
+	breakerFailures := r.BreakerFailures
+	if breakerFailures == 0 {
+		breakerFailures = defaultBreakerFailures
+	}
+	breakerCooldown := r.BreakerCooldown.Duration
+	if breakerCooldown <= 0 {
+		breakerCooldown = defaultBreakerCooldown
+	}
+	return &Store{
+		upstream:        upstream,
+		metadataTimeout: metadataTimeout,
+		copyTimeout:     r.CopyTimeout.Duration,
+		maxRetries:      maxRetries,
+		retryBaseDelay:  retryBaseDelay,
+		breaker:         &breaker{threshold: breakerFailures, cooldown: breakerCooldown, now: time.Now},
+		sleep:           sleepContext,
+	}
+}
+
+//BreakerState returns the current state of the circuit breaker
+func (s *Store) BreakerState() State {
+	return s.breaker.current()
+}
+
+//BreakerStatus returns the state of the circuit breaker along with its failure counters
+func (s *Store) BreakerStatus() BreakerStatus {
+	return s.breaker.status()
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//transient reports whether the error denotes an unhealthy upstream store, as opposed to a failure of the request
+func transient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		//the caller canceled the request or its deadline passed
+		return false
+	}
+	return errors.Is(err, store.ErrUnavailable) || errors.Is(err, context.DeadlineExceeded)
+}
+
+//backoff returns the full-jitter delay before the supplied retry attempt
+func (s *Store) backoff(attempt int) time.Duration {
+	max := s.retryBaseDelay << uint(attempt)
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
+
+//call runs op through the circuit breaker, retrying transient failures while retryable returns true
+func (s *Store) call(ctx context.Context, name, bucket, key string, timeout time.Duration, retryable func() bool, op func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		ok, retryAfter := s.breaker.allow()
+		if !ok {
+			return &OpenError{Op: name, Bucket: bucket, Key: key, retryAfter: retryAfter}
+		}
+		opCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			opCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err = op(opCtx)
+		cancel()
+		failed := err != nil && transient(ctx, err)
+		s.breaker.record(failed)
+		if !failed || attempt >= s.maxRetries || !retryable() {
+			return err
+		}
+		delay := s.backoff(attempt)
+		logging.Debugf("retrying %s for %s/%s in %s: %v", name, bucket, key, delay, err)
+		if sleepErr := s.sleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+//GetObjectMetadata fetches the object metadata from the upstream store, retrying transient failures
+func (s *Store) GetObjectMetadata(ctx context.Context, bucket, key string) (meta store.ObjectMetadata, err error) {
+	always := func() bool { return true }
+	err = s.call(ctx, "GetObjectMetadata", bucket, key, s.metadataTimeout, always, func(ctx context.Context) error {
+		meta, err = s.upstream.GetObjectMetadata(ctx, bucket, key)
+		return err
+	})
+	return meta, err
+}
+
+//countingWriter tracks whether any byte has been written, as copies can only be retried until then
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+//CopyObject copies the object from the upstream store, retrying transient failures until the first byte is written
+func (s *Store) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	untouched := func() bool { return cw.written == 0 }
+	err := s.call(ctx, "CopyObject", bucket, key, s.copyTimeout, untouched, func(ctx context.Context) error {
+		_, err := s.upstream.CopyObject(ctx, bucket, key, cw)
+		return err
+	})
+	return cw.written, err
+}
+
+//SignedURL delegates to the upstream store, when this is able to sign URLs
+func (s *Store) SignedURL(method, bucket, key string, expires time.Time) (string, error) {
+	signer, ok := s.upstream.(store.URLSigner)
+	if !ok {
+		return "", store.ErrNotSupported
+	}
+	return signer.SignedURL(method, bucket, key, expires)
+}
+
+//ListObjects lists the objects through the upstream store, when this is able to list objects, retrying transient
+//failures until the first entry is reported
+func (s *Store) ListObjects(ctx context.Context, bucket, prefix, delimiter string, fn func(store.ListEntry) error) error {
+	lister, ok := s.upstream.(store.Lister)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	reported := false
+	untouched := func() bool { return !reported }
+	return s.call(ctx, "ListObjects", bucket, prefix, s.copyTimeout, untouched, func(ctx context.Context) error {
+		return lister.ListObjects(ctx, bucket, prefix, delimiter, func(e store.ListEntry) error {
+			reported = true
+			return fn(e)
+		})
+	})
+}
@@ -0,0 +1,178 @@
+package resilience
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+type testObject struct{}
+
+func (o testObject) ContentType() string         { return "text/plain" }
+func (o testObject) Size() int64                 { return 7 }
+func (o testObject) Updated() time.Time          { return time.Time{} }
+func (o testObject) Generation() int64           { return 1 }
+func (o testObject) CacheControl() string        { return "" }
+func (o testObject) ContentEncoding() string     { return "" }
+func (o testObject) ContentLanguage() string     { return "" }
+func (o testObject) ContentDisposition() string  { return "" }
+func (o testObject) Metadata() map[string]string { return nil }
+
+//flakyStore fails its first `failures` calls with a transient error, optionally after writing partial content
+type flakyStore struct {
+	failures int
+	partial  string
+	calls    int
+}
+
+func (s *flakyStore) fail() error {
+	s.calls++
+	if s.calls <= s.failures {
+		return &store.Error{Op: "test", Bucket: "bucket", Key: "key", Kind: store.ErrUnavailable, Err: errors.New("503")}
+	}
+	return nil
+}
+
+func (s *flakyStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return testObject{}, nil
+}
+
+func (s *flakyStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	if err := s.fail(); err != nil {
+		n, _ := io.WriteString(w, s.partial)
+		return int64(n), err
+	}
+	n, err := io.WriteString(w, "content")
+	return int64(n), err
+}
+
+func (s *flakyStore) ListObjects(ctx context.Context, bucket, prefix, delimiter string, fn func(store.ListEntry) error) error {
+	if err := s.fail(); err != nil {
+		if s.partial != "" {
+			fn(store.ListEntry{Key: s.partial})
+		}
+		return err
+	}
+	return fn(store.ListEntry{Key: "key", Metadata: testObject{}})
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func testStore(upstream store.ObjectStoreOps, failures int) (*Store, *fakeClock) {
+	var c config.ProgramConfig
+	c.Gcs.Resilience.BreakerFailures = failures
+	c.Gcs.Resilience.BreakerCooldown = config.Duration{Duration: time.Minute}
+	s := New(upstream, c)
+	clock := &fakeClock{t: time.Now()}
+	s.breaker.now = clock.now
+	s.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+	return s, clock
+}
+
+func TestRetriesTransientFailures(t *testing.T) {
+	upstream := &flakyStore{failures: 2}
+	s, _ := testStore(upstream, 10)
+	if _, err := s.GetObjectMetadata(context.Background(), "bucket", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.calls != 3 {
+		t.Errorf("Unexpected number of upstream calls %d", upstream.calls)
+	}
+
+	upstream = &flakyStore{failures: 3}
+	s, _ = testStore(upstream, 10)
+	if _, err := s.GetObjectMetadata(context.Background(), "bucket", "key"); !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("Expected the last error to be returned, got %v", err)
+	}
+}
+
+func TestCopyIsNotRetriedOnceWritten(t *testing.T) {
+	upstream := &flakyStore{failures: 1}
+	s, _ := testStore(upstream, 10)
+	var buf bytes.Buffer
+	if _, err := s.CopyObject(context.Background(), "bucket", "key", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "content" {
+		t.Errorf("Unexpected content %s", buf.String())
+	}
+
+	upstream = &flakyStore{failures: 1, partial: "cont"}
+	s, _ = testStore(upstream, 10)
+	buf.Reset()
+	n, err := s.CopyObject(context.Background(), "bucket", "key", &buf)
+	if err == nil || upstream.calls != 1 || n != 4 {
+		t.Errorf("Expected the partial copy to fail without retries, got %d bytes after %d calls: %v", n, upstream.calls, err)
+	}
+}
+
+func TestBreakerFailsFastWhenOpen(t *testing.T) {
+	upstream := &flakyStore{failures: 6}
+	s, clock := testStore(upstream, 3)
+	ctx := context.Background()
+
+	//three attempts open the breaker, failing the following call without reaching the store
+	s.GetObjectMetadata(ctx, "bucket", "key")
+	if s.BreakerState() != Open {
+		t.Fatalf("Unexpected breaker state %s", s.BreakerState())
+	}
+	_, err := s.GetObjectMetadata(ctx, "bucket", "key")
+	var openErr *OpenError
+	if !errors.As(err, &openErr) || !errors.Is(err, store.ErrUnavailable) {
+		t.Fatalf("Expected the breaker to reject the call, got %v", err)
+	}
+	if openErr.RetryAfter() != time.Minute || upstream.calls != 3 {
+		t.Errorf("Unexpected retry after %s with %d upstream calls", openErr.RetryAfter(), upstream.calls)
+	}
+
+	//a failed probe reopens the breaker, a successful one closes it
+	clock.t = clock.t.Add(time.Minute)
+	s.GetObjectMetadata(ctx, "bucket", "key")
+	if s.BreakerState() != Open || upstream.calls != 4 {
+		t.Errorf("Unexpected breaker state %s after %d calls", s.BreakerState(), upstream.calls)
+	}
+	upstream.failures = 0
+	clock.t = clock.t.Add(time.Minute)
+	if _, err := s.GetObjectMetadata(ctx, "bucket", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if s.BreakerState() != Closed {
+		t.Errorf("Unexpected breaker state %s", s.BreakerState())
+	}
+}
+
+func TestListIsNotRetriedOnceReported(t *testing.T) {
+	var keys []string
+	collect := func(e store.ListEntry) error {
+		keys = append(keys, e.Key)
+		return nil
+	}
+	upstream := &flakyStore{failures: 1}
+	s, _ := testStore(upstream, 10)
+	if err := s.ListObjects(context.Background(), "bucket", "", "/", collect); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || upstream.calls != 2 {
+		t.Errorf("Unexpected keys %v after %d calls", keys, upstream.calls)
+	}
+
+	keys = nil
+	upstream = &flakyStore{failures: 1, partial: "dir/"}
+	s, _ = testStore(upstream, 10)
+	if err := s.ListObjects(context.Background(), "bucket", "", "/", collect); err == nil || upstream.calls != 1 {
+		t.Errorf("Expected the partial listing to fail without retries, got %v after %d calls: %v", keys, upstream.calls, err)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/afiore/gcs-proxy/logging"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//AccessLogged assigns an ID to each request, reusing the one supplied by the client through the X-Request-Id header
+//when valid, and emits a structured access log record once the request has been served. The record carries the client
+//IP resolved by ExternalURL, which accounts for trusted proxies, along with the address of the connection's peer
+func AccessLogged(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		entry := &logging.AccessEntry{
+			Time:       start,
+			RequestID:  id,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: external(r).clientIP,
+			PeerAddr:   r.RemoteAddr,
+		}
+		rec := newResponseRecorder(w)
+		//deferred so that aborted requests are logged too
+		defer func() {
+			entry.Complete(rec.status, rec.written, time.Since(start))
+			logging.Access(entry)
+		}()
+		next.ServeHTTP(rec, r.WithContext(logging.WithAccessEntry(r.Context(), entry)))
+	})
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/gorilla/securecookie"
+)
+
+func TestAccessLogRecordsRequest(t *testing.T) {
+	var out bytes.Buffer
+	logging.Configure(&out, logging.Warn, true)
+	defer logging.Configure(os.Stderr, logging.Info, false)
+
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"existing/key": dummyObject{contentType: "text/plain", body: "content"}},
+	}
+	gcsHandler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &dummyObjectStore{byBucket: objectsByBucket})
+	handler := AccessLogged(ValidatingSession([]string{"lenses.io"}, testSecret, gcsHandler))
+
+	encoded, err := securecookie.New([]byte(testSecret), nil).Encode(sessionCookieName, map[string]string{
+		userHostedDomainKey: "lenses.io",
+		userEmailKey:        "jane@lenses.io",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/b1/existing/key?token=secret", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: encoded})
+	r.Header.Set(requestIDHeader, "req-123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if id := w.Result().Header.Get(requestIDHeader); id != "req-123" {
+		t.Errorf("Unexpected request id %s", id)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %s", out.String())
+	}
+	for field, expected := range map[string]interface{}{
+		"msg":        "access",
+		"request_id": "req-123",
+		"user":       "jane@lenses.io",
+		"alias":      "b1",
+		"bucket":     "bucket1",
+		"key":        "existing/key",
+		"path":       "/b1/existing/key",
+		"status":     float64(200),
+		"bytes":      float64(len("content")),
+	} {
+		if record[field] != expected {
+			t.Errorf("Unexpected %s: %v", field, record[field])
+		}
+	}
+}
+
+func TestAccessLogGeneratesRequestID(t *testing.T) {
+	logging.Configure(&bytes.Buffer{}, logging.Info, true)
+	defer logging.Configure(os.Stderr, logging.Info, false)
+
+	handler := AccessLogged(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(requestIDHeader, "not a valid id\n")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if id := w.Result().Header.Get(requestIDHeader); len(id) != 32 {
+		t.Errorf("Unexpected request id %q", id)
+	}
+}
+
+func TestAccessLogRecordsForwardedClientIP(t *testing.T) {
+	var out bytes.Buffer
+	logging.Configure(&out, logging.Warn, true)
+	defer logging.Configure(os.Stderr, logging.Info, false)
+
+	var c config.ProgramConfig
+	c.Web.TrustedProxies = []string{"10.0.0.0/8"}
+	handler, err := ExternalURL(c, AccessLogged(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %s", out.String())
+	}
+	if record["remote_addr"] != "203.0.113.7" || record["peer_addr"] != "10.0.0.1:4321" {
+		t.Errorf("Unexpected addresses %v and %v", record["remote_addr"], record["peer_addr"])
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afiore/gcs-proxy/logging"
+)
+
+//DefaultSessionWindow is how long after its last request a user is still reported as active
+const DefaultSessionWindow = 15 * time.Minute
+
+//Sessions tracks the users authenticated by ValidatingSession. Sessions live in signed cookies, so the users that
+//issued a request within the activity window are the ones reported as active
+type Sessions struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	byUser map[string]*SessionActivity
+	//pruned is when the expired sessions were last dropped
+	pruned time.Time
+}
+
+//SessionActivity describes the requests issued by a user, or through a share link, within the activity window
+type SessionActivity struct {
+	User      string    `json:"user"`
+	ShareLink bool      `json:"share_link,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Requests  int64     `json:"requests"`
+}
+
+//NewSessions constructs a tracker reporting the users seen within the supplied window, DefaultSessionWindow when 0
+func NewSessions(window time.Duration) *Sessions {
+	if window <= 0 {
+		window = DefaultSessionWindow
+	}
+	return &Sessions{window: window, now: time.Now, byUser: make(map[string]*SessionActivity)}
+}
+
+//WithSessionTracker makes ValidatingSession record the authenticated requests in the supplied tracker
+func WithSessionTracker(s *Sessions) SessionOption {
+	return func(o *sessionOptions) {
+		o.sessions = s
+	}
+}
+
+func (s *Sessions) seen(user string, shareLink bool) {
+	if s == nil {
+		return
+	}
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.byUser[user]
+	if !ok || now.Sub(a.LastSeen) > s.window {
+		//new sessions drop the expired ones, at most once per window, so that the users that stopped issuing requests
+		//don't pile up between calls to Active
+		if now.Sub(s.pruned) > s.window {
+			s.pruneExpired(now)
+		}
+		a = &SessionActivity{User: user, ShareLink: shareLink, FirstSeen: now}
+		s.byUser[user] = a
+	}
+	a.LastSeen = now
+	a.Requests++
+}
+
+//Window returns how long after its last request a user is still reported as active
+func (s *Sessions) Window() time.Duration {
+	return s.window
+}
+
+//Active returns the users seen within the activity window, most recently seen first
+func (s *Sessions) Active() []SessionActivity {
+	now := s.now()
+	s.mu.Lock()
+	s.pruneExpired(now)
+	active := make([]SessionActivity, 0, len(s.byUser))
+	for _, a := range s.byUser {
+		active = append(active, *a)
+	}
+	s.mu.Unlock()
+	sort.Slice(active, func(i, j int) bool {
+		if !active[i].LastSeen.Equal(active[j].LastSeen) {
+			return active[i].LastSeen.After(active[j].LastSeen)
+		}
+		return active[i].User < active[j].User
+	})
+	return active
+}
+
+//pruneExpired drops the sessions whose last request is older than the window. Must be called with s.mu held
+func (s *Sessions) pruneExpired(now time.Time) {
+	for user, a := range s.byUser {
+		if now.Sub(a.LastSeen) > s.window {
+			delete(s.byUser, user)
+		}
+	}
+	s.pruned = now
+}
+
+//Transfers tracks the objects being streamed by ServeFromBuckets
+type Transfers struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*transfer
+}
+
+//TransferInfo describes an object being streamed to a client
+type TransferInfo struct {
+	RequestID string    `json:"request_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Alias     string    `json:"alias"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	Written   int64     `json:"written"`
+	Started   time.Time `json:"started"`
+}
+
+type transfer struct {
+	info  TransferInfo
+	guard *throughputGuard
+}
+
+//NewTransfers constructs an empty transfer tracker
+func NewTransfers() *Transfers {
+	return &Transfers{now: time.Now, active: make(map[uint64]*transfer)}
+}
+
+//WithTransferTracker makes ServeFromBuckets record the objects it streams in the supplied tracker
+func WithTransferTracker(t *Transfers) Option {
+	return func(o *options) {
+		o.transfers = t
+	}
+}
+
+//start records a transfer, whose progress is read from the guard wrapping the response. The returned function
+//must be called once the transfer ends
+func (t *Transfers) start(r *http.Request, alias, bucket, key string, size int64, guard *throughputGuard) func() {
+	if t == nil {
+		return func() {}
+	}
+	info := TransferInfo{User: requestUser(r), Alias: alias, Bucket: bucket, Key: key, Size: size, Started: t.now()}
+	if entry, ok := logging.AccessEntryFrom(r.Context()); ok {
+		info.RequestID = entry.RequestID
+	}
+	t.mu.Lock()
+	t.nextID++
+	id := t.nextID
+	t.active[id] = &transfer{info: info, guard: guard}
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.active, id)
+		t.mu.Unlock()
+	}
+}
+
+//Active returns the transfers in progress, oldest first
+func (t *Transfers) Active() []TransferInfo {
+	t.mu.Lock()
+	active := make([]TransferInfo, 0, len(t.active))
+	for _, tr := range t.active {
+		info := tr.info
+		info.Written = atomic.LoadInt64(&tr.guard.written)
+		active = append(active, info)
+	}
+	t.mu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].Started.Before(active[j].Started) })
+	return active
+}
+
+//Len returns the number of transfers in progress
+func (t *Transfers) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.active)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/afiore/gcs-proxy/cache"
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/resilience"
+)
+
+//AdminPath prefixes the endpoints of the admin API
+const AdminPath = "/admin/"
+
+//AdminState gives the admin API access to the running proxy. Cache and Breaker are nil when the corresponding
+//store layer is disabled
+type AdminState struct {
+	//Config returns the configuration currently in effect, including the reloaded settings
+	Config    func() config.ProgramConfig
+	Health    *Health
+	Sessions  *Sessions
+	Transfers *Transfers
+	Cache     *cache.Store
+	Breaker   *resilience.Store
+}
+
+type admin struct {
+	token []byte
+	state AdminState
+}
+
+type adminRoute struct {
+	Alias           string `json:"alias"`
+	Host            string `json:"host,omitempty"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix,omitempty"`
+	IndexDocument   string `json:"index_document,omitempty"`
+	SignedRedirects bool   `json:"signed_redirects,omitempty"`
+}
+
+type adminCache struct {
+	Enabled bool `json:"enabled"`
+	*cache.Stats
+}
+
+type adminBreaker struct {
+	Enabled bool `json:"enabled"`
+	*resilience.BreakerStatus
+}
+
+type adminSessions struct {
+	Window   string            `json:"window"`
+	Sessions []SessionActivity `json:"sessions"`
+}
+
+type adminTransfers struct {
+	Count     int            `json:"count"`
+	Transfers []TransferInfo `json:"transfers"`
+}
+
+type adminDrain struct {
+	Draining          bool `json:"draining"`
+	InFlightTransfers int  `json:"in_flight_transfers"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+//NewAdmin serves the admin API, authenticating requests with the supplied bearer token. The API lists the effective
+//configuration, with secrets redacted, the routing table, the cache statistics, the active sessions, the circuit
+//breaker state and the transfers in progress. It can also clear the cache and take the instance out of rotation
+func NewAdmin(token string, state AdminState) http.Handler {
+	a := &admin{token: []byte(token), state: state}
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPath+"config", a.get(a.config))
+	mux.HandleFunc(AdminPath+"routes", a.get(a.routes))
+	mux.HandleFunc(AdminPath+"cache", a.get(a.cache))
+	mux.HandleFunc(AdminPath+"cache/clear", a.post(a.clearCache))
+	mux.HandleFunc(AdminPath+"sessions", a.get(a.sessions))
+	mux.HandleFunc(AdminPath+"breaker", a.get(a.breaker))
+	mux.HandleFunc(AdminPath+"transfers", a.get(a.transfers))
+	mux.HandleFunc(AdminPath+"drain", a.methods(map[string]http.HandlerFunc{
+		http.MethodGet:    a.drainStatus,
+		http.MethodPost:   a.drain(true),
+		http.MethodDelete: a.drain(false),
+	}))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, adminError{Error: "no such admin endpoint"})
+	})
+	return a.authenticated(mux)
+}
+
+//authenticated rejects the requests lacking the admin bearer token
+func (a *admin) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const scheme = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if len(auth) < len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), a.token) != 1 {
+			logging.Warnf("rejecting unauthenticated admin request for %s from %s", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gcs-proxy admin"`)
+			writeJSON(w, http.StatusUnauthorized, adminError{Error: "a valid admin token is required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) methods(byMethod map[string]http.HandlerFunc) http.HandlerFunc {
+	allowed := make([]string, 0, len(byMethod))
+	for method := range byMethod {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := byMethod[r.Method]
+		if !ok {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{Error: "method not allowed"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *admin) get(handler http.HandlerFunc) http.HandlerFunc {
+	return a.methods(map[string]http.HandlerFunc{http.MethodGet: handler})
+}
+
+func (a *admin) post(handler http.HandlerFunc) http.HandlerFunc {
+	return a.methods(map[string]http.HandlerFunc{http.MethodPost: handler})
+}
+
+func (a *admin) config(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.state.Config().Redacted())
+}
+
+func (a *admin) routes(w http.ResponseWriter, r *http.Request) {
+	c := a.state.Config()
+	routes := make([]adminRoute, 0, len(c.Gcs.Hosts)+len(c.Gcs.Buckets))
+	//host routes come first, in the order they are configured, as they take precedence over the bucket aliases
+	for _, host := range compileHostRoutes(c.Gcs.Hosts) {
+		_, signed := c.Gcs.SignedRedirects[host.alias]
+		pattern := host.host
+		if host.wildcard {
+			pattern = "*." + pattern
+		}
+		routes = append(routes, adminRoute{Alias: host.alias, Host: pattern, Bucket: host.bucket, Prefix: host.prefix,
+			IndexDocument: host.index, SignedRedirects: signed})
+	}
+	aliases := make([]adminRoute, 0, len(c.Gcs.Buckets))
+	for alias, bucket := range c.Gcs.Buckets {
+		_, signed := c.Gcs.SignedRedirects[alias]
+		aliases = append(aliases, adminRoute{Alias: alias, Bucket: bucket, SignedRedirects: signed})
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Alias < aliases[j].Alias })
+	writeJSON(w, http.StatusOK, append(routes, aliases...))
+}
+
+func (a *admin) cache(w http.ResponseWriter, r *http.Request) {
+	if a.state.Cache == nil {
+		writeJSON(w, http.StatusOK, adminCache{})
+		return
+	}
+	stats := a.state.Cache.Stats()
+	writeJSON(w, http.StatusOK, adminCache{Enabled: true, Stats: &stats})
+}
+
+func (a *admin) clearCache(w http.ResponseWriter, r *http.Request) {
+	if a.state.Cache == nil {
+		writeJSON(w, http.StatusConflict, adminError{Error: "the cache is disabled"})
+		return
+	}
+	a.state.Cache.Clear()
+	logging.Infof("cache cleared through the admin API by %s", r.RemoteAddr)
+	a.cache(w, r)
+}
+
+func (a *admin) sessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, adminSessions{Window: a.state.Sessions.Window().String(), Sessions: a.state.Sessions.Active()})
+}
+
+func (a *admin) breaker(w http.ResponseWriter, r *http.Request) {
+	if a.state.Breaker == nil {
+		writeJSON(w, http.StatusOK, adminBreaker{})
+		return
+	}
+	status := a.state.Breaker.BreakerStatus()
+	writeJSON(w, http.StatusOK, adminBreaker{Enabled: true, BreakerStatus: &status})
+}
+
+func (a *admin) transfers(w http.ResponseWriter, r *http.Request) {
+	active := a.state.Transfers.Active()
+	writeJSON(w, http.StatusOK, adminTransfers{Count: len(active), Transfers: active})
+}
+
+func (a *admin) drainStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, adminDrain{Draining: a.state.Health.Draining(), InFlightTransfers: a.state.Transfers.Len()})
+}
+
+//drain takes the instance out of rotation, or puts it back. Draining only fails the readiness check: the requests
+//routed to the instance keep being served, so that callers can wait for the in-flight transfers to complete
+func (a *admin) drain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.state.Health.SetDraining(draining)
+		if draining {
+			logging.Infof("instance drained through the admin API by %s", r.RemoteAddr)
+		} else {
+			logging.Infof("instance put back in rotation through the admin API by %s", r.RemoteAddr)
+		}
+		a.drainStatus(w, r)
+	}
+}
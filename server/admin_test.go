@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/gorilla/securecookie"
+)
+
+const testAdminToken = "0123456789abcdef0123456789abcdef"
+const redactedSecret = "[REDACTED]"
+
+func testAdmin(health *Health, sessions *Sessions, transfers *Transfers) http.Handler {
+	var c config.ProgramConfig
+	c.Gcs.Buckets = map[string]string{"b2": "bucket2", "b1": "bucket1"}
+	c.Gcs.SignedRedirects = map[string]config.RedirectPolicy{"b2": {MinSizeMB: 1}}
+	c.Web.OAuth.ClientSecret = "client-secret"
+	c.Web.Admin.Token = testAdminToken
+	return NewAdmin(testAdminToken, AdminState{
+		Config:    func() config.ProgramConfig { return c },
+		Health:    health,
+		Sessions:  sessions,
+		Transfers: transfers,
+	})
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, path string, v interface{}) int {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil {
+		if err := json.NewDecoder(w.Result().Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Result().StatusCode
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	h := testAdmin(testHealth(t, &checkingStore{}), NewSessions(0), NewTransfers())
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + testAdminToken} {
+		r := httptest.NewRequest("GET", AdminPath+"config", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if status := w.Result().StatusCode; status != http.StatusUnauthorized || w.Result().Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("Unexpected status code %d for authorization %q", status, auth)
+		}
+	}
+
+	var c config.ProgramConfig
+	if status := adminRequest(t, h, "GET", AdminPath+"config", &c); status != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", status)
+	}
+	if c.Web.OAuth.ClientSecret != redactedSecret || c.Web.Admin.Token != redactedSecret {
+		t.Errorf("Expected the secrets to be redacted, got %+v", c.Web)
+	}
+}
+
+func TestAdminListsRoutes(t *testing.T) {
+	h := testAdmin(testHealth(t, &checkingStore{}), NewSessions(0), NewTransfers())
+	var routes []adminRoute
+	if status := adminRequest(t, h, "GET", AdminPath+"routes", &routes); status != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", status)
+	}
+	expected := []adminRoute{{Alias: "b1", Bucket: "bucket1"}, {Alias: "b2", Bucket: "bucket2", SignedRedirects: true}}
+	if len(routes) != 2 || routes[0] != expected[0] || routes[1] != expected[1] {
+		t.Errorf("Unexpected routes %+v", routes)
+	}
+	if status := adminRequest(t, h, "POST", AdminPath+"routes", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status code %d", status)
+	}
+}
+
+func TestAdminReportsDisabledLayers(t *testing.T) {
+	h := testAdmin(testHealth(t, &checkingStore{}), NewSessions(0), NewTransfers())
+	var c adminCache
+	if status := adminRequest(t, h, "GET", AdminPath+"cache", &c); status != http.StatusOK || c.Enabled {
+		t.Errorf("Unexpected cache status %d: %+v", status, c)
+	}
+	if status := adminRequest(t, h, "POST", AdminPath+"cache/clear", nil); status != http.StatusConflict {
+		t.Errorf("Unexpected status code %d", status)
+	}
+	var b adminBreaker
+	if status := adminRequest(t, h, "GET", AdminPath+"breaker", &b); status != http.StatusOK || b.Enabled {
+		t.Errorf("Unexpected breaker status %d: %+v", status, b)
+	}
+}
+
+func TestAdminDrainsInstance(t *testing.T) {
+	health := testHealth(t, &checkingStore{})
+	h := testAdmin(health, NewSessions(0), NewTransfers())
+
+	var d adminDrain
+	if status := adminRequest(t, h, "POST", AdminPath+"drain", &d); status != http.StatusOK || !d.Draining {
+		t.Errorf("Unexpected drain status %d: %+v", status, d)
+	}
+	if status, body := readiness(t, health); status != http.StatusServiceUnavailable || body.Checks["drain"] != "draining" {
+		t.Errorf("Unexpected readiness %d: %+v", status, body)
+	}
+
+	if status := adminRequest(t, h, "DELETE", AdminPath+"drain", &d); status != http.StatusOK || d.Draining {
+		t.Errorf("Unexpected drain status %d: %+v", status, d)
+	}
+	if status, body := readiness(t, health); status != http.StatusOK {
+		t.Errorf("Unexpected readiness %d: %+v", status, body)
+	}
+}
+
+//pausingStore writes the first part of the object and waits for release before writing the rest
+type pausingStore struct {
+	dummyObjectStore
+	release chan struct{}
+}
+
+func (s *pausingStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	o, err := s.getObject(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	half := len(o.body) / 2
+	n, err := io.WriteString(w, o.body[:half])
+	if err != nil {
+		return int64(n), err
+	}
+	<-s.release
+	m, err := io.WriteString(w, o.body[half:])
+	return int64(n + m), err
+}
+
+func TestAdminReportsSessionsAndTransfers(t *testing.T) {
+	objStore := &pausingStore{
+		dummyObjectStore: dummyObjectStore{byBucket: map[string]map[string]dummyObject{
+			"bucket1": {"existing/key": dummyObject{contentType: "text/plain", body: "0123456789"}},
+		}},
+		release: make(chan struct{}),
+	}
+	sessions, transfers := NewSessions(0), NewTransfers()
+	gcsHandler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore, WithTransferTracker(transfers))
+	handler := ValidatingSession([]string{"lenses.io"}, testSecret, gcsHandler, WithSessionTracker(sessions))
+	h := testAdmin(testHealth(t, &checkingStore{}), sessions, transfers)
+
+	encoded, err := securecookie.New([]byte(testSecret), nil).Encode(sessionCookieName, map[string]string{
+		userHostedDomainKey: "lenses.io",
+		userEmailKey:        "jane@lenses.io",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/b1/existing/key", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: encoded})
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		handler(httptest.NewRecorder(), r)
+	}()
+
+	var tr adminTransfers
+	for deadline := time.Now().Add(5 * time.Second); tr.Count == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		adminRequest(t, h, "GET", AdminPath+"transfers", &tr)
+	}
+	if tr.Count != 1 {
+		t.Fatalf("Expected a transfer in progress, got %+v", tr)
+	}
+	if got := tr.Transfers[0]; got.User != "jane@lenses.io" || got.Key != "existing/key" || got.Size != 10 || got.Written != 5 {
+		t.Errorf("Unexpected transfer %+v", got)
+	}
+	close(objStore.release)
+	<-served
+	if adminRequest(t, h, "GET", AdminPath+"transfers", &tr); tr.Count != 0 {
+		t.Errorf("Expected the transfer to be completed, got %+v", tr)
+	}
+
+	var s adminSessions
+	if status := adminRequest(t, h, "GET", AdminPath+"sessions", &s); status != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", status)
+	}
+	if len(s.Sessions) != 1 || s.Sessions[0].User != "jane@lenses.io" || s.Sessions[0].Requests != 1 || !strings.HasPrefix(s.Window, "15m") {
+		t.Errorf("Unexpected sessions %+v", s)
+	}
+}
+
+func TestSessionsExpireAfterWindow(t *testing.T) {
+	sessions := NewSessions(time.Minute)
+	now := time.Now()
+	sessions.now = func() time.Time { return now }
+	sessions.seen("jane@lenses.io", false)
+	now = now.Add(30 * time.Second)
+	sessions.seen("share:abc", true)
+	if active := sessions.Active(); len(active) != 2 || active[0].User != "share:abc" || !active[0].ShareLink {
+		t.Errorf("Unexpected active sessions %+v", active)
+	}
+	now = now.Add(45 * time.Second)
+	if active := sessions.Active(); len(active) != 1 || active[0].User != "share:abc" {
+		t.Errorf("Unexpected active sessions %+v", active)
+	}
+}
+
+func TestSessionsArePrunedOnInsert(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	sessions := NewSessions(time.Minute)
+	sessions.now = func() time.Time { return now }
+	for i := 0; i < 100; i++ {
+		sessions.seen(fmt.Sprintf("user%d@lenses.io", i), false)
+	}
+	now = now.Add(2 * time.Minute)
+	sessions.seen("jane@lenses.io", false)
+	if n := len(sessions.byUser); n != 1 {
+		t.Errorf("Expected the expired sessions to be dropped, %d are tracked", n)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/afiore/gcs-proxy/audit"
+	"github.com/afiore/gcs-proxy/logging"
+)
+
+//WithAuditLog records the objects served to authenticated users and share link recipients in the supplied audit log
+func WithAuditLog(a *audit.Log) Option {
+	return func(o *options) {
+		o.audit = a
+	}
+}
+
+//recordAudit completes the event with the identity and request ID of the supplied request and appends it to the log
+func recordAudit(a *audit.Log, r *http.Request, e audit.Event) {
+	if a == nil {
+		return
+	}
+	e.User = requestUser(r)
+	if grant, ok := shareGrant(r); ok && e.Action == audit.Read {
+		e.Action = audit.ShareRead
+		e.ShareID = grant.ID
+	}
+	if entry, ok := logging.AccessEntryFrom(r.Context()); ok {
+		e.RequestID = entry.RequestID
+	}
+	if err := a.Record(e); err != nil {
+		logging.Errorf("cannot record audit event for %s: %v", r.URL.Path, err)
+	}
+}
+
+//auditRedirect records the redirect to a signed URL, unless signing the URL has failed
+func auditRedirect(a *audit.Log, r *http.Request, w *responseRecorder, e audit.Event) {
+	if w.status != http.StatusFound {
+		return
+	}
+	e.Status = w.status
+	recordAudit(a, r, e)
+}
+
+func withUser(r *http.Request, identity string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey, identity))
+}
+
+//requestUser returns the identity of the user authenticated by ValidatingSession
+func requestUser(r *http.Request) string {
+	identity, _ := r.Context().Value(userKey).(string)
+	return identity
+}
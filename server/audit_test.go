@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/audit"
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+func TestAuditLogRecordsReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var c config.ProgramConfig
+	c.Audit.File = filepath.Join(dir, "audit.log")
+	auditLog, err := audit.Open(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"existing/key": dummyObject{contentType: "text/plain", body: "content"}},
+	}
+	gcsHandler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &dummyObjectStore{byBucket: objectsByBucket}, WithAuditLog(auditLog))
+	r := httptest.NewRequest("GET", "/b1/existing/key", nil)
+	gcsHandler(httptest.NewRecorder(), withUser(r, "jane@lenses.io"))
+	auditLog.Close()
+
+	f, err := os.Open(c.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := audit.Query(f, audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Unexpected number of events %d", len(events))
+	}
+	e := events[0]
+	if e.Action != audit.Read || e.User != "jane@lenses.io" || e.Bucket != "bucket1" || e.Key != "existing/key" || e.Bytes != int64(len("content")) {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	if e.Hash == "" {
+		t.Errorf("Expected the event to be hashed")
+	}
+}
+
+func TestAuditLogRecordsFailedReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var c config.ProgramConfig
+	c.Audit.File = filepath.Join(dir, "audit.log")
+	auditLog, err := audit.Open(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"existing/key": dummyObject{contentType: "text/plain", body: "content"}},
+	}
+	copyErr := &store.Error{Op: "CopyObject", Bucket: "bucket1", Key: "existing/key", Kind: store.ErrUnavailable, Err: errors.New("boom")}
+	for _, partial := range []string{"", "cont"} {
+		objStore := &failingStore{dummyObjectStore: dummyObjectStore{byBucket: objectsByBucket}, copyErr: copyErr, partial: partial}
+		gcsHandler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore, WithAuditLog(auditLog))
+		func() {
+			defer func() {
+				if p := recover(); p != nil && p != http.ErrAbortHandler {
+					panic(p)
+				}
+			}()
+			gcsHandler(httptest.NewRecorder(), withUser(httptest.NewRequest("GET", "/b1/existing/key", nil), "jane@lenses.io"))
+		}()
+	}
+	auditLog.Close()
+
+	f, err := os.Open(c.Audit.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := audit.Query(f, audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Unexpected number of events %d", len(events))
+	}
+	if e := events[0]; e.Status != http.StatusServiceUnavailable || e.Bytes != 0 || e.Error == "" {
+		t.Errorf("Unexpected event for the read failing before the response %+v", e)
+	}
+	if e := events[1]; e.Status != http.StatusOK || e.Bytes != int64(len("cont")) || e.Error == "" {
+		t.Errorf("Unexpected event for the read aborted mid-stream %+v", e)
+	}
+}
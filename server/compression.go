@@ -0,0 +1,285 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/store"
+	"github.com/andybalholm/brotli"
+)
+
+const defaultMinCompressionSize = 1024
+
+//siblingMissTTL bounds how long an object is known to lack precompressed siblings, so that siblings uploaded later
+//end up being served
+const siblingMissTTL = 5 * time.Minute
+const maxSiblingMisses = 10000
+
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+//siblingExtensions maps content codings to the extension of the precompressed objects storing them
+var siblingExtensions = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+type compression struct {
+	minSize       int64
+	contentTypes  []string
+	precompressed bool
+	misses        *siblingMisses
+}
+
+//siblingMisses remembers the object generations lacking a precompressed sibling, sparing a metadata lookup per coding
+//on every request for them
+type siblingMisses struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	expires map[string]time.Time
+}
+
+func newSiblingMisses() *siblingMisses {
+	return &siblingMisses{now: time.Now, expires: make(map[string]time.Time)}
+}
+
+func (m *siblingMisses) missing(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expires, ok := m.expires[key]
+	return ok && m.now().Before(expires)
+}
+
+func (m *siblingMisses) add(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if len(m.expires) >= maxSiblingMisses {
+		for k, expires := range m.expires {
+			if !now.Before(expires) {
+				delete(m.expires, k)
+			}
+		}
+		if len(m.expires) >= maxSiblingMisses {
+			m.expires = make(map[string]time.Time)
+		}
+	}
+	m.expires[key] = now.Add(siblingMissTTL)
+}
+
+func newCompression(c config.Compression) *compression {
+	if !c.Enabled {
+		return nil
+	}
+	minSize := c.MinSizeBytes
+	if minSize <= 0 {
+		minSize = defaultMinCompressionSize
+	}
+	contentTypes := c.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = defaultCompressibleTypes
+	}
+	return &compression{minSize: minSize, contentTypes: contentTypes, precompressed: c.Precompressed, misses: newSiblingMisses()}
+}
+
+func (c *compression) compressible(meta store.ObjectMetadata) bool {
+	if meta.Size() < c.minSize {
+		return false
+	}
+	contentType, _, err := mime.ParseMediaType(meta.ContentType())
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.contentTypes {
+		if ok, _ := path.Match(pattern, contentType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//acceptedEncodings parses an Accept-Encoding header value into the q-value of each listed content coding
+func acceptedEncodings(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+func qValue(accepted map[string]float64, coding string) float64 {
+	if q, ok := accepted[coding]; ok {
+		return q
+	}
+	return accepted["*"]
+}
+
+//preferredEncoding returns the accepted coding with the highest q-value, ties being resolved by the order of the offers
+func preferredEncoding(accepted map[string]float64, offers ...string) string {
+	best, bestQ := "", 0.0
+	for _, coding := range offers {
+		if q := qValue(accepted, coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+//encodedBody describes how the object content is encoded in the response
+type encodedBody struct {
+	//key of the object to copy, which differs from the requested one when serving a precompressed sibling
+	key string
+	//compress is the content coding applied on the fly, if any
+	compress string
+	//gunzip is set when stored gzip content has to be decoded for clients not accepting it
+	gunzip bool
+}
+
+//negotiateBody selects the representation of the object best suited to the request Accept-Encoding header,
+//adjusting the response headers accordingly
+func negotiateBody(r *http.Request, c *compression, objStore store.ObjectStoreOps, bucket, key string, meta store.ObjectMetadata, headers map[string]string) encodedBody {
+	body := encodedBody{key: key}
+	stored := headers["Content-Encoding"]
+	if c == nil && stored == "" {
+		return body
+	}
+	headers["Vary"] = "Accept-Encoding"
+	accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+
+	if stored != "" {
+		if stored == "gzip" && qValue(accepted, "gzip") <= 0 {
+			delete(headers, "Content-Encoding")
+			delete(headers, "Content-Length")
+			body.gunzip = true
+		}
+		return body
+	}
+	if c == nil {
+		return body
+	}
+	if !c.compressible(meta) {
+		return body
+	}
+	if c.precompressed {
+		if coding, sibling, ok := c.precompressedSibling(r.Context(), objStore, bucket, key, meta, accepted); ok {
+			headers["Content-Encoding"] = coding
+			headers["Content-Length"] = strconv.FormatInt(sibling.Size(), 10)
+			body.key = key + siblingExtensions[coding]
+			return body
+		}
+	}
+	if coding := preferredEncoding(accepted, "br", "gzip"); coding != "" {
+		headers["Content-Encoding"] = coding
+		delete(headers, "Content-Length")
+		body.compress = coding
+	}
+	return body
+}
+
+//precompressedSibling looks up `.br` and `.gz` siblings of the object, in order of client preference. Siblings found
+//missing are remembered for the object generation
+func (c *compression) precompressedSibling(ctx context.Context, objStore store.ObjectStoreOps, bucket, key string, meta store.ObjectMetadata, accepted map[string]float64) (string, store.ObjectMetadata, bool) {
+	if strings.HasSuffix(key, ".br") || strings.HasSuffix(key, ".gz") {
+		return "", nil, false
+	}
+	offers := []string{"br", "gzip"}
+	for len(offers) > 0 {
+		coding := preferredEncoding(accepted, offers...)
+		if coding == "" {
+			break
+		}
+		missKey := bucket + "/" + key + siblingExtensions[coding] + "#" + strconv.FormatInt(meta.Generation(), 10)
+		if !c.misses.missing(missKey) {
+			sibling, err := objStore.GetObjectMetadata(ctx, bucket, key+siblingExtensions[coding])
+			if err == nil {
+				return coding, sibling, true
+			}
+			if errors.Is(err, store.ErrNotFound) {
+				c.misses.add(missKey)
+			} else {
+				logging.Warnf("cannot look up precompressed sibling of %s in bucket %s: %v", key, bucket, err)
+			}
+		}
+		for i, offer := range offers {
+			if offer == coding {
+				offers = append(offers[:i:i], offers[i+1:]...)
+				break
+			}
+		}
+	}
+	return "", nil, false
+}
+
+//copy writes the negotiated representation of the object to w
+func (b encodedBody) copy(ctx context.Context, objStore store.ObjectStoreOps, bucket string, w io.Writer) (int64, error) {
+	switch b.compress {
+	case "br":
+		bw := brotli.NewWriter(w)
+		n, err := objStore.CopyObject(ctx, bucket, b.key, bw)
+		if closeErr := bw.Close(); err == nil {
+			err = closeErr
+		}
+		return n, err
+	case "gzip":
+		gw := gzip.NewWriter(w)
+		n, err := objStore.CopyObject(ctx, bucket, b.key, gw)
+		if closeErr := gw.Close(); err == nil {
+			err = closeErr
+		}
+		return n, err
+	}
+	if b.gunzip {
+		return copyGunzipped(ctx, objStore, bucket, b.key, w)
+	}
+	return objStore.CopyObject(ctx, bucket, b.key, w)
+}
+
+//copyGunzipped decodes gzip encoded objects as they are copied to w
+func copyGunzipped(ctx context.Context, objStore store.ObjectStoreOps, bucket, key string, w io.Writer) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := objStore.CopyObject(ctx, bucket, key, pw)
+		pw.CloseWithError(err)
+	}()
+	gr, err := gzip.NewReader(pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return 0, err
+	}
+	n, err := io.Copy(w, gr)
+	//unblock the store copy if decoding stopped early
+	pr.CloseWithError(errors.New("decoding interrupted"))
+	return n, err
+}
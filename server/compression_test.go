@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/store"
+	"github.com/andybalholm/brotli"
+)
+
+var compressibleContent = strings.Repeat("some compressible report content ", 100)
+
+func gzipped(t *testing.T, content string) string {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func serveCompressed(t *testing.T, path, acceptEncoding string, c config.Compression) *http.Response {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {
+			"report.html":    dummyObject{contentType: "text/html", body: compressibleContent},
+			"report.html.br": dummyObject{contentType: "text/html", body: "brotli bytes"},
+			"image.png":      dummyObject{contentType: "image/png", body: compressibleContent},
+			"data.json":      dummyObject{contentType: "application/json", body: gzipped(t, compressibleContent), encoding: "gzip"},
+		},
+	}
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &dummyObjectStore{byBucket: objectsByBucket}, WithCompression(c))
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Result()
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGzipCompression(t *testing.T) {
+	resp := serveCompressed(t, "/b1/report.html", "gzip, deflate", config.Compression{Enabled: true})
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Unexpected Content-Encoding %s", ce)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		t.Errorf("Unexpected Content-Length %s", cl)
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(gr)
+	if string(b) != compressibleContent {
+		t.Errorf("Unexpected content %s", b)
+	}
+}
+
+func TestBrotliCompressionPreferred(t *testing.T) {
+	resp := serveCompressed(t, "/b1/report.html", "gzip;q=0.8, br", config.Compression{Enabled: true})
+	if ce := resp.Header.Get("Content-Encoding"); ce != "br" {
+		t.Fatalf("Unexpected Content-Encoding %s", ce)
+	}
+	b, _ := ioutil.ReadAll(brotli.NewReader(resp.Body))
+	if string(b) != compressibleContent {
+		t.Errorf("Unexpected content %s", b)
+	}
+}
+
+func TestIncompressibleContentTypeIsNotCompressed(t *testing.T) {
+	resp := serveCompressed(t, "/b1/image.png", "gzip, br", config.Compression{Enabled: true})
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Unexpected Content-Encoding %s", ce)
+	}
+	if body := readBody(t, resp); body != compressibleContent {
+		t.Errorf("Unexpected content %s", body)
+	}
+}
+
+func TestGzippedObjectIsPassedThrough(t *testing.T) {
+	resp := serveCompressed(t, "/b1/data.json", "gzip", config.Compression{})
+	if ce := resp.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("Unexpected Content-Encoding %s", ce)
+	}
+	if body := readBody(t, resp); body != gzipped(t, compressibleContent) {
+		t.Errorf("Expected gzipped content to be passed through unchanged")
+	}
+}
+
+func TestGzippedObjectIsDecodedWhenNotAccepted(t *testing.T) {
+	resp := serveCompressed(t, "/b1/data.json", "identity", config.Compression{})
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Errorf("Unexpected Content-Encoding %s", ce)
+	}
+	if body := readBody(t, resp); body != compressibleContent {
+		t.Errorf("Unexpected content %s", body)
+	}
+}
+
+func TestPrecompressedSiblingIsServed(t *testing.T) {
+	resp := serveCompressed(t, "/b1/report.html", "br", config.Compression{Enabled: true, Precompressed: true})
+	if ce := resp.Header.Get("Content-Encoding"); ce != "br" {
+		t.Errorf("Unexpected Content-Encoding %s", ce)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html" {
+		t.Errorf("Unexpected Content-Type %s", ct)
+	}
+	if body := readBody(t, resp); body != "brotli bytes" {
+		t.Errorf("Unexpected content %s", body)
+	}
+}
+
+func TestPreferredEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                 "",
+		"gzip":             "gzip",
+		"br, gzip":         "br",
+		"br;q=0.5, gzip":   "gzip",
+		"*":                "br",
+		"*, br;q=0":        "gzip",
+		"identity, gzip;q": "gzip",
+	} {
+		if coding := preferredEncoding(acceptedEncodings(header), "br", "gzip"); coding != expected {
+			t.Errorf("Expected %q to negotiate %q, got %q", header, expected, coding)
+		}
+	}
+}
+
+//countingStore counts the metadata lookups per key, answering the missing keys with store.ObjectNotFound
+type countingStore struct {
+	dummyObjectStore
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (s *countingStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	s.mu.Lock()
+	s.lookups[key]++
+	s.mu.Unlock()
+	if _, ok := s.byBucket[bucket][key]; !ok {
+		return nil, &store.ObjectNotFound{Bucket: bucket, Key: key}
+	}
+	return s.dummyObjectStore.GetObjectMetadata(ctx, bucket, key)
+}
+
+func TestPrecompressedSiblingLookups(t *testing.T) {
+	objStore := &countingStore{lookups: make(map[string]int), dummyObjectStore: dummyObjectStore{byBucket: map[string]map[string]dummyObject{
+		"bucket1": {
+			"plain.html": dummyObject{contentType: "text/html", body: compressibleContent},
+			"image.png":  dummyObject{contentType: "image/png", body: compressibleContent},
+		},
+	}}}
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore,
+		WithCompression(config.Compression{Enabled: true, Precompressed: true}))
+	for i := 0; i < 3; i++ {
+		for _, path := range []string{"/b1/plain.html", "/b1/image.png"} {
+			r := httptest.NewRequest("GET", path, nil)
+			r.Header.Set("Accept-Encoding", "br, gzip")
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: unexpected status code %d", path, w.Code)
+			}
+		}
+	}
+	for key, expected := range map[string]int{
+		"plain.html.br": 1,
+		"plain.html.gz": 1,
+		"image.png.br":  0,
+		"image.png.gz":  0,
+	} {
+		if n := objStore.lookups[key]; n != expected {
+			t.Errorf("Expected %d lookups of %s, got %d", expected, key, n)
+		}
+	}
+}
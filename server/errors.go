@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+//statusClientClosedRequest is recorded for requests whose client went away before a response could be sent
+const statusClientClosedRequest = 499
+
+//storeErrorStatus maps the errors returned by object stores to a response status and message
+func storeErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, "Not found"
+	case errors.Is(err, store.ErrForbidden):
+		return http.StatusForbidden, "Forbidden"
+	case errors.Is(err, store.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed, "Precondition failed"
+	case errors.Is(err, store.ErrUnavailable):
+		return http.StatusServiceUnavailable, "The object store is temporarily unavailable"
+	case errors.Is(err, store.ErrCanceled), errors.Is(err, context.Canceled):
+		return statusClientClosedRequest, "Request canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "The object store did not respond in time"
+	case errors.Is(err, store.ErrNotSupported):
+		return http.StatusNotImplemented, "Not implemented"
+	default:
+		return http.StatusInternalServerError, "An internal error has occured"
+	}
+}
+
+//writeStoreError answers the request with the status corresponding to the supplied store error
+func writeStoreError(w http.ResponseWriter, err error) {
+	status, msg := storeErrorStatus(err)
+	var retryable interface{ RetryAfter() time.Duration }
+	if errors.As(err, &retryable) {
+		seconds := int64(math.Ceil(retryable.RetryAfter().Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	switch {
+	case status == http.StatusNotFound || status == statusClientClosedRequest:
+		logging.Debugf("%v", err)
+	case status >= 500:
+		logging.Errorf("%v", err)
+	default:
+		logging.Warnf("%v", err)
+	}
+	http.Error(w, msg, status)
+}
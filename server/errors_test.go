@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/store"
+)
+
+//failingStore returns err from GetObjectMetadata, or from CopyObject after writing partial, when set
+type failingStore struct {
+	dummyObjectStore
+	metaErr error
+	copyErr error
+	partial string
+}
+
+func (s *failingStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	if s.metaErr != nil {
+		return nil, s.metaErr
+	}
+	return s.dummyObjectStore.GetObjectMetadata(ctx, bucket, key)
+}
+
+func (s *failingStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	if s.partial == "" {
+		return 0, s.copyErr
+	}
+	n, _ := io.WriteString(w, s.partial)
+	return int64(n), s.copyErr
+}
+
+func TestStoreErrorsMapToStatus(t *testing.T) {
+	storeErr := func(kind error) error {
+		return &store.Error{Op: "GetObjectMetadata", Bucket: "bucket1", Key: "key", Kind: kind, Err: errors.New("boom")}
+	}
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{&store.ObjectNotFound{Bucket: "bucket1", Key: "key"}, http.StatusNotFound},
+		{storeErr(store.ErrNotFound), http.StatusNotFound},
+		{storeErr(store.ErrForbidden), http.StatusForbidden},
+		{storeErr(store.ErrPreconditionFailed), http.StatusPreconditionFailed},
+		{storeErr(store.ErrUnavailable), http.StatusServiceUnavailable},
+		{storeErr(store.ErrCanceled), statusClientClosedRequest},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{errors.New("boom"), http.StatusInternalServerError},
+	} {
+		w := httptest.NewRecorder()
+		handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &failingStore{metaErr: test.err})
+		handler(w, httptest.NewRequest("GET", "/b1/key", nil))
+		if status := w.Result().StatusCode; status != test.status {
+			t.Errorf("Unexpected status code %d for %v", status, test.err)
+		}
+	}
+}
+
+func failingCopyServer(partial string) *httptest.Server {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"key": dummyObject{contentType: "text/plain", body: "complete content"}},
+	}
+	objStore := &failingStore{dummyObjectStore: dummyObjectStore{byBucket: objectsByBucket}, copyErr: errors.New("connection reset"), partial: partial}
+	return httptest.NewServer(Recovering(http.HandlerFunc(ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore))))
+}
+
+func TestCopyFailureBeforeWritingAnswersWithError(t *testing.T) {
+	server := failingCopyServer("")
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/b1/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestCopyFailureMidStreamAbortsConnection(t *testing.T) {
+	server := failingCopyServer("complete")
+	defer server.Close()
+
+	//depending on buffering, the connection is aborted either before or after the response headers are received
+	resp, err := http.Get(server.URL + "/b1/key")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("Expected the truncated body to fail reading")
+	}
+}
+
+func TestRecoveringFromPanics(t *testing.T) {
+	handler := Recovering(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/b1/key", nil))
+	if status := w.Result().StatusCode; status != http.StatusInternalServerError {
+		t.Errorf("Unexpected status code %d", status)
+	}
+}
+
+type retryableError struct{}
+
+func (e retryableError) Error() string             { return "circuit breaker open" }
+func (e retryableError) Is(target error) bool      { return target == store.ErrUnavailable }
+func (e retryableError) RetryAfter() time.Duration { return 1500 * time.Millisecond }
+
+func TestUnavailableStoreSetsRetryAfter(t *testing.T) {
+	w := httptest.NewRecorder()
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &failingStore{metaErr: retryableError{}})
+	handler(w, httptest.NewRequest("GET", "/b1/key", nil))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Unexpected Retry-After %s", retryAfter)
+	}
+}
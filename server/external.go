@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+//externalURL describes how a client reaches the proxy, possibly through reverse proxies
+type externalURL struct {
+	scheme   string
+	host     string
+	prefix   string
+	clientIP string
+	//requested is the host the request was addressed to, which differs from host when a public URL is configured
+	requested string
+}
+
+//ExternalURL resolves, for every request, the scheme, host and path prefix clients reach the proxy with, along with
+//their IP address, so that the URLs generated by the proxy (e.g. OAuth callbacks and share links) are valid for them.
+//These are taken from the configured public URL or, for requests from trusted proxies, from the X-Forwarded-Proto,
+//X-Forwarded-Host, X-Forwarded-Prefix, X-Forwarded-For and Forwarded headers. The configured path prefix is
+//stripped from incoming requests, answering with 404 those falling outside of it
+func ExternalURL(c config.ProgramConfig, next http.Handler) (http.Handler, error) {
+	trusted, err := parseCIDRs(c.Web.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	var public *url.URL
+	if c.Web.PublicURL != "" {
+		public, err = url.Parse(c.Web.PublicURL)
+		if err != nil || (public.Scheme != "http" && public.Scheme != "https") || public.Host == "" {
+			return nil, fmt.Errorf("invalid public URL %s", c.Web.PublicURL)
+		}
+	}
+	scheme := c.Web.Scheme
+	if scheme == "" && c.Web.TLS.Enabled {
+		scheme = "https"
+	}
+	pathPrefix := strings.TrimSuffix(c.Web.PathPrefix, "/")
+	if pathPrefix != "" && !strings.HasPrefix(pathPrefix, "/") {
+		pathPrefix = "/" + pathPrefix
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := requestURL(r)
+		e.prefix = pathPrefix
+		if scheme != "" {
+			e.scheme = scheme
+		}
+		if isTrusted(trusted, e.clientIP) {
+			forwarded(r, trusted, &e)
+		}
+		e.requested = e.host
+		if public != nil {
+			e.scheme, e.host, e.prefix = public.Scheme, public.Host, strings.TrimSuffix(public.Path, "/")
+		}
+		if pathPrefix != "" {
+			if r.URL.Path != pathPrefix && !strings.HasPrefix(r.URL.Path, pathPrefix+"/") {
+				http.NotFound(w, r)
+				return
+			}
+			u := *r.URL
+			u.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, pathPrefix), "/")
+			u.RawPath = ""
+			r2 := *r
+			r2.URL = &u
+			r = &r2
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), externalURLKey, e)))
+	}), nil
+}
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrusted(trusted []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//requestURL describes the request as received, ignoring any forwarded header
+func requestURL(r *http.Request) externalURL {
+	e := externalURL{scheme: "https", host: r.Host, clientIP: r.RemoteAddr, requested: r.Host}
+	if r.TLS == nil {
+		e.scheme = "http"
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.clientIP = host
+	}
+	return e
+}
+
+//forwarded updates e with the headers set by trusted reverse proxies. Forwarded (RFC 7239) takes precedence over
+//the X-Forwarded-* headers. The scheme and host are those seen by the outermost proxy, while the client IP is the
+//rightmost address of the chain not belonging to a trusted proxy
+func forwarded(r *http.Request, trusted []*net.IPNet, e *externalURL) {
+	var chain []string
+	if elements := forwardedElements(r.Header.Values("Forwarded")); len(elements) > 0 {
+		if proto := elements[0]["proto"]; proto == "http" || proto == "https" {
+			e.scheme = proto
+		}
+		if host := elements[0]["host"]; host != "" {
+			e.host = host
+		}
+		for _, element := range elements {
+			if addr := element["for"]; addr != "" {
+				chain = append(chain, addr)
+			}
+		}
+	} else {
+		if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			e.scheme = proto
+		}
+		if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+			e.host = host
+		}
+		for _, values := range r.Header.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(values, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+	}
+	if prefix := strings.TrimSuffix(firstValue(r.Header.Get("X-Forwarded-Prefix")), "/"); strings.HasPrefix(prefix, "/") {
+		e.prefix = prefix + e.prefix
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := stripPort(chain[i])
+		if net.ParseIP(ip) == nil {
+			//obfuscated or unknown identifiers end the chain
+			break
+		}
+		e.clientIP = ip
+		if !isTrusted(trusted, ip) {
+			break
+		}
+	}
+}
+
+func firstValue(header string) string {
+	return strings.TrimSpace(strings.Split(header, ",")[0])
+}
+
+//forwardedElements parses the elements of RFC 7239 Forwarded headers into lowercase key/value pairs
+func forwardedElements(headers []string) []map[string]string {
+	var elements []map[string]string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			pairs := make(map[string]string)
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				pairs[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+			elements = append(elements, pairs)
+		}
+	}
+	return elements
+}
+
+//stripPort removes the port and IPv6 brackets from a forwarded node identifier
+func stripPort(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.Trim(node, "[]")
+}
+
+//external returns how the client issuing the request reaches the proxy
+func external(r *http.Request) externalURL {
+	if e, ok := r.Context().Value(externalURLKey).(externalURL); ok {
+		return e
+	}
+	return requestURL(r)
+}
+
+//externalPath prepends the path prefix clients reach the proxy with to the supplied path
+func externalPath(path string, r *http.Request) string {
+	return external(r).prefix + path
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+//resolveThrough returns the login URL resolved for the request, along with the path and client IP seen by handlers
+func resolveThrough(t *testing.T, c config.ProgramConfig, r *http.Request) (string, string, string) {
+	var resolved, path, ip string
+	handler, err := ExternalURL(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolved, path, ip = resolve(GoogleOAuthLoginPath, r), r.URL.Path, clientIP(r)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	return resolved, path, ip
+}
+
+func forwardedRequest(remoteAddr string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest("GET", "http://internal:8080/b1/key", nil)
+	r.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestForwardedHeadersFromTrustedProxies(t *testing.T) {
+	var c config.ProgramConfig
+	c.Web.TrustedProxies = []string{"10.0.0.0/8"}
+	xForwarded := map[string]string{
+		"X-Forwarded-Proto":  "https",
+		"X-Forwarded-Host":   "files.example.com",
+		"X-Forwarded-Prefix": "/docs",
+		"X-Forwarded-For":    "203.0.113.7, 10.1.1.1",
+	}
+	for _, test := range []struct {
+		remoteAddr string
+		headers    map[string]string
+		resolved   string
+		ip         string
+	}{
+		{"10.0.0.1:1234", xForwarded, "https://files.example.com/docs" + GoogleOAuthLoginPath, "203.0.113.7"},
+		{"192.0.2.1:1234", xForwarded, "http://internal:8080" + GoogleOAuthLoginPath, "192.0.2.1"},
+		{"10.0.0.1:1234", map[string]string{
+			"Forwarded": `for="[2001:db8::1]:4711";proto=https;host=files.example.com, for=10.2.2.2`,
+		}, "https://files.example.com" + GoogleOAuthLoginPath, "2001:db8::1"},
+	} {
+		resolved, _, ip := resolveThrough(t, c, forwardedRequest(test.remoteAddr, test.headers))
+		if resolved != test.resolved || ip != test.ip {
+			t.Errorf("Unexpected URL %s and client IP %s from %s", resolved, ip, test.remoteAddr)
+		}
+	}
+}
+
+func TestPublicURLAndPathPrefix(t *testing.T) {
+	var c config.ProgramConfig
+	c.Web.PublicURL = "https://files.example.com/docs/"
+	c.Web.PathPrefix = "/docs"
+
+	resolved, path, _ := resolveThrough(t, c, httptest.NewRequest("GET", "http://internal:8080/docs/b1/key", nil))
+	if resolved != "https://files.example.com/docs"+GoogleOAuthLoginPath || path != "/b1/key" {
+		t.Errorf("Unexpected URL %s and path %s", resolved, path)
+	}
+
+	handler, err := ExternalURL(c, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://internal:8080/b1/key", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code %d outside of the path prefix", w.Code)
+	}
+}
+
+func TestConfiguredCallbackURL(t *testing.T) {
+	var c config.ProgramConfig
+	c.Web.OAuth.CallbackURL = "https://files.example.com/auth/google/callback"
+	w := httptest.NewRecorder()
+	Handlers(c).Login(w, httptest.NewRequest("GET", "http://internal:8080"+GoogleOAuthLoginPath, nil))
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirectURI := loc.Query().Get("redirect_uri"); redirectURI != c.Web.OAuth.CallbackURL {
+		t.Errorf("Unexpected redirect URI %s", redirectURI)
+	}
+	if !strings.HasPrefix(loc.String(), "https://accounts.google.com/") {
+		t.Errorf("Unexpected location %s", loc)
+	}
+}
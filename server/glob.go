@@ -0,0 +1,40 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+//globRegexp translates a glob pattern into an anchored regular expression: `**` matches any sequence of characters,
+//`*` any sequence not containing a path separator and `?` a single character other than a separator. The text
+//matched by each wildcard is captured as a group
+func globRegexp(pattern string) *regexp.Regexp {
+	return separatedGlobRegexp(pattern, '/')
+}
+
+//separatedGlobRegexp translates a glob pattern like globRegexp, with `*` and `?` not matching the supplied separator.
+//A 0 separator makes `*` equivalent to `**`
+func separatedGlobRegexp(pattern string, separator byte) *regexp.Regexp {
+	segment, char := "(.*)", "(.)"
+	if separator != 0 {
+		not := regexp.QuoteMeta(string(separator))
+		segment, char = "([^"+not+"]*)", "([^"+not+"])"
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			b.WriteString("(.*)")
+			i++
+		case c == '*':
+			b.WriteString(segment)
+		case c == '?':
+			b.WriteString(char)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"mime"
+	"path"
+	"regexp"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+type headerRule struct {
+	config.HeaderRule
+	path *regexp.Regexp
+}
+
+func compileHeaderRules(rules []config.HeaderRule) []headerRule {
+	compiled := make([]headerRule, 0, len(rules))
+	for _, rule := range rules {
+		c := headerRule{HeaderRule: rule}
+		if rule.Path != "" {
+			c.path = globRegexp(rule.Path)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled
+}
+
+func (rule headerRule) matches(alias, key string, meta store.ObjectMetadata) bool {
+	if rule.Alias != "" && rule.Alias != alias {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(key) {
+		return false
+	}
+	if rule.ContentType != "" {
+		contentType, _, err := mime.ParseMediaType(meta.ContentType())
+		if err != nil {
+			return false
+		}
+		if ok, _ := path.Match(rule.ContentType, contentType); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//applyHeaderRules overrides the object headers with the values set by the first matching rule
+func applyHeaderRules(rules []headerRule, alias, key string, meta store.ObjectMetadata, headers map[string]string) {
+	for _, rule := range rules {
+		if !rule.matches(alias, key, meta) {
+			continue
+		}
+		for name, value := range map[string]string{
+			"Cache-Control":       rule.CacheControl,
+			"Content-Encoding":    rule.ContentEncoding,
+			"Content-Language":    rule.ContentLanguage,
+			"Content-Disposition": rule.ContentDisposition,
+		} {
+			if value != "" {
+				headers[name] = value
+			}
+		}
+		return
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+func serveWithHeaderRules(path string, rules []config.HeaderRule) *http.Response {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {
+			"assets/app.3f2a.js":  dummyObject{contentType: "application/javascript", body: "x", cacheControl: "no-store"},
+			"reports/latest/q.js": dummyObject{contentType: "application/javascript", body: "x", cacheControl: "public, max-age=60"},
+			"reports/q3.html":     dummyObject{contentType: "text/html; charset=utf-8", body: "x"},
+		},
+	}
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &dummyObjectStore{byBucket: objectsByBucket}, WithHeaderRules(rules))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path, nil))
+	return w.Result()
+}
+
+func TestObjectCacheControlIsPropagated(t *testing.T) {
+	resp := serveWithHeaderRules("/b1/reports/latest/q.js", nil)
+	if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("Unexpected Cache-Control %s", cc)
+	}
+}
+
+func TestFirstMatchingHeaderRuleApplies(t *testing.T) {
+	rules := []config.HeaderRule{
+		{Alias: "other", CacheControl: "private"},
+		{Alias: "b1", Path: "assets/**", CacheControl: "public, max-age=31536000, immutable"},
+		{Path: "**", CacheControl: "no-cache"},
+	}
+	resp := serveWithHeaderRules("/b1/assets/app.3f2a.js", rules)
+	if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("Unexpected Cache-Control %s", cc)
+	}
+	resp = serveWithHeaderRules("/b1/reports/latest/q.js", rules)
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Unexpected Cache-Control %s", cc)
+	}
+}
+
+func TestHeaderRuleByContentType(t *testing.T) {
+	rules := []config.HeaderRule{
+		{Path: "reports/*", ContentType: "text/html", ContentDisposition: "attachment", ContentLanguage: "en"},
+	}
+	resp := serveWithHeaderRules("/b1/reports/q3.html", rules)
+	if cd := resp.Header.Get("Content-Disposition"); cd != "attachment" {
+		t.Errorf("Unexpected Content-Disposition %s", cd)
+	}
+	if cl := resp.Header.Get("Content-Language"); cl != "en" {
+		t.Errorf("Unexpected Content-Language %s", cl)
+	}
+	resp = serveWithHeaderRules("/b1/reports/latest/q.js", rules)
+	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+		t.Errorf("Unexpected Content-Disposition %s", cd)
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	for pattern, matches := range map[string]map[string]bool{
+		"assets/*.js":   {"assets/app.js": true, "assets/vendor/app.js": false},
+		"assets/**":     {"assets/app.js": true, "assets/vendor/app.js": true, "other/app.js": false},
+		"**/latest/*":   {"reports/latest/q.html": true, "latest/q.html": false},
+		"report-?.html": {"report-1.html": true, "report-10.html": false},
+	} {
+		re := globRegexp(pattern)
+		for name, expected := range matches {
+			if re.MatchString(name) != expected {
+				t.Errorf("Expected %s matching %s to be %v", pattern, name, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/store"
+	"github.com/afiore/gcs-proxy/version"
+)
+
+//HealthzPath, ReadyzPath and VersionPath are the canonical paths of the probe and build info handlers
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	VersionPath = "/version"
+)
+
+//storeCheckInterval is how long the outcome of a bucket reachability check is reused
+const storeCheckInterval = 30 * time.Second
+const storeCheckTimeout = 5 * time.Second
+
+//googleDiscoveryURL is the OpenID Connect discovery document of Google's OAuth endpoints. Readiness checks that it
+//can be loaded, reusing the outcome for discoveryCheckInterval
+const googleDiscoveryURL = "https://accounts.google.com/.well-known/openid-configuration"
+const discoveryCheckInterval = 30 * time.Second
+const discoveryCheckTimeout = 5 * time.Second
+
+//Health serves the liveness, readiness and build info endpoints. These bypass session validation
+type Health struct {
+	config  func() config.ProgramConfig
+	checker store.HealthChecker
+	//shuttingDown is set to 1 once the server starts draining connections
+	shuttingDown int32
+	//draining is set to 1 while an operator keeps the instance out of rotation
+	draining int32
+
+	mu             sync.Mutex
+	checkedAt      time.Time
+	checkedBuckets []string
+	storeErr       error
+	now            func() time.Time
+
+	discoveryURL string
+	client       *http.Client
+	discoveryMu  sync.Mutex
+	discoveredAt time.Time
+	discoveryErr error
+}
+
+//NewHealth constructs the health endpoints, checking the buckets and OAuth settings of the configuration currently
+//in effect, as returned by config, and that Google's OpenID Connect discovery document can be loaded. The bucket
+//reachability check is skipped when the store doesn't implement store.HealthChecker
+func NewHealth(config func() config.ProgramConfig, objStore store.ObjectStoreOps) *Health {
+	checker, _ := objStore.(store.HealthChecker)
+	return &Health{
+		config:       config,
+		checker:      checker,
+		now:          time.Now,
+		discoveryURL: googleDiscoveryURL,
+		client:       &http.Client{Timeout: discoveryCheckTimeout},
+	}
+}
+
+//configuredBuckets returns the buckets routed to by the bucket aliases and host routes, sorted and deduplicated
+func configuredBuckets(c config.ProgramConfig) []string {
+	seen := make(map[string]bool)
+	var buckets []string
+	add := func(bucket string) {
+		if !seen[bucket] {
+			seen[bucket] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	for _, bucket := range c.Gcs.Buckets {
+		add(bucket)
+	}
+	for _, route := range c.Gcs.Hosts {
+		add(route.Bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+//ShuttingDown marks the server as not ready, so that load balancers stop routing new requests to it
+func (h *Health) ShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+//SetDraining takes the instance out of rotation, or puts it back, by failing the readiness check. Requests keep
+//being served while draining
+func (h *Health) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&h.draining, v)
+}
+
+//Draining reports whether the instance has been taken out of rotation with SetDraining
+func (h *Health) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+//checkStore verifies that the buckets are reachable, reusing the outcome of recent checks of the same buckets
+func (h *Health) checkStore(ctx context.Context, buckets []string) error {
+	if h.checker == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.checkedAt.IsZero() && h.now().Sub(h.checkedAt) < storeCheckInterval && reflect.DeepEqual(buckets, h.checkedBuckets) {
+		return h.storeErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, storeCheckTimeout)
+	defer cancel()
+	h.storeErr = nil
+	h.checkedBuckets = buckets
+	for _, bucket := range buckets {
+		if err := h.checker.CheckBucket(ctx, bucket); err != nil {
+			h.storeErr = fmt.Errorf("bucket %s: %s", bucket, err.Error())
+			break
+		}
+	}
+	h.checkedAt = h.now()
+	return h.storeErr
+}
+
+//checkDiscovery verifies that the OpenID Connect discovery document can be loaded and lists the authorization and
+//token endpoints, reusing the outcome of recent checks
+func (h *Health) checkDiscovery(ctx context.Context) error {
+	h.discoveryMu.Lock()
+	defer h.discoveryMu.Unlock()
+	if !h.discoveredAt.IsZero() && h.now().Sub(h.discoveredAt) < discoveryCheckInterval {
+		return h.discoveryErr
+	}
+	h.discoveryErr = h.loadDiscovery(ctx)
+	h.discoveredAt = h.now()
+	return h.discoveryErr
+}
+
+func (h *Health) loadDiscovery(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, discoveryCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, h.discoveryURL, nil)
+	if err != nil {
+		return fmt.Errorf("OIDC discovery: %s", err.Error())
+	}
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("OIDC discovery: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC discovery: %s answered %s", h.discoveryURL, resp.Status)
+	}
+	var doc struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("OIDC discovery: %s", err.Error())
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return fmt.Errorf("OIDC discovery: %s lists no authorization or token endpoint", h.discoveryURL)
+	}
+	return nil
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+//Healthz reports that the process is up and serving requests
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+//Readyz reports whether the server is ready to serve objects, answering with 503 when any of its checks fails
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	c := h.config()
+	buckets := configuredBuckets(c)
+	checks := map[string]error{
+		"config":   nil,
+		"store":    h.checkStore(r.Context(), buckets),
+		"oauth":    nil,
+		"shutdown": nil,
+		"drain":    nil,
+	}
+	if len(buckets) == 0 {
+		checks["config"] = fmt.Errorf("no bucket is configured")
+	}
+	if c.Web.OAuth.ClientID == "" || c.Web.OAuth.ClientSecret == "" {
+		checks["oauth"] = fmt.Errorf("OAuth client credentials are not configured")
+	} else {
+		checks["oauth"] = h.checkDiscovery(r.Context())
+	}
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		checks["shutdown"] = fmt.Errorf("shutting down")
+	}
+	if h.Draining() {
+		checks["drain"] = fmt.Errorf("draining")
+	}
+	resp := healthResponse{Status: "ok", Checks: make(map[string]string)}
+	status := http.StatusOK
+	for name, err := range checks {
+		resp.Checks[name] = "ok"
+		if err != nil {
+			resp.Checks[name] = err.Error()
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, resp)
+}
+
+//Version reports the build information of the running binary
+func (h *Health) Version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, version.Info())
+}
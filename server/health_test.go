@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+type checkingStore struct {
+	emptyBucketsStore
+	err    error
+	checks int
+}
+
+func (s *checkingStore) CheckBucket(ctx context.Context, bucket string) error {
+	s.checks++
+	return s.err
+}
+
+//discoveryServer serves a discovery document listing Google's endpoints, counting the requests
+type discoveryServer struct {
+	url      string
+	requests int32
+	broken   int32
+}
+
+func startDiscoveryServer(t *testing.T) *discoveryServer {
+	d := &discoveryServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&d.requests, 1)
+		if atomic.LoadInt32(&d.broken) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": "https://accounts.google.com/o/oauth2/v2/auth",
+			"token_endpoint":         "https://oauth2.googleapis.com/token",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	d.url = srv.URL
+	return d
+}
+
+func testHealth(t *testing.T, objStore *checkingStore) *Health {
+	var c config.ProgramConfig
+	c.Gcs.Buckets = map[string]string{"b1": "bucket1", "b2": "bucket1"}
+	c.Web.OAuth.ClientID = "client-id"
+	c.Web.OAuth.ClientSecret = "client-secret"
+	h := NewHealth(func() config.ProgramConfig { return c }, objStore)
+	h.discoveryURL = startDiscoveryServer(t).url
+	return h
+}
+
+func readiness(t *testing.T, h *Health) (int, healthResponse) {
+	w := httptest.NewRecorder()
+	h.Readyz(w, httptest.NewRequest("GET", ReadyzPath, nil))
+	var body healthResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().StatusCode, body
+}
+
+func TestReadinessCachesStoreChecks(t *testing.T) {
+	objStore := &checkingStore{}
+	h := testHealth(t, objStore)
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if status, body := readiness(t, h); status != http.StatusOK {
+			t.Errorf("Unexpected status code %d: %+v", status, body)
+		}
+	}
+	if objStore.checks != 1 {
+		t.Errorf("Expected the store check to be cached, got %d checks", objStore.checks)
+	}
+
+	objStore.err = errors.New("forbidden")
+	now = now.Add(storeCheckInterval)
+	status, body := readiness(t, h)
+	if status != http.StatusServiceUnavailable || body.Checks["store"] != "bucket bucket1: forbidden" {
+		t.Errorf("Unexpected status code %d: %+v", status, body)
+	}
+}
+
+func TestNotReadyWhileShuttingDown(t *testing.T) {
+	h := testHealth(t, &checkingStore{})
+	h.ShuttingDown()
+	if status, body := readiness(t, h); status != http.StatusServiceUnavailable || body.Checks["shutdown"] == "ok" {
+		t.Errorf("Unexpected status code %d: %+v", status, body)
+	}
+
+	w := httptest.NewRecorder()
+	h.Healthz(w, httptest.NewRequest("GET", HealthzPath, nil))
+	if status := w.Result().StatusCode; status != http.StatusOK {
+		t.Errorf("Unexpected liveness status code %d", status)
+	}
+}
+
+type recordingStore struct {
+	emptyBucketsStore
+	checked []string
+}
+
+func (s *recordingStore) CheckBucket(ctx context.Context, bucket string) error {
+	s.checked = append(s.checked, bucket)
+	return nil
+}
+
+func TestReadinessFollowsTheReloadedConfig(t *testing.T) {
+	var c config.ProgramConfig
+	c.Gcs.Buckets = map[string]string{"b1": "bucket1"}
+	objStore := &recordingStore{}
+	h := NewHealth(func() config.ProgramConfig { return c }, objStore)
+	h.discoveryURL = startDiscoveryServer(t).url
+	if status, body := readiness(t, h); status != http.StatusServiceUnavailable || body.Checks["oauth"] == "ok" {
+		t.Errorf("Unexpected status code %d: %+v", status, body)
+	}
+
+	//the cached store check doesn't cover the buckets added on reload
+	c.Gcs.Buckets = map[string]string{"b1": "bucket1", "b2": "bucket2"}
+	c.Web.OAuth.ClientID = "client-id"
+	c.Web.OAuth.ClientSecret = "client-secret"
+	if status, body := readiness(t, h); status != http.StatusOK {
+		t.Errorf("Unexpected status code %d: %+v", status, body)
+	}
+	if checked := strings.Join(objStore.checked, ","); checked != "bucket1,bucket1,bucket2" {
+		t.Errorf("Unexpected bucket checks %s", checked)
+	}
+}
+
+func TestReadinessCachesDiscoveryChecks(t *testing.T) {
+	h := testHealth(t, &checkingStore{})
+	discovery := startDiscoveryServer(t)
+	h.discoveryURL = discovery.url
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if status, body := readiness(t, h); status != http.StatusOK {
+			t.Errorf("Unexpected status code %d: %+v", status, body)
+		}
+	}
+	if requests := atomic.LoadInt32(&discovery.requests); requests != 1 {
+		t.Errorf("Expected the discovery check to be cached, got %d requests", requests)
+	}
+
+	atomic.StoreInt32(&discovery.broken, 1)
+	now = now.Add(discoveryCheckInterval)
+	status, body := readiness(t, h)
+	if status != http.StatusServiceUnavailable || !strings.Contains(body.Checks["oauth"], "503 Service Unavailable") {
+		t.Errorf("Unexpected status code %d: %+v", status, body)
+	}
+
+	atomic.StoreInt32(&discovery.broken, 0)
+	now = now.Add(discoveryCheckInterval)
+	if status, body := readiness(t, h); status != http.StatusOK {
+		t.Errorf("Unexpected status code %d: %+v", status, body)
+	}
+
+	//a document without the endpoints doesn't count as loaded either
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer empty.Close()
+	h.discoveryURL = empty.URL
+	now = now.Add(discoveryCheckInterval)
+	if status, body := readiness(t, h); status != http.StatusServiceUnavailable || !strings.Contains(body.Checks["oauth"], "no authorization or token endpoint") {
+		t.Errorf("Unexpected status code %d: %+v", status, body)
+	}
+}
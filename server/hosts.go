@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+//subdomainPlaceholder is replaced, in the prefix of wildcard host routes, by the label matched by the wildcard
+const subdomainPlaceholder = "{subdomain}"
+
+//hostRoute is a config.HostRoute prepared for matching
+type hostRoute struct {
+	alias string
+	//host is lowercase and, for wildcard routes, stripped of the leading *.
+	host     string
+	wildcard bool
+	bucket   string
+	prefix   string
+	index    string
+}
+
+//WithHostRoutes makes ServeFromBuckets serve the requests addressed to the hosts of the supplied routes from their
+//bucket, at the root path. Requests for the other hosts keep being resolved through the bucket aliases
+func WithHostRoutes(routes []config.HostRoute) Option {
+	return func(o *options) {
+		o.hosts = compileHostRoutes(routes)
+	}
+}
+
+func compileHostRoutes(routes []config.HostRoute) []hostRoute {
+	compiled := make([]hostRoute, 0, len(routes))
+	for _, route := range routes {
+		h := hostRoute{
+			alias:  route.RouteAlias(),
+			host:   strings.ToLower(route.Host),
+			bucket: route.Bucket,
+			prefix: route.Prefix,
+			index:  route.IndexDocument,
+		}
+		if strings.HasPrefix(h.host, "*.") {
+			h.host, h.wildcard = h.host[2:], true
+			if h.prefix == "" {
+				h.prefix = subdomainPlaceholder + "/"
+			}
+		}
+		compiled = append(compiled, h)
+	}
+	return compiled
+}
+
+//matchHost returns the route bound to the host, along with the subdomain matched by wildcard routes. Exact matches
+//take precedence over wildcard ones
+func matchHost(routes []hostRoute, host string) (hostRoute, string, bool) {
+	var (
+		match     hostRoute
+		subdomain string
+		found     bool
+	)
+	for _, route := range routes {
+		if !route.wildcard {
+			if route.host == host {
+				return route, "", true
+			}
+			continue
+		}
+		label := strings.TrimSuffix(host, "."+route.host)
+		if !found && label != host && label != "" && !strings.Contains(label, ".") {
+			match, subdomain, found = route, label, true
+		}
+	}
+	return match, subdomain, found
+}
+
+//resolveHost maps a request host and path to the route bound to the host, returning its alias along with the bucket
+//and object key. Paths ending with / are completed with the index document of the route, when set. Requests for the
+//root of a route without index document are not resolved
+func resolveHost(routes []hostRoute, host, path string) (alias, bucket, key string, ok bool) {
+	route, subdomain, ok := matchHost(routes, host)
+	if !ok {
+		return "", "", "", false
+	}
+	key = strings.TrimPrefix(path, "/")
+	if route.index != "" && (key == "" || strings.HasSuffix(key, "/")) {
+		key += route.index
+	}
+	if key == "" {
+		return "", "", "", false
+	}
+	return route.alias, route.bucket, strings.Replace(route.prefix, subdomainPlaceholder, subdomain, -1) + key, true
+}
+
+//requestedHost returns the lowercase host name the client addressed the request to, as forwarded by trusted proxies
+//and regardless of the configured public URL, without port
+func requestedHost(r *http.Request) string {
+	host := external(r).requested
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
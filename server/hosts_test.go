@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+func TestResolveHost(t *testing.T) {
+	routes := compileHostRoutes([]config.HostRoute{
+		{Host: "Reports.Example.com", Bucket: "reports", IndexDocument: "index.html"},
+		{Host: "*.pr.example.com", Bucket: "previews"},
+		{Host: "main.pr.example.com", Bucket: "site", Prefix: "main/", Alias: "main"},
+		{Host: "*.docs.example.com", Bucket: "docs", Prefix: "versions/{subdomain}/html/"},
+	})
+	for _, tc := range []struct {
+		host, path         string
+		alias, bucket, key string
+		ok                 bool
+	}{
+		{"reports.example.com", "/q3/summary.pdf", "reports.example.com", "reports", "q3/summary.pdf", true},
+		{"reports.example.com", "/", "reports.example.com", "reports", "index.html", true},
+		{"reports.example.com", "/q3/", "reports.example.com", "reports", "q3/index.html", true},
+		{"42.pr.example.com", "/app.js", "*.pr.example.com", "previews", "42/app.js", true},
+		{"main.pr.example.com", "/app.js", "main", "site", "main/app.js", true},
+		{"v2.docs.example.com", "/intro.html", "*.docs.example.com", "docs", "versions/v2/html/intro.html", true},
+		//wildcards match a single label
+		{"pr.example.com", "/app.js", "", "", "", false},
+		{"a.b.pr.example.com", "/app.js", "", "", "", false},
+		//the root of routes without index document isn't resolved
+		{"42.pr.example.com", "/", "", "", "", false},
+		{"other.example.com", "/b1/key", "", "", "", false},
+	} {
+		alias, bucket, key, ok := resolveHost(routes, tc.host, tc.path)
+		if alias != tc.alias || bucket != tc.bucket || key != tc.key || ok != tc.ok {
+			t.Errorf("%s%s: unexpected resolution %s %s %s %v", tc.host, tc.path, alias, bucket, key, ok)
+		}
+	}
+}
+
+func TestHostRoutesCoexistWithAliases(t *testing.T) {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1":  {"key": dummyObject{contentType: "text/plain", body: "from alias"}},
+		"previews": {"42/key": dummyObject{contentType: "text/plain", body: "from host"}},
+	}
+	gcsHandler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &dummyObjectStore{byBucket: objectsByBucket},
+		WithHostRoutes([]config.HostRoute{{Host: "*.pr.example.com", Bucket: "previews"}}))
+	var c config.ProgramConfig
+	c.Web.PublicURL = "https://files.example.com"
+	handler, err := ExternalURL(c, http.HandlerFunc(gcsHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host, path, body string
+	}{
+		{"42.pr.example.com:8080", "/key", "from host"},
+		{"files.example.com", "/b1/key", "from alias"},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if status := w.Result().StatusCode; status != http.StatusOK || string(body) != tc.body {
+			t.Errorf("%s%s: unexpected response %d %s", tc.host, tc.path, status, body)
+		}
+	}
+}
+
+func TestShareLinksAreBoundToTheirHost(t *testing.T) {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"reports":  {"q3.html": dummyObject{contentType: "text/html", body: "public report"}},
+		"payroll":  {"q3.html": dummyObject{contentType: "text/html", body: "payroll"}},
+		"previews": {"42/q3.html": dummyObject{contentType: "text/html", body: "preview"}},
+	}
+	gcsHandler := ServeFromBuckets(map[string]string{}, &dummyObjectStore{byBucket: objectsByBucket},
+		WithHostRoutes([]config.HostRoute{
+			{Host: "reports.example.com", Bucket: "reports"},
+			{Host: "payroll.example.com", Bucket: "payroll"},
+			{Host: "*.pr.example.com", Bucket: "previews"},
+		}))
+	shares := testShareLinks()
+	handler := ValidatingSession([]string{"lenses.io"}, testSecret, gcsHandler, WithShareLinks(shares))
+
+	r := httptest.NewRequest("POST", ShareLinkPath, strings.NewReader(url.Values{"path": {"/q3.html"}}.Encode()))
+	r.Host = "reports.example.com"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	shares.Mint(w, r)
+	var minted shareLinkResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&minted); err != nil {
+		t.Fatal(err)
+	}
+	link, err := url.Parse(minted.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		host   string
+		status int
+	}{
+		{"reports.example.com", http.StatusOK},
+		{"Reports.Example.com:8080", http.StatusOK},
+		{"payroll.example.com", http.StatusForbidden},
+		{"42.pr.example.com", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", link.RequestURI(), nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		handler(w, r)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		if status := w.Result().StatusCode; status != tc.status {
+			t.Errorf("%s: unexpected response %d %s", tc.host, status, body)
+		}
+	}
+}
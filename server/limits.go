@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+)
+
+const defaultReadHeaderTimeout = 10 * time.Second
+const defaultReadTimeout = time.Minute
+const defaultIdleTimeout = 2 * time.Minute
+const defaultMaxHeaderBytes = 64 * 1024
+const defaultMinThroughputWindow = 30 * time.Second
+
+//NewHTTPServer constructs a server listening on addr with the timeouts and header size limit set in the configuration
+func NewHTTPServer(addr string, handler http.Handler, c config.ProgramConfig) *http.Server {
+	l := c.Web.Limits
+	withDefault := func(d config.Duration, def time.Duration) time.Duration {
+		if d.Duration <= 0 {
+			return def
+		}
+		return d.Duration
+	}
+	maxHeaderBytes := l.MaxHeaderBytes
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = defaultMaxHeaderBytes
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: withDefault(l.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       withDefault(l.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      l.WriteTimeout.Duration,
+		IdleTimeout:       withDefault(l.IdleTimeout, defaultIdleTimeout),
+		MaxHeaderBytes:    maxHeaderBytes,
+		ConnContext:       ConnContext,
+	}
+}
+
+//ConnContext makes the connection serving a request available to its handlers, so that stalled transfers can be
+//interrupted. It is meant to be set as the ConnContext of a http.Server
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey, c)
+}
+
+//WithMinThroughput aborts transfers whose throughput, measured over the supplied window, falls below bytesPerSec
+func WithMinThroughput(bytesPerSec int64, window time.Duration) Option {
+	return func(o *options) {
+		if window <= 0 {
+			window = defaultMinThroughputWindow
+		}
+		o.minThroughput = bytesPerSec
+		o.throughputWindow = window
+	}
+}
+
+//guardChunkSize bounds the writes going through a throughputGuard, so that progress is counted while large buffers,
+//such as cached objects, are being sent
+const guardChunkSize = 32 * 1024
+
+//throughputGuard counts the bytes written through it, interrupting the transfer when too few are written in a window
+type throughputGuard struct {
+	w       io.Writer
+	written int64
+}
+
+func (g *throughputGuard) Write(b []byte) (int, error) {
+	var total int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > guardChunkSize {
+			chunk = chunk[:guardChunkSize]
+		}
+		n, err := g.w.Write(chunk)
+		atomic.AddInt64(&g.written, int64(n))
+		total += n
+		if err != nil {
+			return total, err
+		}
+		b = b[n:]
+	}
+	return total, nil
+}
+
+//guardThroughput wraps w in a throughputGuard. The returned context is canceled, and the connection write deadline
+//expired, once the throughput drops below the minimum. The returned function must be called when the transfer ends
+func guardThroughput(ctx context.Context, w io.Writer, minBytesPerSec int64, window time.Duration) (context.Context, *throughputGuard, func()) {
+	g := &throughputGuard{w: w}
+	if minBytesPerSec <= 0 {
+		return ctx, g, func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	minBytes := int64(float64(minBytesPerSec) * window.Seconds())
+	go func() {
+		ticker := time.NewTicker(window)
+		defer ticker.Stop()
+		var last int64
+		for {
+			select {
+			case <-ticker.C:
+				written := atomic.LoadInt64(&g.written)
+				if written-last >= minBytes {
+					last = written
+					continue
+				}
+				logging.Warnf("aborting transfer after %d bytes: less than %d bytes written in %s", written, minBytes, window)
+				if conn, ok := ctx.Value(connKey).(net.Conn); ok {
+					conn.SetWriteDeadline(time.Now())
+				}
+				cancel()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ctx, g, func() {
+		close(done)
+		cancel()
+	}
+}
+
+//Limited caps the requests handled concurrently, overall and per client IP, answering with 503 once saturated.
+//A limit of 0 disables the corresponding cap
+func Limited(maxInFlight, maxInFlightPerIP int, next http.Handler) http.Handler {
+	if maxInFlight <= 0 && maxInFlightPerIP <= 0 {
+		return next
+	}
+	var mu sync.Mutex
+	inFlight := 0
+	byIP := make(map[string]int)
+	release := func(ip string) {
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight--
+		if byIP[ip]--; byIP[ip] == 0 {
+			delete(byIP, ip)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		mu.Lock()
+		if (maxInFlight > 0 && inFlight >= maxInFlight) || (maxInFlightPerIP > 0 && byIP[ip] >= maxInFlightPerIP) {
+			mu.Unlock()
+			logging.Warnf("rejecting request from %s: too many requests in flight", ip)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests in flight, please retry later", http.StatusServiceUnavailable)
+			return
+		}
+		inFlight++
+		byIP[ip]++
+		mu.Unlock()
+		defer release(ip)
+		next.ServeHTTP(w, r)
+	})
+}
+
+//clientIP returns the IP address of the client issuing the request
+func clientIP(r *http.Request) string {
+	return external(r).clientIP
+}
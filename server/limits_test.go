@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInFlightLimitPerIP(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := Limited(0, 1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientIP(r) == "10.0.0.1" {
+			close(started)
+			<-release
+		}
+	}))
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/b1/key", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan struct{})
+	go func() {
+		request("10.0.0.1:1234")
+		close(done)
+	}()
+	<-started
+
+	w := request("10.0.0.1:5678")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Unexpected status code %d", w.Code)
+	}
+	if w := request("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status code %d for another client", w.Code)
+	}
+	close(release)
+	<-done
+}
+
+func TestGlobalInFlightLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := Limited(1, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/b1/key", nil))
+	<-started
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/b1/key", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status code %d", w.Code)
+	}
+	close(release)
+}
+
+//stallingStore writes the first bytes of the object, then stalls until the context is canceled
+type stallingStore struct {
+	dummyObjectStore
+}
+
+func (s *stallingStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	n, _ := io.WriteString(w, "con")
+	select {
+	case <-ctx.Done():
+		return int64(n), ctx.Err()
+	case <-time.After(5 * time.Second):
+		return int64(n), nil
+	}
+}
+
+func TestStalledTransferIsAborted(t *testing.T) {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"key": dummyObject{contentType: "text/plain", body: "content"}},
+	}
+	objStore := &stallingStore{dummyObjectStore{byBucket: objectsByBucket}}
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore, WithMinThroughput(1024, 50*time.Millisecond))
+
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("Expected the transfer to be aborted, got %v", p)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("The stalled transfer took %s to be aborted", elapsed)
+		}
+	}()
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/b1/key", nil))
+}
+
+//chunkRecorder records the size of the writes it receives
+type chunkRecorder struct {
+	sizes []int
+}
+
+func (c *chunkRecorder) Write(b []byte) (int, error) {
+	c.sizes = append(c.sizes, len(b))
+	return len(b), nil
+}
+
+func TestThroughputGuardSplitsLargeWrites(t *testing.T) {
+	var rec chunkRecorder
+	_, guard, stop := guardThroughput(context.Background(), &rec, 1024, time.Minute)
+	defer stop()
+	n, err := guard.Write(make([]byte, 8*guardChunkSize+1))
+	if err != nil || n != 8*guardChunkSize+1 || guard.written != int64(n) {
+		t.Fatalf("Unexpected write %d %v, %d bytes counted", n, err, guard.written)
+	}
+	if len(rec.sizes) != 9 || rec.sizes[0] != guardChunkSize || rec.sizes[8] != 1 {
+		t.Errorf("Unexpected chunks %v", rec.sizes)
+	}
+}
+
+//panickingStore panics while copying the object
+type panickingStore struct {
+	dummyObjectStore
+}
+
+func (s *panickingStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	panic("boom")
+}
+
+func TestPanickingTransferIsUntracked(t *testing.T) {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"key": dummyObject{contentType: "text/plain", body: "content"}},
+	}
+	transfers := NewTransfers()
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &panickingStore{dummyObjectStore{byBucket: objectsByBucket}},
+		WithTransferTracker(transfers), WithMinThroughput(1024, time.Minute))
+	func() {
+		defer func() { recover() }()
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/b1/key", nil))
+	}()
+	if n := transfers.Len(); n != 0 {
+		t.Errorf("Expected the transfer to be untracked, got %d in flight", n)
+	}
+}
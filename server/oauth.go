@@ -7,12 +7,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/metrics"
+	"github.com/afiore/gcs-proxy/tracing"
 	"github.com/gorilla/securecookie"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
@@ -30,6 +35,7 @@ const GoogleOAuthLoginPath = "/auth/google/login"
 const GoogleOAuthCallbackPath = "/auth/google/callback"
 
 const userHostedDomainKey = "hostedDomain"
+const userEmailKey = "email"
 
 type sessionValidationResult int
 
@@ -46,6 +52,7 @@ func setSessionCookie(secret string, u userInfo, w http.ResponseWriter) error {
 	signedCookie := securecookie.New([]byte(secret), nil)
 	value := map[string]string{
 		userHostedDomainKey: u.HostedDomain,
+		userEmailKey:        u.Email,
 	}
 	encoded, err := signedCookie.Encode(sessionCookieName, value)
 	if err != nil {
@@ -62,6 +69,15 @@ func setSessionCookie(secret string, u userInfo, w http.ResponseWriter) error {
 
 type userInfo struct {
 	HostedDomain string `json:"hd"`
+	Email        string `json:"email"`
+}
+
+//identity returns the best available identifier for the user
+func (u userInfo) identity() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return u.HostedDomain
 }
 
 func userInfoFromSessionCookie(secret string, r *http.Request) (userInfo, error) {
@@ -75,25 +91,23 @@ func userInfoFromSessionCookie(secret string, r *http.Request) (userInfo, error)
 	if err = signedCookie.Decode(sessionCookieName, cookie.Value, &value); err == nil {
 		hostedDomain, ok := value[userHostedDomainKey]
 		if ok {
-			u = userInfo{HostedDomain: hostedDomain}
+			u = userInfo{HostedDomain: hostedDomain, Email: value[userEmailKey]}
 		}
 	}
 	return u, err
 }
 
+//resolve returns the absolute URL of the supplied path, as reached by the client issuing the request
 func resolve(path string, r *http.Request) string {
-	scheme := "https"
-	if r.TLS == nil {
-		scheme = "http"
-	}
-	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+	e := external(r)
+	return fmt.Sprintf("%s://%s%s%s", e.scheme, e.host, e.prefix, path)
 }
 
-func validateSession(validDomains []string, sessionSecret string, r *http.Request) (sessionValidationResult, error) {
+func validateSession(validDomains []string, sessionSecret string, r *http.Request) (sessionValidationResult, userInfo, error) {
 	result := invalid
 	u, err := userInfoFromSessionCookie(sessionSecret, r)
 	if err != nil {
-		return noCookie, nil
+		return noCookie, u, nil
 	}
 	for _, domain := range validDomains {
 		if domain == u.HostedDomain {
@@ -101,35 +115,86 @@ func validateSession(validDomains []string, sessionSecret string, r *http.Reques
 			break
 		}
 	}
-	return result, nil
+	return result, u, nil
+}
+
+//SessionOption customises the behaviour of ValidatingSession
+type SessionOption func(*sessionOptions)
+
+type sessionOptions struct {
+	shares   *ShareLinks
+	sessions *Sessions
+}
+
+//WithShareLinks makes ValidatingSession accept links minted by the supplied ShareLinks in place of a session cookie
+func WithShareLinks(shares *ShareLinks) SessionOption {
+	return func(o *sessionOptions) {
+		o.shares = shares
+	}
 }
 
 //ValidatingSession validates the session cookie redirecting to /auth/google/login if this is missing
-func ValidatingSession(allowedHostDomains []string, sessionSecret string, handler http.HandlerFunc) http.HandlerFunc {
+func ValidatingSession(allowedHostDomains []string, sessionSecret string, handler http.HandlerFunc, opts ...SessionOption) http.HandlerFunc {
+	var o sessionOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		result, err := validateSession(allowedHostDomains, sessionSecret, r)
+		ctx, span := tracing.Tracer().Start(r.Context(), "ValidatingSession")
+		defer span.End()
+		r = r.WithContext(ctx)
+		if token := r.URL.Query().Get(shareQueryParam); token != "" && o.shares != nil {
+			claims, err := o.shares.authorize(token, r)
+			if err != nil {
+				recordAuthOutcome(span, "share_link_rejected")
+				logging.Warnf("rejecting share link for %s: %v", r.URL.Path, err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			recordAuthOutcome(span, "share_link")
+			logging.SetUser(r.Context(), "share:"+claims.ID)
+			o.sessions.seen("share:"+claims.ID, true)
+			handler(w, withUser(withShareGrant(r, claims), "share:"+claims.ID))
+			return
+		}
+		result, u, err := validateSession(allowedHostDomains, sessionSecret, r)
 		if err != nil {
-			log.Fatal(err)
+			recordAuthOutcome(span, "error")
+			logging.Errorf("cannot validate session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
 		switch result {
 		case valid:
-			handler(w, r)
+			recordAuthOutcome(span, "valid_session")
+			logging.SetUser(r.Context(), u.identity())
+			o.sessions.seen(u.identity(), false)
+			handler(w, withUser(r, u.identity()))
 		case invalid:
+			recordAuthOutcome(span, "invalid_session")
+			logging.SetUser(r.Context(), u.identity())
 			http.Error(w, "Forbidden", http.StatusForbidden)
 		case noCookie:
+			recordAuthOutcome(span, "no_session")
 			//set a cookie to preserve the original target path across serveral requests
 			targetPathCookie := http.Cookie{
 				Name:  loginTargetCookieName,
 				Path:  "/",
-				Value: r.RequestURI,
+				Value: externalPath(r.URL.RequestURI(), r),
 			}
-			log.Printf("setting %s cookie to: %s. Request: %v", loginTargetCookieName, r.RequestURI, r.URL)
+			logging.Debugf("redirecting unauthenticated request for %s to login", r.URL.Path)
 			http.SetCookie(w, &targetPathCookie)
 			http.Redirect(w, r, resolve(GoogleOAuthLoginPath, r), http.StatusTemporaryRedirect)
 		}
 	}
 }
 
+//recordAuthOutcome counts the outcome of a session validation, annotating its span
+func recordAuthOutcome(span trace.Span, outcome string) {
+	metrics.AuthOutcomes.WithLabelValues(outcome).Inc()
+	span.SetAttributes(attribute.String("auth.outcome", outcome))
+}
+
 //GoogleOAuthHandlers provides server handlers for Google OAuth2 login and callback
 type GoogleOAuthHandlers struct {
 	Login    func(w http.ResponseWriter, r *http.Request)
@@ -153,8 +218,12 @@ func generateStateOauthCookie(w http.ResponseWriter) string {
 // Implementation is adapted from https://dev.to/douglasmakey/oauth2-example-with-go-3n8a
 func Handlers(c config.ProgramConfig) GoogleOAuthHandlers {
 	googleOauthConfig := func(r *http.Request) oauth2.Config {
+		redirectURL := c.Web.OAuth.CallbackURL
+		if redirectURL == "" {
+			redirectURL = resolve(GoogleOAuthCallbackPath, r)
+		}
 		return oauth2.Config{
-			RedirectURL:  resolve(GoogleOAuthCallbackPath, r),
+			RedirectURL:  redirectURL,
 			ClientID:     c.Web.OAuth.ClientID,
 			ClientSecret: c.Web.OAuth.ClientSecret,
 			Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
@@ -162,13 +231,17 @@ func Handlers(c config.ProgramConfig) GoogleOAuthHandlers {
 		}
 	}
 
-	getUserData := func(config *oauth2.Config, code string) (userInfo, error) {
+	getUserData := func(ctx context.Context, config *oauth2.Config, code string) (userInfo, error) {
 		var u userInfo
-		token, err := config.Exchange(context.Background(), code)
+		token, err := config.Exchange(ctx, code)
 		if err != nil {
 			return u, fmt.Errorf("code exchange wrong: %s", err.Error())
 		}
-		response, err := http.Get(oauthGoogleURLAPI + token.AccessToken)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, oauthGoogleURLAPI+token.AccessToken, nil)
+		if err != nil {
+			return u, fmt.Errorf("failed getting user info: %s", err.Error())
+		}
+		response, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return u, fmt.Errorf("failed getting user info: %s", err.Error())
 		}
@@ -177,8 +250,11 @@ func Handlers(c config.ProgramConfig) GoogleOAuthHandlers {
 		if err != nil {
 			return u, fmt.Errorf("failed read response: %s", err.Error())
 		}
+		if response.StatusCode != http.StatusOK {
+			return u, fmt.Errorf("failed getting user info: unexpected status %d", response.StatusCode)
+		}
 		if err := json.Unmarshal(contents, &u); err != nil {
-			log.Fatal(err)
+			return u, fmt.Errorf("failed parsing user info: %s", err.Error())
 		}
 
 		return u, nil
@@ -200,30 +276,44 @@ func Handlers(c config.ProgramConfig) GoogleOAuthHandlers {
 
 	callback := func(w http.ResponseWriter, r *http.Request) {
 		// Read oauthState from Cookie
-		oauthState, _ := r.Cookie("oauthstate")
+		oauthState, err := r.Cookie("oauthstate")
 		config := googleOauthConfig(r)
 
-		if r.FormValue("state") != oauthState.Value {
-			log.Println("invalid oauth google state")
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		if err != nil || r.FormValue("state") != oauthState.Value {
+			metrics.AuthOutcomes.WithLabelValues("login_invalid_state").Inc()
+			logging.Warnf("invalid oauth google state")
+			http.Redirect(w, r, externalPath("/", r), http.StatusTemporaryRedirect)
 			return
 		}
 
-		userData, err := getUserData(&config, r.FormValue("code"))
+		ctx, span := tracing.Tracer().Start(r.Context(), "OAuthCodeExchange")
+		userData, err := getUserData(ctx, &config, r.FormValue("code"))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
 		if err != nil {
-			log.Println(err.Error())
+			metrics.AuthOutcomes.WithLabelValues("login_failed").Inc()
+			logging.Errorf("%s", err.Error())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := setSessionCookie(c.Web.OAuth.SessionSecret, userData, w); err != nil {
+			metrics.AuthOutcomes.WithLabelValues("login_failed").Inc()
+			logging.Errorf("cannot set session cookie: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		setSessionCookie(c.Web.OAuth.SessionSecret, userData, w)
+		metrics.AuthOutcomes.WithLabelValues("login").Inc()
 
 		cookie, err := r.Cookie(loginTargetCookieName)
 		if err != nil {
-			log.Printf("cookie not found: %v", err)
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			logging.Debugf("cookie not found: %v", err)
+			http.Redirect(w, r, externalPath("/", r), http.StatusTemporaryRedirect)
 		} else {
 
-			log.Printf("found cookie %s. Value: %s", loginTargetCookieName, cookie.Value)
+			logging.Debugf("found cookie %s", loginTargetCookieName)
 			expired := http.Cookie{
 				Value:  "",
 				Path:   "/",
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/afiore/gcs-proxy/logging"
+)
+
+//Recovering recovers from panics raised while serving a request, answering with a 500 when the response hasn't started
+//yet and aborting the connection otherwise. Panics with http.ErrAbortHandler are propagated to abort the connection quietly
+func Recovering(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := newResponseRecorder(rw)
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			logging.Log(logging.Error, "recovered from panic", map[string]interface{}{
+				"path":  r.URL.Path,
+				"panic": fmt.Sprint(p),
+				"stack": string(debug.Stack()),
+			})
+			if w.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
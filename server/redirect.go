@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+const defaultRedirectTTL = 5 * time.Minute
+
+//maxSignedURLTTL is the longest lifetime GCS accepts for V4 signed URLs
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+const bytesPerMB = 1024 * 1024
+
+//redirectPolicyMatches returns true when the object metadata is selected by the supplied policy
+func redirectPolicyMatches(policy config.RedirectPolicy, meta store.ObjectMetadata) bool {
+	if policy.MinSizeMB > 0 && meta.Size() >= policy.MinSizeMB*bytesPerMB {
+		return true
+	}
+	if len(policy.ContentTypes) == 0 {
+		return false
+	}
+	contentType, _, err := mime.ParseMediaType(meta.ContentType())
+	if err != nil {
+		return false
+	}
+	for _, pattern := range policy.ContentTypes {
+		if ok, _ := path.Match(pattern, contentType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func redirectTTL(policy config.RedirectPolicy) time.Duration {
+	if policy.TTL.Duration > 0 {
+		return policy.TTL.Duration
+	}
+	return defaultRedirectTTL
+}
+
+//redirectToSignedURL answers with a 302 to a signed URL valid for ttl, or until notAfter if earlier. HEAD requests
+//get a URL signed for HEAD, as the signature covers the method, and any other request a URL signed for GET
+func redirectToSignedURL(w http.ResponseWriter, r *http.Request, objStore store.ObjectStoreOps, bucket, key string, ttl time.Duration, notAfter time.Time) {
+	signer, ok := objStore.(store.URLSigner)
+	if !ok {
+		logging.Errorf("cannot redirect to %s/%s: store doesn't support signed URLs", bucket, key)
+		http.Error(w, "Signed URLs are not supported", http.StatusNotImplemented)
+		return
+	}
+	if ttl > maxSignedURLTTL {
+		ttl = maxSignedURLTTL
+	}
+	expires := time.Now().Add(ttl)
+	if !notAfter.IsZero() && notAfter.Before(expires) {
+		expires = notAfter
+	}
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	signedURL, err := signer.SignedURL(method, bucket, key, expires)
+	if errors.Is(err, store.ErrNotSupported) {
+		logging.Errorf("cannot redirect to %s/%s: %v", bucket, key, err)
+		http.Error(w, "Signed URLs are not supported", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		logging.Errorf("cannot sign URL for %s/%s: %v", bucket, key, err)
+		http.Error(w, "An internal error has occured", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, signedURL, http.StatusFound)
+}
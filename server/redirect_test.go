@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+func serveWithRedirectPolicy(t *testing.T, path string, policy config.RedirectPolicy) *http.Response {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {
+			"small.txt": dummyObject{contentType: "text/plain", body: "content"},
+			"clip.mp4":  dummyObject{contentType: "video/mp4", body: "not really a video"},
+			"big.bin":   dummyObject{contentType: "application/octet-stream", body: strings.Repeat("x", bytesPerMB)},
+		},
+	}
+	objStore := &signingObjectStore{dummyObjectStore{byBucket: objectsByBucket}}
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore, WithSignedRedirects(map[string]config.RedirectPolicy{
+		"b1": policy,
+	}))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", path, nil))
+	return w.Result()
+}
+
+func TestRedirectPolicyBySize(t *testing.T) {
+	policy := config.RedirectPolicy{MinSizeMB: 1}
+
+	resp := serveWithRedirectPolicy(t, "/b1/big.bin", policy)
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, "https://storage.googleapis.com/bucket1/big.bin") {
+		t.Errorf("Unexpected location %s", loc)
+	}
+
+	resp = serveWithRedirectPolicy(t, "/b1/small.txt", policy)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestRedirectPolicyByContentType(t *testing.T) {
+	policy := config.RedirectPolicy{ContentTypes: []string{"video/*"}}
+
+	if resp := serveWithRedirectPolicy(t, "/b1/clip.mp4", policy); resp.StatusCode != http.StatusFound {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	if resp := serveWithRedirectPolicy(t, "/b1/small.txt", policy); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+//recordingSigner records the last signed URL request, failing it with err when set
+type recordingSigner struct {
+	dummyObjectStore
+	method  string
+	expires time.Time
+	err     error
+}
+
+func (s *recordingSigner) SignedURL(method, bucket, key string, expires time.Time) (string, error) {
+	s.method, s.expires = method, expires
+	if s.err != nil {
+		return "", s.err
+	}
+	return "https://storage.googleapis.com/" + bucket + "/" + key + "?X-Goog-Signature=sig", nil
+}
+
+func TestRedirectToSignedURL(t *testing.T) {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"big.bin": dummyObject{contentType: "application/octet-stream", body: strings.Repeat("x", bytesPerMB)}},
+	}
+	signer := &recordingSigner{dummyObjectStore: dummyObjectStore{byBucket: objectsByBucket}}
+	policies := WithSignedRedirects(map[string]config.RedirectPolicy{
+		"b1": {MinSizeMB: 1, TTL: config.Duration{Duration: time.Hour}},
+	})
+	serve := func(objStore store.ObjectStoreOps, r *http.Request) *http.Response {
+		w := httptest.NewRecorder()
+		ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore, policies)(w, r)
+		return w.Result()
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		start := time.Now()
+		resp := serve(signer, httptest.NewRequest(method, "/b1/big.bin", nil))
+		if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), "https://storage.googleapis.com/bucket1/big.bin") {
+			t.Errorf("%s: unexpected response %d to %s", method, resp.StatusCode, resp.Header.Get("Location"))
+		}
+		if signer.method != method {
+			t.Errorf("%s: URL signed for %s", method, signer.method)
+		}
+		if expires := signer.expires.Sub(start); expires < time.Hour || expires > time.Hour+time.Minute {
+			t.Errorf("%s: URL signed for %s rather than the policy TTL", method, expires)
+		}
+	}
+
+	//share link recipients don't get URLs outliving their link
+	linkExpiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	r := httptest.NewRequest("GET", "/b1/big.bin", nil)
+	r = withShareGrant(r, shareClaims{ID: "link", Host: "example.com", Path: "/b1/big.bin", Expires: linkExpiry.Unix()})
+	if resp := serve(signer, r); resp.StatusCode != http.StatusFound || !signer.expires.Equal(linkExpiry) {
+		t.Errorf("Unexpected response %d, with a URL expiring at %s rather than %s", resp.StatusCode, signer.expires, linkExpiry)
+	}
+
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{errors.New("invalid key"), http.StatusInternalServerError},
+		{store.ErrNotSupported, http.StatusNotImplemented},
+	} {
+		signer.err = tc.err
+		if resp := serve(signer, httptest.NewRequest("GET", "/b1/big.bin", nil)); resp.StatusCode != tc.status {
+			t.Errorf("%v: unexpected status code %d", tc.err, resp.StatusCode)
+		}
+	}
+	if resp := serve(&signer.dummyObjectStore, httptest.NewRequest("GET", "/b1/big.bin", nil)); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Unexpected status code %d without a signing store", resp.StatusCode)
+	}
+}
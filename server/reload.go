@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+//Reloadable serves requests with the most recently installed handler, so that the handlers built from the
+//configuration can be replaced without restarting the listeners. Requests in flight complete on the handler
+//that accepted them
+type Reloadable struct {
+	current atomic.Value
+}
+
+//handlerBox gives atomic.Value a consistent concrete type to store
+type handlerBox struct {
+	http.Handler
+}
+
+//NewReloadable returns a Reloadable serving requests with handler
+func NewReloadable(handler http.Handler) *Reloadable {
+	r := &Reloadable{}
+	r.Swap(handler)
+	return r
+}
+
+//Swap installs the handler serving subsequent requests
+func (r *Reloadable) Swap(handler http.Handler) {
+	r.current.Store(handlerBox{handler})
+}
+
+func (r *Reloadable) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.current.Load().(handlerBox).ServeHTTP(w, req)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReloadableSwapsHandler(t *testing.T) {
+	status := func(code int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		})
+	}
+	handler := NewReloadable(status(http.StatusOK))
+	serve := func() int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/b1/key", nil))
+		return w.Code
+	}
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("Unexpected status code %d", code)
+	}
+	handler.Swap(http.NotFoundHandler())
+	if code := serve(); code != http.StatusNotFound {
+		t.Errorf("Unexpected status code %d after swapping the handler", code)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//Resolver maps paths to bucket objects the way ServeFromBuckets maps request paths, for the tools inspecting the
+//buckets outside of a request, e.g. the object commands
+type Resolver struct {
+	buckets map[string]string
+	o       options
+}
+
+//NewResolver constructs a Resolver applying the host routes and rewrite rules set through opts. The other options
+//don't affect resolution and are ignored
+func NewResolver(bucketByAlias map[string]string, opts ...Option) *Resolver {
+	res := &Resolver{buckets: bucketByAlias}
+	for _, opt := range opts {
+		opt(&res.o)
+	}
+	return res
+}
+
+//request builds a GET request for the path, addressed to host when not empty
+func (res *Resolver) request(host, path string) *http.Request {
+	return &http.Request{Method: http.MethodGet, URL: &url.URL{Path: path}, Host: host, Header: make(http.Header)}
+}
+
+//Resolve maps the path, requested on host when not empty, to its alias, bucket and object key, applying the rewrite
+//rules, host routes and bucket aliases in the same order as the proxy. Paths redirected by a rewrite rule are
+//reported as an error naming the redirect location
+func (res *Resolver) Resolve(host, path string) (alias, bucket, key string, err error) {
+	r, location, _ := res.o.rewrites.rewrite(res.request(host, path))
+	if location != "" {
+		return "", "", "", fmt.Errorf("%s is redirected to %s", path, location)
+	}
+	alias, bucket, key, ok := res.o.resolve(res.buckets, r)
+	if !ok {
+		return "", "", "", fmt.Errorf("no host route or bucket alias matches %s", r.URL.Path)
+	}
+	return alias, bucket, key, nil
+}
+
+//ResolvePrefix maps the path, requested on host when not empty, to its alias, bucket and key prefix. Rewrite rules
+//and index documents, which apply to the requests for objects, are ignored
+func (res *Resolver) ResolvePrefix(host, path string) (alias, bucket, prefix string, err error) {
+	if route, subdomain, ok := matchHost(res.o.hosts, requestedHost(res.request(host, path))); host != "" && ok {
+		routePrefix := strings.Replace(route.prefix, subdomainPlaceholder, subdomain, -1)
+		return route.alias, route.bucket, routePrefix + strings.TrimPrefix(path, "/"), nil
+	}
+	alias, bucket, prefix, ok := ResolveAlias(res.buckets, path)
+	if !ok {
+		return "", "", "", fmt.Errorf("no host route or bucket alias matches %s", path)
+	}
+	return alias, bucket, prefix, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+func TestResolver(t *testing.T) {
+	res := NewResolver(map[string]string{"b1": "bucket1"},
+		WithHostRoutes([]config.HostRoute{
+			{Host: "*.pr.example.com", Bucket: "previews"},
+			{Host: "docs.example.com", Bucket: "docs", Prefix: "site/", IndexDocument: "index.html"},
+		}),
+		WithRewrites(config.Rewrites{Rules: []config.RewriteRule{
+			{Path: "/b1/latest/*", Target: "/b1/releases/v2/$1"},
+			{Path: "/b1/old/**", Target: "/b1/$1", Status: http.StatusFound},
+		}}),
+	)
+	for _, tc := range []struct {
+		host, path, bucket, key string
+	}{
+		{"", "/b1/latest/app.js", "bucket1", "releases/v2/app.js"},
+		{"42.pr.example.com", "/app.js", "previews", "42/app.js"},
+		{"docs.example.com", "/guide/", "docs", "site/guide/index.html"},
+		{"other.example.com", "/b1/key", "bucket1", "key"},
+	} {
+		if _, bucket, key, err := res.Resolve(tc.host, tc.path); err != nil || bucket != tc.bucket || key != tc.key {
+			t.Errorf("%s%s: unexpected resolution %s/%s (%v)", tc.host, tc.path, bucket, key, err)
+		}
+	}
+	for _, path := range []string{"/b1/old/key", "/missing/key"} {
+		if _, _, _, err := res.Resolve("", path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+
+	//prefixes ignore rewrites and index documents
+	for _, tc := range []struct {
+		host, path, bucket, prefix string
+	}{
+		{"", "/b1/latest/", "bucket1", "latest/"},
+		{"docs.example.com", "/guide/", "docs", "site/guide/"},
+		{"42.pr.example.com", "/", "previews", "42/"},
+	} {
+		if _, bucket, prefix, err := res.ResolvePrefix(tc.host, tc.path); err != nil || bucket != tc.bucket || prefix != tc.prefix {
+			t.Errorf("%s%s: unexpected prefix %s/%s (%v)", tc.host, tc.path, bucket, prefix, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/store"
+)
+
+//websiteRedirectKey is the custom metadata redirecting the requests for an object, set through the
+//x-goog-meta-website-redirect-location header
+const websiteRedirectKey = "website-redirect-location"
+
+//rewriteRule is a config.RewriteRule prepared for matching
+type rewriteRule struct {
+	config.RewriteRule
+	path    *regexp.Regexp
+	host    *regexp.Regexp
+	headers map[string]*regexp.Regexp
+	query   map[string]*regexp.Regexp
+}
+
+//rewrites redirects, or rewrites internally, the requests matched by its rules before their object key is resolved
+type rewrites struct {
+	rules           []rewriteRule
+	objectRedirects bool
+}
+
+//WithRewrites makes ServeFromBuckets apply the supplied rewrite rules, and the redirects set in the object metadata
+//when enabled
+func WithRewrites(c config.Rewrites) Option {
+	return func(o *options) {
+		o.rewrites = compileRewrites(c)
+	}
+}
+
+func compileRewrites(c config.Rewrites) *rewrites {
+	rw := &rewrites{objectRedirects: c.ObjectRedirects}
+	for i, rule := range c.Rules {
+		compiled := rewriteRule{RewriteRule: rule}
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				logging.Errorf("skipping rewrite rule %d: %v", i+1, err)
+				continue
+			}
+			compiled.path = re
+		} else {
+			compiled.path = globRegexp(rule.Path)
+		}
+		if rule.Host != "" {
+			compiled.host = separatedGlobRegexp(strings.ToLower(rule.Host), '.')
+		}
+		compiled.headers = compileValueGlobs(rule.Headers)
+		compiled.query = compileValueGlobs(rule.Query)
+		rw.rules = append(rw.rules, compiled)
+	}
+	return rw
+}
+
+func compileValueGlobs(globs map[string]string) map[string]*regexp.Regexp {
+	compiled := make(map[string]*regexp.Regexp, len(globs))
+	for name, glob := range globs {
+		compiled[name] = separatedGlobRegexp(glob, 0)
+	}
+	return compiled
+}
+
+//anyMatches reports whether any of the values matches the glob
+func anyMatches(glob *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if glob.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+//match returns the indexes of the groups captured from the request path, or nil when the rule doesn't apply
+func (rule rewriteRule) match(r *http.Request) []int {
+	if rule.host != nil && !rule.host.MatchString(requestedHost(r)) {
+		return nil
+	}
+	for name, glob := range rule.headers {
+		if !anyMatches(glob, r.Header.Values(name)) {
+			return nil
+		}
+	}
+	if len(rule.query) > 0 {
+		query := r.URL.Query()
+		for name, glob := range rule.query {
+			if !anyMatches(glob, query[name]) {
+				return nil
+			}
+		}
+	}
+	return rule.path.FindStringSubmatchIndex(r.URL.Path)
+}
+
+//apply evaluates the rules in order, answering the request with a redirect or returning it with its path rewritten
+//by the first matching one. It reports whether the request has been answered
+func (rw *rewrites) apply(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	rewritten, location, status := rw.rewrite(r)
+	if location == "" {
+		return rewritten, false
+	}
+	logging.Debugf("redirecting %s to %s", r.URL.Path, location)
+	http.Redirect(w, r, location, status)
+	return r, true
+}
+
+//rewrite evaluates the rules in order, returning the request with its path rewritten by the first matching one or,
+//for redirecting rules, the location to redirect the request to along with the status
+func (rw *rewrites) rewrite(r *http.Request) (*http.Request, string, int) {
+	if rw == nil {
+		return r, "", 0
+	}
+	for _, rule := range rw.rules {
+		groups := rule.match(r)
+		if groups == nil {
+			continue
+		}
+		target := string(rule.path.ExpandString(nil, rule.Target, r.URL.Path, groups))
+		targetPath, targetQuery, hasQuery := target, "", false
+		if i := strings.Index(target, "?"); i >= 0 {
+			targetPath, targetQuery, hasQuery = target[:i], target[i+1:], true
+		}
+		if strings.HasPrefix(targetPath, "/") {
+			//captures starting with / would otherwise turn the target into a protocol relative URL
+			targetPath = "/" + strings.TrimLeft(targetPath, "/")
+		}
+
+		if rule.Status != 0 {
+			location := targetPath
+			if strings.HasPrefix(location, "/") {
+				location = externalPath(location, r)
+			}
+			if hasQuery {
+				location += "?" + targetQuery
+			} else if r.URL.RawQuery != "" {
+				location += "?" + r.URL.RawQuery
+			}
+			return r, location, rule.Status
+		}
+
+		logging.Debugf("rewriting %s to %s", r.URL.Path, targetPath)
+		u := *r.URL
+		u.Path, u.RawPath = targetPath, ""
+		if hasQuery {
+			u.RawQuery = targetQuery
+		}
+		r2 := *r
+		r2.URL = &u
+		return &r2, "", 0
+	}
+	return r, "", 0
+}
+
+//objectRedirect returns the location set in the website-redirect-location metadata of the object, when object
+//redirects are enabled. Locations must be paths, resolved against the external URL of the proxy, or absolute
+//http and https URLs
+func (rw *rewrites) objectRedirect(meta store.ObjectMetadata, r *http.Request) (string, bool) {
+	if rw == nil || !rw.objectRedirects {
+		return "", false
+	}
+	for name, location := range meta.Metadata() {
+		if !strings.EqualFold(name, websiteRedirectKey) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//"):
+			return externalPath(location, r), true
+		case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+			return location, true
+		default:
+			logging.Warnf("ignoring the invalid %s metadata of %s: %q", websiteRedirectKey, r.URL.Path, location)
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+func rewritingHandler(rules []config.RewriteRule) http.HandlerFunc {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {
+			"archive/reports/q3.html": dummyObject{contentType: "text/html", body: "archived q3"},
+			"app-beta/app.js":         dummyObject{contentType: "application/javascript", body: "beta"},
+			"app/app.js":              dummyObject{contentType: "application/javascript", body: "stable"},
+			"legacy/q3.html":          dummyObject{contentType: "text/html", body: "legacy"},
+			"moved.html": dummyObject{contentType: "text/html", body: "moved",
+				metadata: map[string]string{"Website-Redirect-Location": "/b1/archive/reports/q3.html"}},
+			"external.html": dummyObject{contentType: "text/html", body: "external",
+				metadata: map[string]string{"website-redirect-location": "https://example.com/q3"}},
+		},
+	}
+	return ServeFromBuckets(map[string]string{"b1": "bucket1"}, &dummyObjectStore{byBucket: objectsByBucket},
+		WithRewrites(config.Rewrites{Rules: rules, ObjectRedirects: true}))
+}
+
+func TestRewriteRules(t *testing.T) {
+	handler := rewritingHandler([]config.RewriteRule{
+		{Path: "/b1/reports/**", Target: "/b1/archive/reports/$1", Status: http.StatusMovedPermanently},
+		{Path: "/b1/legacy/*", Host: "*.example.com", Target: "https://legacy.example.com/$1", Status: http.StatusFound},
+		{Regex: "^/b1/app/(?P<file>[^/]+)$", Query: map[string]string{"channel": "beta"}, Target: "/b1/app-beta/${file}"},
+		{Path: "/b1/app/*", Headers: map[string]string{"X-Channel": "beta*"}, Target: "/b1/app-beta/$1"},
+		{Path: "/b1/open/**", Target: "/$1", Status: http.StatusFound},
+	})
+	for _, tc := range []struct {
+		host, target, header string
+		status               int
+		location, body       string
+	}{
+		{"files.example.com", "/b1/reports/q3.html?v=2", "", http.StatusMovedPermanently, "/b1/archive/reports/q3.html?v=2", ""},
+		{"files.example.com", "/b1/legacy/q3.html", "", http.StatusFound, "https://legacy.example.com/q3.html", ""},
+		//a single host label is matched by *
+		{"files.internal.example.com", "/b1/legacy/q3.html", "", http.StatusOK, "", "legacy"},
+		{"files.example.com", "/b1/app/app.js?channel=beta", "", http.StatusOK, "", "beta"},
+		{"files.example.com", "/b1/app/app.js", "beta-2", http.StatusOK, "", "beta"},
+		{"files.example.com", "/b1/app/app.js", "", http.StatusOK, "", "stable"},
+		//captures can't turn the target into a protocol relative URL
+		{"files.example.com", "/b1/open//evil.com", "", http.StatusFound, "/evil.com", ""},
+		{"files.example.com", "/b1/moved.html", "", http.StatusMovedPermanently, "/b1/archive/reports/q3.html", ""},
+		{"files.example.com", "/b1/external.html", "", http.StatusMovedPermanently, "https://example.com/q3", ""},
+	} {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		r.Host = tc.host
+		if tc.header != "" {
+			r.Header.Set("X-Channel", tc.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		resp := w.Result()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: unexpected status code %d", tc.target, resp.StatusCode)
+			continue
+		}
+		if location := resp.Header.Get("Location"); location != tc.location {
+			t.Errorf("%s: unexpected location %s", tc.target, location)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); tc.body != "" && string(body) != tc.body {
+			t.Errorf("%s: unexpected body %s", tc.target, body)
+		}
+	}
+}
+
+func TestObjectRedirectsAreOptIn(t *testing.T) {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"moved.html": dummyObject{contentType: "text/html", body: "moved",
+			metadata: map[string]string{websiteRedirectKey: "/b1/new.html"}}},
+	}
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &dummyObjectStore{byBucket: objectsByBucket})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/b1/moved.html", nil))
+	if status := w.Result().StatusCode; status != http.StatusOK {
+		t.Errorf("Unexpected status code %d", status)
+	}
+}
+
+func TestShareLinksCoverTheRewrittenObject(t *testing.T) {
+	gcsHandler := rewritingHandler([]config.RewriteRule{
+		{Path: "/b1/public/**", Target: "/b1/archive/$1"},
+		{Path: "/b1/latest.js", Target: "/b1/app/app.js"},
+	})
+	shares := testShareLinks()
+	handler := ValidatingSession([]string{"lenses.io"}, testSecret, gcsHandler, WithShareLinks(shares))
+	for _, tc := range []struct {
+		form   url.Values
+		target string
+		status int
+	}{
+		//the link covers the requested path, but not the object it is rewritten to
+		{url.Values{"path": {"/b1/public/"}, "prefix": {"true"}}, "/b1/public/reports/q3.html", http.StatusForbidden},
+		{url.Values{"path": {"/b1/"}, "prefix": {"true"}}, "/b1/public/reports/q3.html", http.StatusOK},
+		{url.Values{"path": {"/b1/latest.js"}}, "/b1/latest.js", http.StatusForbidden},
+		{url.Values{"path": {"/b1/app/"}, "prefix": {"true"}}, "/b1/latest.js", http.StatusForbidden},
+	} {
+		link := mintShareLink(t, shares, tc.form)
+		token := link[strings.Index(link, "?"):]
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://example.com"+tc.target+token, nil))
+		if status := w.Result().StatusCode; status != tc.status {
+			t.Errorf("%s with a link for %s: unexpected status code %d", tc.target, tc.form.Get("path"), status)
+		}
+	}
+}
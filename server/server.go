@@ -1,67 +1,223 @@
 package server
 
 import (
-	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/afiore/gcs-proxy/audit"
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"github.com/afiore/gcs-proxy/metrics"
 	"github.com/afiore/gcs-proxy/store"
 )
 
 const welcomeMsg = "<p>You have reached an instance of <a href=\"https://github.com/afiore/gcs-proxy\">GCS Proxy</a></p>"
 
+//Option customises the behaviour of ServeFromBuckets
+type Option func(*options)
+
+type options struct {
+	redirects   map[string]config.RedirectPolicy
+	headerRules []headerRule
+	compression *compression
+	audit       *audit.Log
+	transfers   *Transfers
+	hosts       []hostRoute
+	rewrites    *rewrites
+
+	minThroughput    int64
+	throughputWindow time.Duration
+}
+
+//WithSignedRedirects makes ServeFromBuckets answer with a redirect to a signed URL for objects selected by the policy
+//configured for their bucket alias, rather than streaming their content
+func WithSignedRedirects(policyByAlias map[string]config.RedirectPolicy) Option {
+	return func(o *options) {
+		o.redirects = policyByAlias
+	}
+}
+
+//WithHeaderRules overrides the Cache-Control, Content-Encoding, Content-Language and Content-Disposition headers
+//stored along with the objects matched by the supplied rules
+func WithHeaderRules(rules []config.HeaderRule) Option {
+	return func(o *options) {
+		o.headerRules = compileHeaderRules(rules)
+	}
+}
+
+//WithCompression enables the negotiated gzip and brotli compression of responses
+func WithCompression(c config.Compression) Option {
+	return func(o *options) {
+		o.compression = newCompression(c)
+	}
+}
+
+//ResolveAlias maps a path (e.g. /alias/path/to/key) to the bucket alias making up its first segment, along with the
+//corresponding bucket and object key. The key is empty for the alias root, i.e. /alias or /alias/
+func ResolveAlias(bucketByAlias map[string]string, path string) (alias, bucket, key string, ok bool) {
+	for alias, bucket := range bucketByAlias {
+		root := "/" + alias
+		if path == root {
+			return alias, bucket, "", true
+		}
+		if strings.HasPrefix(path, root+"/") {
+			return alias, bucket, strings.TrimPrefix(path, root+"/"), true
+		}
+	}
+	return "", "", "", false
+}
+
+//resolve maps the request to the host route bound to its host or, failing that, to the bucket alias its path starts with
+func (o *options) resolve(bucketByAlias map[string]string, r *http.Request) (alias, bucket, key string, ok bool) {
+	if len(o.hosts) > 0 {
+		if alias, bucket, key, ok := resolveHost(o.hosts, requestedHost(r), r.URL.Path); ok {
+			return alias, bucket, key, true
+		}
+	}
+	return ResolveAlias(bucketByAlias, r.URL.Path)
+}
+
 //ServeFromBuckets maps incoming requests to bucket objects defined in the supplied configuration
-func ServeFromBuckets(bucketByAlias map[string]string, objStore store.ObjectStoreOps) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		for alias, bucketName := range bucketByAlias {
-			if !strings.HasPrefix(r.URL.Path, "/"+alias) {
-				continue
-			}
-			objectKey := strings.Replace(r.URL.Path, fmt.Sprintf("/%s/", alias), "", 1)
+func ServeFromBuckets(bucketByAlias map[string]string, objStore store.ObjectStoreOps, opts ...Option) func(w http.ResponseWriter, r *http.Request) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		w := newResponseRecorder(rw)
+		start := time.Now()
+		servedAlias := ""
+		defer func() {
+			metrics.ObserveRequest(servedAlias, w.status, w.written, time.Since(start))
+		}()
+
+		r, answered := o.rewrites.apply(w, r)
+		if answered {
+			return
+		}
+		//share links are authorised against the requested path, which rewrites may have pointed to another object
+		if grant, shared := shareGrant(r); shared && !grant.covers(requestedHost(r), r.URL.Path) {
+			logging.Warnf("rejecting share link %s for %s, which it doesn't cover", grant.ID, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 
-			log.Printf("Fetching key: %s from bucket %s", objectKey, bucketName)
+		if alias, bucketName, objectKey, ok := o.resolve(bucketByAlias, r); ok {
+			servedAlias = alias
 
-			meta, err := objStore.GetObjectMetadata(bucketName, objectKey)
+			logging.SetObject(r.Context(), alias, bucketName, objectKey)
+			logging.Debugf("Fetching key: %s from bucket %s", objectKey, bucketName)
 
-			var objNotFoundErr *store.ObjectNotFound
-			if errors.As(err, &objNotFoundErr) {
-				log.Printf("key %s not found in bucket %s", objectKey, bucketName)
-				http.NotFound(w, r)
+			meta, err := objStore.GetObjectMetadata(r.Context(), bucketName, objectKey)
+			if err != nil {
+				writeStoreError(w, err)
 				return
 			}
-			if err != nil {
-				http.Error(w, "An internal error has occured", 500)
+			if location, ok := o.rewrites.objectRedirect(meta, r); ok {
+				logging.Debugf("redirecting %s to %s, as set in the object metadata", r.URL.Path, location)
+				http.Redirect(w, r, location, http.StatusMovedPermanently)
+				return
+			}
+
+			event := audit.Event{Action: audit.Read, Alias: alias, Bucket: bucketName, Key: objectKey}
+			grant, shared := shareGrant(r)
+			if shared && grant.Redirect {
+				redirectToSignedURL(w, r, objStore, bucketName, objectKey, shareRedirectTTL, grant.expiry())
+				auditRedirect(o.audit, r, w, event)
+				return
+			}
+			if policy, ok := o.redirects[alias]; ok && redirectPolicyMatches(policy, meta) {
+				var notAfter time.Time
+				if shared {
+					notAfter = grant.expiry()
+				}
+				redirectToSignedURL(w, r, objStore, bucketName, objectKey, redirectTTL(policy), notAfter)
+				auditRedirect(o.audit, r, w, event)
 				return
 			}
 
-			for k, v := range objectHeaders(meta) {
+			headers := objectHeaders(meta)
+			applyHeaderRules(o.headerRules, alias, objectKey, meta, headers)
+			body := negotiateBody(r, o.compression, objStore, bucketName, objectKey, meta, headers)
+			for k, v := range headers {
 				w.Header().Add(k, v)
 			}
 
-			_, err = objStore.CopyObject(bucketName, objectKey, w)
+			ctx, guard, stopGuard := guardThroughput(r.Context(), w, o.minThroughput, o.throughputWindow)
+			defer stopGuard()
+			done := o.transfers.start(r, alias, bucketName, objectKey, meta.Size(), guard)
+			defer done()
+			written, err := body.copy(ctx, objStore, bucketName, guard)
 			if err != nil {
-				log.Fatal(err)
-			} else {
+				//abortCopy panics once the response has started, hence the deferred audit
+				defer func() {
+					event.Status, event.Bytes, event.Error = w.status, written, err.Error()
+					recordAudit(o.audit, r, event)
+				}()
+				abortCopy(w, r, headers, err)
 				return
 			}
+			event.Status, event.Bytes = w.status, written
+			recordAudit(o.audit, r, event)
+			return
 		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprint(w, welcomeMsg)
+		serveUnrouted(w, r)
 	}
 
 }
 
+//serveUnrouted answers the requests matching neither a host route nor a bucket alias. The root path gets the welcome
+//page, while any other path is answered with 502 Bad Gateway: the proxy has no upstream bucket to forward it to, and
+//serving the welcome page with a 200 would hide mistyped aliases and misconfigured routes from clients and probes
+func serveUnrouted(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Error(w, "No bucket is configured for this path", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, welcomeMsg)
+}
+
+//abortCopy handles a failed object copy. Failures occurring before any byte is written are answered with an
+//error response, while the connection is aborted once the response has started, as its status can't be changed anymore
+func abortCopy(w *responseRecorder, r *http.Request, headers map[string]string, err error) {
+	if !w.wroteHeader {
+		for name := range headers {
+			w.Header().Del(name)
+		}
+		writeStoreError(w, err)
+		return
+	}
+	if r.Context().Err() != nil {
+		logging.Debugf("client went away while copying %s after %d bytes: %v", r.URL.Path, w.written, err)
+	} else {
+		logging.Errorf("aborting response for %s after %d bytes: %v", r.URL.Path, w.written, err)
+	}
+	panic(http.ErrAbortHandler)
+}
+
 func base(key string) string {
 	parts := strings.Split(key, "/")
 	return parts[len(parts)-1]
 }
 
 func objectHeaders(o store.ObjectMetadata) map[string]string {
-	return map[string]string{
+	headers := map[string]string{
 		"Content-Type":   o.ContentType(),
 		"Content-Length": fmt.Sprintf("%d", o.Size()),
 		"Last-Modified":  o.Updated().Format(http.TimeFormat),
 	}
+	for name, value := range map[string]string{
+		"Cache-Control":       o.CacheControl(),
+		"Content-Encoding":    o.ContentEncoding(),
+		"Content-Language":    o.ContentLanguage(),
+		"Content-Disposition": o.ContentDisposition(),
+	} {
+		if value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
 }
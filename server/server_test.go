@@ -1,9 +1,11 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,10 +17,10 @@ import (
 
 type emptyBucketsStore struct{}
 
-func (s *emptyBucketsStore) GetObjectMetadata(bucket, key string) (store.ObjectMetadata, error) {
+func (s *emptyBucketsStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
 	return nil, &store.ObjectNotFound{Bucket: bucket, Key: key}
 }
-func (s *emptyBucketsStore) CopyObject(bucket, key string, w io.Writer) (int64, error) {
+func (s *emptyBucketsStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
 	return 0, &store.ObjectNotFound{Bucket: bucket, Key: key}
 }
 
@@ -40,6 +42,15 @@ func TestBucketNotFound(t *testing.T) {
 	}
 }
 
+func TestRootServesTheWelcomePage(t *testing.T) {
+	w := httptest.NewRecorder()
+	handler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, &emptyBucketsStore{})
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	if resp := w.Result(); resp.StatusCode != http.StatusOK || !strings.Contains(w.Body.String(), "GCS Proxy") {
+		t.Errorf("Unexpected response %d %s", resp.StatusCode, w.Body.String())
+	}
+}
+
 func TestObjectNotFound(t *testing.T) {
 	r, err := http.NewRequest("GET", "/test-alias/some/obj/key", nil)
 	if err != nil {
@@ -61,8 +72,11 @@ func TestObjectNotFound(t *testing.T) {
 }
 
 type dummyObject struct {
-	contentType string
-	body        string
+	contentType  string
+	body         string
+	cacheControl string
+	encoding     string
+	metadata     map[string]string
 }
 
 func (o dummyObject) ContentType() string {
@@ -75,6 +89,24 @@ func (o dummyObject) Size() int64 {
 func (o dummyObject) Updated() time.Time {
 	return time.Now()
 }
+func (o dummyObject) Generation() int64 {
+	return 1
+}
+func (o dummyObject) CacheControl() string {
+	return o.cacheControl
+}
+func (o dummyObject) ContentEncoding() string {
+	return o.encoding
+}
+func (o dummyObject) ContentLanguage() string {
+	return ""
+}
+func (o dummyObject) ContentDisposition() string {
+	return ""
+}
+func (o dummyObject) Metadata() map[string]string {
+	return o.metadata
+}
 
 type dummyObjectStore struct {
 	byBucket map[string]map[string]dummyObject
@@ -92,11 +124,11 @@ func (s *dummyObjectStore) getObject(bucket, key string) (o dummyObject, err err
 	return o, nil
 }
 
-func (s *dummyObjectStore) GetObjectMetadata(bucket, key string) (store.ObjectMetadata, error) {
+func (s *dummyObjectStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
 	return s.getObject(bucket, key)
 }
 
-func (s *dummyObjectStore) CopyObject(bucket, key string, w io.Writer) (int64, error) {
+func (s *dummyObjectStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
 	o, err := s.getObject(bucket, key)
 	written, err := w.Write([]byte(o.body))
 	return int64(written), err
@@ -144,3 +176,26 @@ func TestObjectFoundInBucketAlias(t *testing.T) {
 	}
 
 }
+
+func TestResolveAlias(t *testing.T) {
+	aliases := map[string]string{"b1": "bucket1", "x2": "bucket2"}
+	alias, bucket, key, ok := ResolveAlias(aliases, "/x2/path/to/key")
+	if !ok || alias != "x2" || bucket != "bucket2" || key != "path/to/key" {
+		t.Errorf("Unexpected resolution %s %s %s %v", alias, bucket, key, ok)
+	}
+	if _, _, key, ok := ResolveAlias(aliases, "/b1/"); !ok || key != "" {
+		t.Errorf("Expected the alias root to resolve to an empty key, got %q", key)
+	}
+	if _, _, _, ok := ResolveAlias(aliases, "/other/key"); ok {
+		t.Error("Expected an unknown alias not to resolve")
+	}
+	if _, _, key, ok := ResolveAlias(aliases, "/b1"); !ok || key != "" {
+		t.Errorf("Expected the alias without trailing slash to resolve to an empty key, got %q", key)
+	}
+	if alias, _, key, ok := ResolveAlias(aliases, "/b1x/foo"); ok {
+		t.Errorf("Expected aliases to only match whole path segments, got %s %q", alias, key)
+	}
+	if _, _, key, ok := ResolveAlias(aliases, "/x2/a/x2/b"); !ok || key != "a/x2/b" {
+		t.Errorf("Unexpected key %q", key)
+	}
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/afiore/gcs-proxy/audit"
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+)
+
+//ShareLinkPath is the canonical path for the handler minting share links
+const ShareLinkPath = "/share"
+
+const shareQueryParam = "share"
+const defaultShareTTL = 24 * time.Hour
+const defaultMaxShareTTL = 7 * 24 * time.Hour
+
+//shareRedirectTTL bounds the lifetime of signed URLs handed out to share link recipients,
+//so that a download limited link cannot be turned into a long lived GCS URL
+const shareRedirectTTL = 15 * time.Minute
+
+var errInvalidShareLink = errors.New("invalid share link")
+var errExpiredShareLink = errors.New("share link expired")
+var errExhaustedShareLink = errors.New("share link download limit reached")
+
+type contextKey int
+
+const (
+	shareGrantKey contextKey = iota
+	userKey
+	connKey
+	externalURLKey
+)
+
+type shareClaims struct {
+	ID string `json:"id"`
+	//Host is the host the link was minted for, as host routes map the same path to different buckets
+	Host      string `json:"h"`
+	Path      string `json:"p"`
+	Prefix    bool   `json:"pfx,omitempty"`
+	Expires   int64  `json:"exp"`
+	Downloads int    `json:"n,omitempty"`
+	Redirect  bool   `json:"r,omitempty"`
+}
+
+//covers reports whether the claims grant access to the path on host. Prefix claims only match whole path segments:
+//a link minted for /b1/reports covers /b1/reports/q3.html, but not /b1/reports-private/q3.html
+func (c shareClaims) covers(host, path string) bool {
+	if host != c.Host || !strings.HasPrefix(path, c.Path) {
+		return false
+	}
+	if !c.Prefix {
+		return path == c.Path
+	}
+	return len(path) == len(c.Path) || strings.HasSuffix(c.Path, "/") || path[len(c.Path)] == '/'
+}
+
+func (c shareClaims) expiry() time.Time {
+	return time.Unix(c.Expires, 0)
+}
+
+type shareUsage struct {
+	downloads int
+	expires   time.Time
+}
+
+//ShareLinks mints and verifies HMAC signed links granting unauthenticated, time limited access to an object or prefix
+type ShareLinks struct {
+	settingsMu sync.RWMutex
+	settings   shareSettings
+
+	mu    sync.Mutex
+	usage map[string]shareUsage
+
+	audit *audit.Log
+}
+
+//shareSettings holds the configurable parameters of ShareLinks, which are replaced on reload
+type shareSettings struct {
+	secret     []byte
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+func newShareSettings(c config.ProgramConfig) shareSettings {
+	secret := c.Web.Share.Secret
+	if secret == "" {
+		secret = c.Web.OAuth.SessionSecret
+	}
+	defaultTTL := c.Web.Share.DefaultTTL.Duration
+	if defaultTTL <= 0 {
+		defaultTTL = defaultShareTTL
+	}
+	maxTTL := c.Web.Share.MaxTTL.Duration
+	if maxTTL <= 0 {
+		maxTTL = defaultMaxShareTTL
+	}
+	if defaultTTL > maxTTL {
+		defaultTTL = maxTTL
+	}
+	return shareSettings{secret: []byte(secret), defaultTTL: defaultTTL, maxTTL: maxTTL}
+}
+
+//NewShareLinks constructs ShareLinks from the supplied configuration, recording the minted links in auditLog when not nil
+func NewShareLinks(c config.ProgramConfig, auditLog *audit.Log) *ShareLinks {
+	return &ShareLinks{
+		settings: newShareSettings(c),
+		usage:    make(map[string]shareUsage),
+		audit:    auditLog,
+	}
+}
+
+//Reload applies the share settings of the supplied configuration, keeping the download counters of the minted links
+func (s *ShareLinks) Reload(c config.ProgramConfig) {
+	settings := newShareSettings(c)
+	s.settingsMu.Lock()
+	s.settings = settings
+	s.settingsMu.Unlock()
+}
+
+func (s *ShareLinks) current() shareSettings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.settings
+}
+
+func (s *ShareLinks) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.current().secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (s *ShareLinks) encode(c shareClaims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload)), nil
+}
+
+func (s *ShareLinks) decode(token string) (c shareClaims, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return c, errInvalidShareLink
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return c, errInvalidShareLink
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return c, errInvalidShareLink
+	}
+	if !hmac.Equal(sig, s.sign(payload)) {
+		return c, errInvalidShareLink
+	}
+	if err = json.Unmarshal(payload, &c); err != nil {
+		return c, errInvalidShareLink
+	}
+	return c, nil
+}
+
+//authorize verifies the share token against the request host and path, counting the request as a download
+func (s *ShareLinks) authorize(token string, r *http.Request) (shareClaims, error) {
+	c, err := s.decode(token)
+	if err != nil {
+		return c, err
+	}
+	now := time.Now()
+	if now.After(c.expiry()) {
+		return c, errExpiredShareLink
+	}
+	if !c.covers(requestedHost(r), r.URL.Path) {
+		return c, errInvalidShareLink
+	}
+	if c.Downloads == 0 {
+		return c, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.usage[c.ID]
+	if !ok {
+		s.pruneExpired(now)
+		u = shareUsage{expires: c.expiry()}
+	}
+	if u.downloads >= c.Downloads {
+		return c, errExhaustedShareLink
+	}
+	u.downloads++
+	s.usage[c.ID] = u
+	return c, nil
+}
+
+//pruneExpired drops download counters for links past their expiry. Must be called with s.mu held
+func (s *ShareLinks) pruneExpired(now time.Time) {
+	for id, u := range s.usage {
+		if now.After(u.expires) {
+			delete(s.usage, id)
+		}
+	}
+}
+
+type shareLinkResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+//Mint handles POST requests for new share links. The target is supplied through the `path` form value
+//(e.g. /alias/path/to/key), optionally along with `prefix`, `ttl` (e.g. 48h), `downloads` and `redirect`. Links are
+//bound to the host the request is addressed to
+func (s *ShareLinks) Mint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.FormValue("path")
+	if !strings.HasPrefix(path, "/") || path == "/" {
+		http.Error(w, "Expected an absolute object path (e.g. /alias/path/to/key)", http.StatusBadRequest)
+		return
+	}
+	settings := s.current()
+	ttl := settings.defaultTTL
+	if v := r.FormValue("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl > settings.maxTTL {
+		http.Error(w, "Requested ttl exceeds the maximum of "+settings.maxTTL.String(), http.StatusBadRequest)
+		return
+	}
+	downloads := 0
+	if v := r.FormValue("downloads"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid downloads", http.StatusBadRequest)
+			return
+		}
+		downloads = n
+	}
+	prefix, err := formBool(r, "prefix")
+	if err != nil {
+		http.Error(w, "Invalid prefix", http.StatusBadRequest)
+		return
+	}
+	redirect, err := formBool(r, "redirect")
+	if err != nil {
+		http.Error(w, "Invalid redirect", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 12)
+	rand.Read(b)
+	expires := time.Now().Add(ttl)
+	claims := shareClaims{
+		ID:        base64.RawURLEncoding.EncodeToString(b),
+		Host:      requestedHost(r),
+		Path:      path,
+		Prefix:    prefix,
+		Expires:   expires.Unix(),
+		Downloads: downloads,
+		Redirect:  redirect,
+	}
+	token, err := s.encode(claims)
+	if err != nil {
+		logging.Errorf("cannot encode share link: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	link := resolve((&url.URL{Path: path}).EscapedPath(), r) + "?" + url.Values{shareQueryParam: {token}}.Encode()
+	logging.Infof("minted share link %s for %s expiring at %s", claims.ID, path, expires.UTC().Format(time.RFC3339))
+	recordAudit(s.audit, r, audit.Event{Action: audit.ShareMint, Key: path, ShareID: claims.ID, Status: http.StatusOK})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shareLinkResponse{URL: link, Expires: claims.expiry().UTC()})
+}
+
+func formBool(r *http.Request, key string) (bool, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+func withShareGrant(r *http.Request, c shareClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), shareGrantKey, c))
+}
+
+func shareGrant(r *http.Request) (shareClaims, bool) {
+	c, ok := r.Context().Value(shareGrantKey).(shareClaims)
+	return c, ok
+}
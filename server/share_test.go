@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+func testShareLinks() *ShareLinks {
+	var c config.ProgramConfig
+	c.Web.OAuth.SessionSecret = testSecret
+	return NewShareLinks(c, nil)
+}
+
+func mintShareLink(t *testing.T, shares *ShareLinks, form url.Values) string {
+	r, err := http.NewRequest("POST", ShareLinkPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Host = "example.com"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	shares.Mint(w, r)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", resp.StatusCode)
+	}
+	var body shareLinkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.URL
+}
+
+func getWithShareLink(shares *ShareLinks, link string) *http.Response {
+	r := httptest.NewRequest("GET", link, nil)
+	w := httptest.NewRecorder()
+	innerHandler := func(w http.ResponseWriter, r *http.Request) {}
+	handler := ValidatingSession([]string{"lenses.io"}, testSecret, innerHandler, WithShareLinks(shares))
+	handler.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func TestShareLinkGrantsAccessToObject(t *testing.T) {
+	shares := testShareLinks()
+	link := mintShareLink(t, shares, url.Values{"path": {"/b1/reports/q3.html"}})
+
+	if !strings.HasPrefix(link, "http://example.com/b1/reports/q3.html?share=") {
+		t.Errorf("Unexpected link %s", link)
+	}
+	if resp := getWithShareLink(shares, link); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	otherKey := strings.Replace(link, "q3.html", "q4.html", 1)
+	if resp := getWithShareLink(shares, otherKey); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestShareLinkWithPrefix(t *testing.T) {
+	shares := testShareLinks()
+	link := mintShareLink(t, shares, url.Values{"path": {"/b1/reports/"}, "prefix": {"true"}})
+	nested := strings.Replace(link, "/b1/reports/", "/b1/reports/2020/q3.html", 1)
+
+	if resp := getWithShareLink(shares, nested); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestShareLinkPrefixMatchesWholeSegments(t *testing.T) {
+	shares := testShareLinks()
+	link := mintShareLink(t, shares, url.Values{"path": {"/b1/reports"}, "prefix": {"true"}})
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/b1/reports", http.StatusOK},
+		{"/b1/reports/2020/q3.html", http.StatusOK},
+		{"/b1/reports-private/q3.html", http.StatusForbidden},
+		{"/b1/reportsq3.html", http.StatusForbidden},
+	} {
+		target := strings.Replace(link, "/b1/reports?", test.path+"?", 1)
+		if resp := getWithShareLink(shares, target); resp.StatusCode != test.status {
+			t.Errorf("%s: unexpected status code %d", test.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestShareLinkDownloadLimit(t *testing.T) {
+	shares := testShareLinks()
+	link := mintShareLink(t, shares, url.Values{"path": {"/b1/key"}, "downloads": {"2"}})
+
+	for i := 0; i < 2; i++ {
+		if resp := getWithShareLink(shares, link); resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status code %d", resp.StatusCode)
+		}
+	}
+	if resp := getWithShareLink(shares, link); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestShareLinkExpired(t *testing.T) {
+	shares := testShareLinks()
+	token, err := shares.encode(shareClaims{ID: "x", Path: "/b1/key", Expires: time.Now().Add(-time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := getWithShareLink(shares, "/b1/key?share="+token); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestShareLinkTampered(t *testing.T) {
+	shares := testShareLinks()
+	var c config.ProgramConfig
+	c.Web.OAuth.SessionSecret = "another-secret"
+	link := mintShareLink(t, NewShareLinks(c, nil), url.Values{"path": {"/b1/key"}})
+
+	if resp := getWithShareLink(shares, link); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestShareLinkTTLAboveMaximum(t *testing.T) {
+	form := url.Values{"path": {"/b1/key"}, "ttl": {"10000h"}}
+	r, err := http.NewRequest("POST", ShareLinkPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	testShareLinks().Mint(w, r)
+
+	if resp := w.Result(); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+type signingObjectStore struct {
+	dummyObjectStore
+}
+
+func (s *signingObjectStore) SignedURL(method, bucket, key string, expires time.Time) (string, error) {
+	return "https://storage.googleapis.com/" + bucket + "/" + key + "?X-Goog-Signature=sig", nil
+}
+
+func TestShareLinkRedirectsToSignedURL(t *testing.T) {
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"existing/key": dummyObject{contentType: "text/plain", body: "content"}},
+	}
+	objStore := &signingObjectStore{dummyObjectStore{byBucket: objectsByBucket}}
+	shares := testShareLinks()
+	link := mintShareLink(t, shares, url.Values{"path": {"/b1/existing/key"}, "redirect": {"true"}})
+
+	w := httptest.NewRecorder()
+	gcsHandler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore)
+	handler := ValidatingSession([]string{"lenses.io"}, testSecret, gcsHandler, WithShareLinks(shares))
+	handler.ServeHTTP(w, httptest.NewRequest("GET", link, nil))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "https://storage.googleapis.com/bucket1/existing/key?X-Goog-Signature=sig" {
+		t.Errorf("Unexpected location %s", loc)
+	}
+}
+
+func TestShareLinksReload(t *testing.T) {
+	shares := testShareLinks()
+	link := mintShareLink(t, shares, url.Values{"path": {"/b1/key"}, "downloads": {"1"}})
+	if resp := getWithShareLink(shares, link); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	var c config.ProgramConfig
+	c.Web.OAuth.SessionSecret = testSecret
+	c.Web.Share.MaxTTL = config.Duration{Duration: time.Hour}
+	shares.Reload(c)
+	if resp := getWithShareLink(shares, link); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the download counter to survive the reload, got status code %d", resp.StatusCode)
+	}
+	if settings := shares.current(); settings.maxTTL != time.Hour || settings.defaultTTL != time.Hour {
+		t.Errorf("Unexpected settings after reload %+v", settings)
+	}
+
+	c.Web.Share.Secret = "another-secret"
+	shares.Reload(c)
+	fresh := mintShareLink(t, testShareLinks(), url.Values{"path": {"/b1/key"}})
+	if resp := getWithShareLink(shares, fresh); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected links signed with the previous secret to be rejected, got status code %d", resp.StatusCode)
+	}
+}
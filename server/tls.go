@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+	"github.com/afiore/gcs-proxy/logging"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+//certCheckInterval bounds how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+//TLS holds the configuration of the HTTPS listener, along with the handler of the plain HTTP one
+type TLS struct {
+	Config *tls.Config
+	//Redirect redirects plain HTTP requests to HTTPS, answering ACME challenges where needed
+	Redirect http.Handler
+}
+
+//NewTLS sets up HTTPS from the supplied configuration, either loading the configured certificate or obtaining
+//certificates through ACME. HTTP/2 is negotiated by the server listening with the returned configuration
+func NewTLS(c config.ProgramConfig) (*TLS, error) {
+	t := c.Web.TLS
+	redirect := redirectToHTTPS(c.Web.Port)
+	if len(t.ACMEDomains) > 0 {
+		if t.ACMECacheDir == "" {
+			return nil, fmt.Errorf("an ACME cache directory is required to obtain certificates")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(t.ACMEDomains...),
+			Cache:      autocert.DirCache(t.ACMECacheDir),
+			Email:      t.ACMEEmail,
+		}
+		return &TLS{Config: m.TLSConfig(), Redirect: m.HTTPHandler(redirect)}, nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, fmt.Errorf("TLS requires either a certificate and key file or ACME domains")
+	}
+	certs := &certLoader{certFile: t.CertFile, keyFile: t.KeyFile, now: time.Now}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	return &TLS{
+		Config:   &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate},
+		Redirect: redirect,
+	}, nil
+}
+
+//certLoader serves a certificate loaded from files, reloading it when the files change
+type certLoader struct {
+	certFile string
+	keyFile  string
+	now      func() time.Time
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+//lastModified returns the most recent modification time of the certificate and key files
+func (l *certLoader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (l *certLoader) load() error {
+	modTime, err := l.lastModified()
+	if err != nil {
+		return fmt.Errorf("cannot read TLS certificate: %s", err.Error())
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate: %s", err.Error())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cert, l.modTime, l.checkedAt = &cert, modTime, l.now()
+	return nil
+}
+
+func (l *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	cert, loadedModTime, stale := l.cert, l.modTime, l.now().Sub(l.checkedAt) >= certCheckInterval
+	if stale {
+		l.checkedAt = l.now()
+	}
+	l.mu.Unlock()
+	if !stale {
+		return cert, nil
+	}
+	modTime, err := l.lastModified()
+	if err != nil || !modTime.After(loadedModTime) {
+		return cert, nil
+	}
+	//keep serving the previous certificate until a valid pair is in place
+	if err := l.load(); err != nil {
+		logging.Errorf("cannot reload TLS certificate, serving the previous one: %v", err)
+		return cert, nil
+	}
+	logging.Infof("reloaded TLS certificate from %s", l.certFile)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cert, nil
+}
+
+//redirectToHTTPS permanently redirects requests to the same URL on the HTTPS port
+func redirectToHTTPS(httpsPort int16) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 && httpsPort != 0 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(httpsPort)))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+//HSTS advertises the Strict-Transport-Security policy configured for TLS on responses served over HTTPS
+func HSTS(c config.ProgramConfig, next http.Handler) http.Handler {
+	maxAge := c.Web.TLS.HSTSMaxAge.Duration
+	if maxAge == 0 {
+		maxAge = defaultHSTSMaxAge
+	}
+	if !c.Web.TLS.Enabled || maxAge < 0 {
+		return next
+	}
+	policy := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if c.Web.TLS.HSTSIncludeSubdomains {
+		policy += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", policy)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afiore/gcs-proxy/config"
+)
+
+//writeCertificate writes a self-signed certificate for localhost, identified by serial, to certFile and keyFile
+func writeCertificate(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tlsConfig(t *testing.T) config.ProgramConfig {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	var c config.ProgramConfig
+	c.Web.Port = 8443
+	c.Web.TLS.Enabled = true
+	c.Web.TLS.CertFile = filepath.Join(dir, "cert.pem")
+	c.Web.TLS.KeyFile = filepath.Join(dir, "key.pem")
+	writeCertificate(t, c.Web.TLS.CertFile, c.Web.TLS.KeyFile, 1)
+	return c
+}
+
+func TestServesHTTP2WithHSTS(t *testing.T) {
+	c := tlsConfig(t)
+	tlsSetup, err := NewTLS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scheme string
+	handler, err := ExternalURL(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme = external(r).scheme
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(HSTS(c, handler))
+	server.TLS = tlsSetup.Config
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Unexpected protocol %s", resp.Proto)
+	}
+	if hsts := resp.Header.Get("Strict-Transport-Security"); hsts != "max-age=31536000" {
+		t.Errorf("Unexpected HSTS header %s", hsts)
+	}
+	if scheme != "https" {
+		t.Errorf("Unexpected scheme %s", scheme)
+	}
+}
+
+func TestReloadsModifiedCertificate(t *testing.T) {
+	c := tlsConfig(t)
+	now := time.Now()
+	certs := &certLoader{certFile: c.Web.TLS.CertFile, keyFile: c.Web.TLS.KeyFile, now: func() time.Time { return now }}
+	if err := certs.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeCertificate(t, c.Web.TLS.CertFile, c.Web.TLS.KeyFile, 2)
+	future := now.Add(time.Minute)
+	os.Chtimes(c.Web.TLS.CertFile, future, future)
+	now = now.Add(certCheckInterval)
+
+	cert, err := certs.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected the modified certificate to be served, got serial %d", leaf.SerialNumber)
+	}
+}
+
+func TestRedirectsToHTTPS(t *testing.T) {
+	tlsSetup, err := NewTLS(tlsConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	tlsSetup.Redirect.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:8080/b1/key?x=1", nil))
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("Unexpected status code %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://example.com:8443/b1/key?x=1" {
+		t.Errorf("Unexpected location %s", loc)
+	}
+}
+
+func TestReloadsCertificateDuringConcurrentHandshakes(t *testing.T) {
+	c := tlsConfig(t)
+	base := time.Now()
+	var ticks int64
+	//every handshake finds the certificate stale, while the files keep being modified
+	now := func() time.Time { return base.Add(time.Duration(atomic.AddInt64(&ticks, 1)) * certCheckInterval) }
+	certs := &certLoader{certFile: c.Web.TLS.CertFile, keyFile: c.Web.TLS.KeyFile, now: now}
+	if err := certs.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if i == 0 {
+					future := base.Add(time.Duration(j+1) * time.Hour)
+					os.Chtimes(c.Web.TLS.CertFile, future, future)
+				}
+				if cert, err := certs.getCertificate(nil); err != nil || cert == nil {
+					t.Errorf("Unexpected certificate %v (%v)", cert, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
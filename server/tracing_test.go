@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/afiore/gcs-proxy/tracing"
+	"github.com/gorilla/securecookie"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracedRequestSpans(t *testing.T) {
+	exporter := tracing.SetupInMemory()
+
+	objectsByBucket := map[string]map[string]dummyObject{
+		"bucket1": {"existing/key": dummyObject{contentType: "text/plain", body: "content"}},
+	}
+	objStore := tracing.InstrumentStore(&dummyObjectStore{byBucket: objectsByBucket})
+	gcsHandler := ServeFromBuckets(map[string]string{"b1": "bucket1"}, objStore)
+	handler := Traced(ValidatingSession([]string{"lenses.io"}, testSecret, gcsHandler))
+
+	encoded, err := securecookie.New([]byte(testSecret), nil).Encode(sessionCookieName, map[string]string{
+		userHostedDomainKey: "lenses.io",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/b1/existing/key", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: encoded})
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if resp := w.Result(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	spans := exporter.GetSpans()
+	names := map[string]bool{}
+	byName := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		names[span.Name] = true
+		byName[span.Name] = span
+		if traceID := span.SpanContext.TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Span %s has unexpected trace id %s", span.Name, traceID)
+		}
+	}
+	for _, expected := range []string{"HTTP GET", "ValidatingSession", "GetObjectMetadata", "CopyObject"} {
+		if !names[expected] {
+			t.Errorf("Expected a %s span among %v", expected, names)
+		}
+	}
+
+	//the store spans are nested within the session validation, which covers the whole request
+	validation := byName["ValidatingSession"]
+	for _, name := range []string{"GetObjectMetadata", "CopyObject"} {
+		span := byName[name]
+		if span.Parent.SpanID() != validation.SpanContext.SpanID() {
+			t.Errorf("Expected the %s span to be a child of the ValidatingSession span", name)
+		}
+		if span.EndTime.After(validation.EndTime) {
+			t.Errorf("The %s span ended after the ValidatingSession span", name)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"io"
 	"time"
 )
@@ -10,12 +12,53 @@ type ObjectMetadata interface {
 	ContentType() string
 	Size() int64
 	Updated() time.Time
+	//Generation identifies the object content. It changes every time the object is overwritten
+	Generation() int64
+	CacheControl() string
+	ContentEncoding() string
+	ContentLanguage() string
+	ContentDisposition() string
+	//Metadata returns the custom metadata of the object, set through x-goog-meta-* headers, keyed by the header name
+	//stripped of the x-goog-meta- prefix
+	Metadata() map[string]string
 }
 
 //ObjectStoreOps exposes basic operations on objects
 type ObjectStoreOps interface {
-	GetObjectMetadata(bucket, key string) (ObjectMetadata, error)
-	CopyObject(bucket, key string, w io.Writer) (int64, error)
+	GetObjectMetadata(ctx context.Context, bucket, key string) (ObjectMetadata, error)
+	CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error)
+}
+
+//URLSigner is implemented by stores able to issue time limited URLs granting direct read access to an object. The
+//signature covers the HTTP method, GET or HEAD, the URL is requested with
+type URLSigner interface {
+	SignedURL(method, bucket, key string, expires time.Time) (string, error)
+}
+
+//ObjectWriter is implemented by stores able to create objects
+type ObjectWriter interface {
+	PutObject(ctx context.Context, bucket, key string, r io.Reader) error
+}
+
+//HealthChecker is implemented by stores able to cheaply verify that a bucket is reachable
+type HealthChecker interface {
+	CheckBucket(ctx context.Context, bucket string) error
+}
+
+//ListEntry is an object, or a common prefix when listing with a delimiter, returned by Lister
+type ListEntry struct {
+	//Key is the object key, or the common prefix including the trailing delimiter
+	Key string
+	//Metadata is nil for common prefixes
+	Metadata ObjectMetadata
+}
+
+//Lister is implemented by stores able to list the objects of a bucket
+type Lister interface {
+	//ListObjects calls fn, in lexicographic order, with the objects whose key starts with prefix. With a non empty
+	//delimiter, the keys containing it after the prefix are reported once, as their common prefix. Listing stops at
+	//the first error returned by fn
+	ListObjects(ctx context.Context, bucket, prefix, delimiter string, fn func(ListEntry) error) error
 }
 
 //ObjectNotFound is the error value returned by GetObject when the supplied key is not found
@@ -25,3 +68,36 @@ type ObjectNotFound struct {
 }
 
 func (e *ObjectNotFound) Error() string { return e.Key + " not found in bucket " + e.Bucket }
+
+//Is makes ObjectNotFound match ErrNotFound
+func (e *ObjectNotFound) Is(target error) bool { return target == ErrNotFound }
+
+//Error kinds classifying the failures of store operations
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrForbidden          = errors.New("forbidden")
+	ErrUnavailable        = errors.New("store unavailable")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrCanceled           = errors.New("canceled")
+)
+
+//Error reports the failure of a store operation, classified by one of the error kinds above
+type Error struct {
+	Op     string
+	Bucket string
+	Key    string
+	Kind   error
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Op + " " + e.Bucket + "/" + e.Key + ": " + e.Kind.Error() + ": " + e.Err.Error()
+}
+
+//Is makes the error match its kind
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+//ErrNotSupported is returned by stores and decorators when the requested operation is unavailable for the underlying backend
+var ErrNotSupported = errors.New("operation not supported by the object store")
@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/afiore/gcs-proxy/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracedStore struct {
+	upstream store.ObjectStoreOps
+}
+
+//InstrumentStore decorates the supplied store, recording a span for each of its operations
+func InstrumentStore(upstream store.ObjectStoreOps) store.ObjectStoreOps {
+	return &tracedStore{upstream: upstream}
+}
+
+func startSpan(ctx context.Context, name, bucket, key string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("gcs.bucket", bucket),
+		attribute.String("gcs.key", key),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	var notFound *store.ObjectNotFound
+	if err != nil && !errors.As(err, &notFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *tracedStore) GetObjectMetadata(ctx context.Context, bucket, key string) (store.ObjectMetadata, error) {
+	ctx, span := startSpan(ctx, "GetObjectMetadata", bucket, key)
+	meta, err := s.upstream.GetObjectMetadata(ctx, bucket, key)
+	if err == nil {
+		span.SetAttributes(attribute.Int64("gcs.size", meta.Size()), attribute.Int64("gcs.generation", meta.Generation()))
+	}
+	endSpan(span, err)
+	return meta, err
+}
+
+func (s *tracedStore) CopyObject(ctx context.Context, bucket, key string, w io.Writer) (int64, error) {
+	ctx, span := startSpan(ctx, "CopyObject", bucket, key)
+	n, err := s.upstream.CopyObject(ctx, bucket, key, w)
+	span.SetAttributes(attribute.Int64("gcs.bytes_copied", n))
+	endSpan(span, err)
+	return n, err
+}
+
+func (s *tracedStore) SignedURL(method, bucket, key string, expires time.Time) (string, error) {
+	signer, ok := s.upstream.(store.URLSigner)
+	if !ok {
+		return "", store.ErrNotSupported
+	}
+	return signer.SignedURL(method, bucket, key, expires)
+}
+
+func (s *tracedStore) ListObjects(ctx context.Context, bucket, prefix, delimiter string, fn func(store.ListEntry) error) error {
+	lister, ok := s.upstream.(store.Lister)
+	if !ok {
+		return store.ErrNotSupported
+	}
+	ctx, span := startSpan(ctx, "ListObjects", bucket, prefix)
+	err := lister.ListObjects(ctx, bucket, prefix, delimiter, fn)
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,31 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+//Version, Commit and Date identify the build. They are set at link time, e.g.
+//go build -ldflags "-X github.com/afiore/gcs-proxy/version.Version=v1.2.0"
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+//BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+//Info returns the build information, falling back to the module version recorded by the Go toolchain when available
+func Info() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	return info
+}